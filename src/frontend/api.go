@@ -0,0 +1,297 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+// apiErrorBody is the envelope of every error returned by the JSON API:
+//
+//	{"error":{"code":"invalid_argument","message":"...","fields":[...]}}
+//
+// HTML handlers keep rendering the error page instead.
+type apiErrorBody struct {
+	Error apiError `json:"error"`
+}
+
+type apiError struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Fields  []apiFieldError `json:"fields"`
+}
+
+// apiFieldError describes why the value of a single request field was
+// rejected.
+type apiFieldError struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// grpcHTTPStatus maps the gRPC codes surfaced by the API to HTTP statuses.
+// Other codes are reported as internal errors.
+var grpcHTTPStatus = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+}
+
+// newAPIError returns an error envelope with an empty field list.
+func newAPIError(code, message string) apiError {
+	return apiError{Code: code, Message: message, Fields: []apiFieldError{}}
+}
+
+// apiErrorFromGRPC converts an error returned by a downstream call into an
+// HTTP status and error envelope. Field violations attached to an
+// InvalidArgument status are reported in the fields array.
+func apiErrorFromGRPC(err error) (int, apiError) {
+	st := status.Convert(err)
+	code, ok := grpcHTTPStatus[st.Code()]
+	if !ok {
+		return http.StatusInternalServerError, newAPIError("internal", "internal error")
+	}
+	e := newAPIError(snakeCase(st.Code().String()), st.Message())
+	for _, d := range st.Details() {
+		if br, ok := d.(*errdetails.BadRequest); ok {
+			for _, v := range br.GetFieldViolations() {
+				e.Fields = append(e.Fields, apiFieldError{Field: v.GetField(), Description: v.GetDescription()})
+			}
+		}
+	}
+	return code, e
+}
+
+// writeAPIError writes e as the JSON body of a response with the given status.
+func writeAPIError(log logrus.FieldLogger, w http.ResponseWriter, code int, e apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(apiErrorBody{Error: e}); err != nil {
+		log.WithField("error", err).Warn("failed to write API error")
+	}
+}
+
+// snakeCase converts a CamelCase gRPC code name to snake_case.
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// apiProduct is the JSON representation of a product, priced in the
+// requested currency.
+type apiProduct struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Picture     string   `json:"picture"`
+	Categories  []string `json:"categories"`
+	Price       apiMoney `json:"price"`
+}
+
+type apiMoney struct {
+	CurrencyCode string `json:"currency_code"`
+	Units        int64  `json:"units"`
+	Nanos        int32  `json:"nanos"`
+}
+
+// apiProductHandler serves GET /api/product/{id}. The price is converted to
+// the currency given by the "currency" query parameter, or else the session
+// currency.
+func (fe *frontendServer) apiProductHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	id := mux.Vars(r)["id"]
+	currency := r.URL.Query().Get("currency")
+	if currency == "" {
+		currency = currentCurrency(r)
+	}
+
+	currencies, err := fe.getCurrencies(r.Context())
+	if err != nil {
+		log.WithField("error", err).Error("could not retrieve currencies")
+		code, e := apiErrorFromGRPC(err)
+		writeAPIError(log, w, code, e)
+		return
+	}
+	if !contains(currencies, currency) {
+		e := newAPIError("invalid_argument", "unsupported currency")
+		e.Fields = append(e.Fields, apiFieldError{Field: "currency", Description: "must be one of " + strings.Join(currencies, ", ")})
+		writeAPIError(log, w, http.StatusBadRequest, e)
+		return
+	}
+
+	p, err := fe.getProduct(r.Context(), id)
+	if err != nil {
+		code, e := apiErrorFromGRPC(err)
+		if code >= http.StatusInternalServerError {
+			log.WithField("error", errors.Wrap(err, "could not retrieve product")).Error("request error")
+		}
+		writeAPIError(log, w, code, e)
+		return
+	}
+	price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currency)
+	if err != nil {
+		log.WithField("error", errors.Wrap(err, "failed to convert currency")).Error("request error")
+		code, e := apiErrorFromGRPC(err)
+		writeAPIError(log, w, code, e)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(newAPIProduct(p, price)); err != nil {
+		log.WithField("error", err).Warn("failed to write API response")
+	}
+}
+
+func newAPIProduct(p *pb.Product, price *pb.Money) apiProduct {
+	categories := p.GetCategories()
+	if categories == nil {
+		categories = []string{}
+	}
+	return apiProduct{
+		ID:          p.GetId(),
+		Name:        p.GetName(),
+		Description: p.GetDescription(),
+		Picture:     p.GetPicture(),
+		Categories:  categories,
+		Price:       newAPIMoney(price),
+	}
+}
+
+func newAPIMoney(m *pb.Money) apiMoney {
+	return apiMoney{
+		CurrencyCode: m.GetCurrencyCode(),
+		Units:        m.GetUnits(),
+		Nanos:        m.GetNanos(),
+	}
+}
+
+// apiCart is the JSON representation of a cart, priced in the session
+// currency. Items whose product went away have no product details.
+type apiCart struct {
+	Currency string        `json:"currency"`
+	Items    []apiCartItem `json:"items"`
+	Subtotal apiMoney      `json:"subtotal"`
+}
+
+type apiCartItem struct {
+	ProductID   string      `json:"product_id"`
+	Quantity    int32       `json:"quantity"`
+	Product     *apiProduct `json:"product,omitempty"`
+	Total       *apiMoney   `json:"total,omitempty"`
+	Unavailable bool        `json:"unavailable,omitempty"`
+}
+
+// cartExportHandler serves GET /cart/export, the cart of the user as a JSON
+// file to download.
+func (fe *frontendServer) cartExportHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	fail := func(err error) {
+		log.WithField("error", err).Error("request error")
+		code, e := apiErrorFromGRPC(errors.Cause(err))
+		writeAPIError(log, w, code, e)
+	}
+	cart, err := fe.getCart(r.Context(), userID(r))
+	if err != nil {
+		fail(errors.Wrap(err, "could not retrieve cart"))
+		return
+	}
+
+	out := apiCart{Items: make([]apiCartItem, len(cart))}
+	// The session currency may be reset to the default while converting, so
+	// the subtotal takes the currency of the converted prices.
+	var subtotal *pb.Money
+	for i, item := range cart {
+		out.Items[i] = apiCartItem{ProductID: item.GetProductId(), Quantity: item.GetQuantity()}
+		p, err := fe.getProduct(r.Context(), item.GetProductId())
+		if isProductUnavailable(err) {
+			out.Items[i].Unavailable = true
+			continue
+		}
+		if err != nil {
+			fail(errors.Wrapf(err, "could not retrieve product #%s", item.GetProductId()))
+			return
+		}
+		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
+		if err != nil {
+			fail(errors.Wrapf(err, "could not convert currency for product #%s", item.GetProductId()))
+			return
+		}
+		product := newAPIProduct(p, price)
+		total := money.MultiplySlow(*price, uint32(item.GetQuantity()))
+		totalJSON := newAPIMoney(&total)
+		out.Items[i].Product, out.Items[i].Total = &product, &totalJSON
+		if subtotal == nil {
+			subtotal = &total
+			continue
+		}
+		sum, err := money.Sum(*subtotal, total)
+		if err != nil {
+			fail(errors.Wrapf(err, "could not add up the price of product #%s", item.GetProductId()))
+			return
+		}
+		subtotal = &sum
+	}
+	out.Currency = currentCurrency(r)
+	if subtotal == nil {
+		subtotal = &pb.Money{CurrencyCode: out.Currency}
+	}
+	out.Subtotal = newAPIMoney(subtotal)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="cart.json"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		log.WithField("error", err).Warn("failed to write API response")
+	}
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// decodeAPIError decodes an error envelope, failing the test if the body
+// has any other shape.
+func decodeAPIError(t *testing.T, w *httptest.ResponseRecorder) apiError {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body is not a JSON object: %v: %s", err, w.Body.String())
+	}
+	if len(body) != 1 || body["error"] == nil {
+		t.Fatalf("body = %s, want a single \"error\" member", w.Body.String())
+	}
+	dec := json.NewDecoder(bytes.NewReader(body["error"]))
+	dec.DisallowUnknownFields()
+	var e apiError
+	if err := dec.Decode(&e); err != nil {
+		t.Fatalf("unexpected error shape: %v: %s", err, w.Body.String())
+	}
+	if e.Fields == nil {
+		t.Errorf("fields is missing or null: %s", w.Body.String())
+	}
+	return e
+}
+
+func TestWriteAPIError_validationFailure(t *testing.T) {
+	st, err := status.New(codes.InvalidArgument, "invalid order").WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: "email", Description: "must be a valid e-mail address"},
+			{Field: "address.zip_code", Description: "must be 5 digits"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, e := apiErrorFromGRPC(st.Err())
+	w := httptest.NewRecorder()
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	writeAPIError(log, w, code, e)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	got := decodeAPIError(t, w)
+	want := apiError{
+		Code:    "invalid_argument",
+		Message: "invalid order",
+		Fields: []apiFieldError{
+			{Field: "email", Description: "must be a valid e-mail address"},
+			{Field: "address.zip_code", Description: "must be 5 digits"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestAPIErrorFromGRPC_codes(t *testing.T) {
+	tests := []struct {
+		err      error
+		wantHTTP int
+		wantCode string
+	}{
+		{status.Error(codes.NotFound, "no such product"), http.StatusNotFound, "not_found"},
+		{status.Error(codes.ResourceExhausted, "slow down"), http.StatusTooManyRequests, "resource_exhausted"},
+		{status.Error(codes.Internal, "boom"), http.StatusInternalServerError, "internal"},
+		{errors.New("not a status"), http.StatusInternalServerError, "internal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantCode, func(t *testing.T) {
+			code, e := apiErrorFromGRPC(tt.err)
+			if code != tt.wantHTTP || e.Code != tt.wantCode {
+				t.Errorf("apiErrorFromGRPC(%v) = %d %q, want %d %q", tt.err, code, e.Code, tt.wantHTTP, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestAPIProductHandler(t *testing.T) {
+	fe := newTestFrontend(t, &frontendServer{}, newFakeBackends())
+
+	tests := []struct {
+		name       string
+		id         string
+		target     string
+		cookie     string
+		wantStatus int
+		wantPrice  apiMoney
+		wantError  string
+	}{
+		{"session currency", "OLJCESPC7Z", "/api/product/OLJCESPC7Z", "EUR", http.StatusOK,
+			apiMoney{CurrencyCode: "EUR", Units: 19, Nanos: 990000000}, ""},
+		{"query overrides cookie", "OLJCESPC7Z", "/api/product/OLJCESPC7Z?currency=JPY", "EUR", http.StatusOK,
+			apiMoney{CurrencyCode: "JPY", Units: 19, Nanos: 990000000}, ""},
+		{"missing product", "GONE", "/api/product/GONE", "", http.StatusNotFound, apiMoney{}, "not_found"},
+		{"bad currency", "OLJCESPC7Z", "/api/product/OLJCESPC7Z?currency=XXX", "", http.StatusBadRequest, apiMoney{}, "invalid_argument"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mux.SetURLVars(newTestRequest(http.MethodGet, tt.target, nil), map[string]string{"id": tt.id})
+			if tt.cookie != "" {
+				r = r.WithContext(context.WithValue(r.Context(), ctxKeyCurrency{}, tt.cookie))
+			}
+			w := httptest.NewRecorder()
+			fe.apiProductHandler(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantError != "" {
+				if e := decodeAPIError(t, w); e.Code != tt.wantError {
+					t.Errorf("error code = %q, want %q", e.Code, tt.wantError)
+				}
+				return
+			}
+			var got apiProduct
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != tt.id || got.Name != "Sunglasses" || got.Price != tt.wantPrice {
+				t.Errorf("got %+v, want %s priced %+v", got, tt.id, tt.wantPrice)
+			}
+		})
+	}
+}
+
+func TestCartExportHandler(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}, {ProductId: "DISCONTINUED", Quantity: 1}}
+	fb.carts["another-session"] = []*pb.CartItem{{ProductId: "1YMWWN1N4O", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	w := httptest.NewRecorder()
+	fe.cartExportHandler(w, newTestRequest(http.MethodGet, "/cart/export", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="cart.json"` {
+		t.Errorf("Content-Disposition = %q, want an attachment", got)
+	}
+	var got apiCart
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Items) != 2 {
+		t.Fatalf("exported %d items, want the 2 of the session's cart: %+v", len(got.Items), got.Items)
+	}
+	if p := got.Items[0].Product; p == nil || p.Name != "Sunglasses" || got.Items[0].Quantity != 2 {
+		t.Errorf("first item = %+v, want 2 Sunglasses with their details", got.Items[0])
+	}
+	if !got.Items[1].Unavailable || got.Items[1].Product != nil {
+		t.Errorf("second item = %+v, want it flagged unavailable", got.Items[1])
+	}
+	if want := (apiMoney{CurrencyCode: "USD", Units: 39, Nanos: 980000000}); got.Subtotal != want {
+		t.Errorf("subtotal = %+v, want %+v", got.Subtotal, want)
+	}
+}
+
+func TestCartExportHandler_resetsUnsupportedCurrency(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}, {ProductId: "66VCHSJNUP", Quantity: 1}}
+	fb.convert = func(req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+		if req.GetToCode() == "TRY" {
+			return nil, status.Error(codes.InvalidArgument, "unsupported currency: TRY")
+		}
+		return &pb.Money{CurrencyCode: req.GetToCode(), Units: req.GetFrom().GetUnits(), Nanos: req.GetFrom().GetNanos()}, nil
+	}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	r := newTestRequest(http.MethodGet, "/cart/export", nil)
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "TRY"})
+	w := httptest.NewRecorder()
+	fe.ensureCurrency(http.HandlerFunc(fe.cartExportHandler)).ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var got apiCart
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Currency != defaultCurrency {
+		t.Errorf("currency = %q, want the default %s", got.Currency, defaultCurrency)
+	}
+	if want := (apiMoney{CurrencyCode: defaultCurrency, Units: 38, Nanos: 980000000}); got.Subtotal != want {
+		t.Errorf("subtotal = %+v, want %+v", got.Subtotal, want)
+	}
+}
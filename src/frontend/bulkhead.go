@@ -0,0 +1,87 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultConcurrencyWait is how long a call waits for one of the concurrency
+// slots of its service when DOWNSTREAM_CONCURRENCY_WAIT is not set.
+const defaultConcurrencyWait = 50 * time.Millisecond
+
+// serviceConcurrencyKeys are the environment variables holding the maximum
+// number of concurrent calls to each service, by service label.
+var serviceConcurrencyKeys = map[string]string{
+	"adservice":             "AD_MAX_CONCURRENCY",
+	"cartservice":           "CART_MAX_CONCURRENCY",
+	"checkoutservice":       "CHECKOUT_MAX_CONCURRENCY",
+	"currencyservice":       "CURRENCY_MAX_CONCURRENCY",
+	"productcatalogservice": "PRODUCT_CATALOG_MAX_CONCURRENCY",
+	"recommendationservice": "RECOMMENDATION_MAX_CONCURRENCY",
+	"shippingservice":       "SHIPPING_MAX_CONCURRENCY",
+}
+
+// mustMapServiceConcurrency sets up a semaphore for each service with a
+// maximum number of concurrent calls, and the wait for them from
+// DOWNSTREAM_CONCURRENCY_WAIT.
+func mustMapServiceConcurrency(svc *frontendServer) {
+	svc.concurrencyWait = defaultConcurrencyWait
+	mustMapEnvDuration(&svc.concurrencyWait, "DOWNSTREAM_CONCURRENCY_WAIT")
+	for service, key := range serviceConcurrencyKeys {
+		var n int
+		mustMapEnvInt(&n, key)
+		if n > 0 {
+			if svc.serviceSemaphores == nil {
+				svc.serviceSemaphores = make(map[string]chan struct{})
+			}
+			svc.serviceSemaphores[service] = make(chan struct{}, n)
+		}
+	}
+}
+
+// limitServiceConcurrency is a client-side bulkhead: it holds one of the
+// concurrency slots of the service called for the duration of the call,
+// retries included. Calls that get none within the concurrency wait fail
+// with ResourceExhausted, which pages handle like the service being down:
+// optional content is left out, while pages needing it render an error.
+func (fe *frontendServer) limitServiceConcurrency(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	service := serviceLabel(method)
+	sem, ok := fe.serviceSemaphores[service]
+	if !ok {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	select {
+	case sem <- struct{}{}:
+	default:
+		timer := time.NewTimer(fe.concurrencyWait)
+		defer timer.Stop()
+		select {
+		case sem <- struct{}{}:
+		case <-timer.C:
+			bulkheadRejections.WithLabelValues(service).Inc()
+			return status.Errorf(codes.ResourceExhausted, "too many concurrent calls to %s", service)
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	defer func() { <-sem }()
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLimitServiceConcurrency(t *testing.T) {
+	fe := &frontendServer{
+		serviceSemaphores: map[string]chan struct{}{"cartservice": make(chan struct{}, 2)},
+		concurrencyWait:   20 * time.Millisecond,
+	}
+	rejections := bulkheadRejections.WithLabelValues("cartservice")
+	before := testutil.ToFloat64(rejections)
+
+	var inFlight, maxInFlight int32
+	release := make(chan struct{})
+	invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		<-release
+		return nil
+	}
+
+	const calls = 5
+	errs := make(chan error, calls)
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- fe.limitServiceConcurrency(context.Background(), "/hipstershop.CartService/GetCart", nil, nil, nil, invoker)
+		}()
+	}
+	// The calls beyond the limit fail while the others are still holding
+	// their slots.
+	for i := 0; i < calls-2; i++ {
+		if err := <-errs; status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("call over the limit: error = %v, want ResourceExhausted", err)
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("call within the limit: error = %v", err)
+		}
+	}
+
+	if maxInFlight != 2 {
+		t.Errorf("%d concurrent calls, want 2", maxInFlight)
+	}
+	if got := testutil.ToFloat64(rejections); got != before+calls-2 {
+		t.Errorf("frontend_bulkhead_rejections_total = %v, want %v", got, before+calls-2)
+	}
+}
+
+func TestLimitServiceConcurrency_otherServices(t *testing.T) {
+	fe := &frontendServer{serviceSemaphores: map[string]chan struct{}{"cartservice": make(chan struct{})}}
+	called := false
+	invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		called = true
+		return nil
+	}
+	if err := fe.limitServiceConcurrency(context.Background(), "/hipstershop.CurrencyService/Convert", nil, nil, nil, invoker); err != nil || !called {
+		t.Errorf("call to a service without a limit: called = %v, error = %v", called, err)
+	}
+}
+
+func TestMustMapServiceConcurrency(t *testing.T) {
+	setenv(t, "CART_MAX_CONCURRENCY", "8")
+	setenv(t, "DOWNSTREAM_CONCURRENCY_WAIT", "10ms")
+	svc := new(frontendServer)
+	mustMapServiceConcurrency(svc)
+
+	if got := cap(svc.serviceSemaphores["cartservice"]); got != 8 {
+		t.Errorf("cart concurrency limit = %d, want 8", got)
+	}
+	if _, ok := svc.serviceSemaphores["checkoutservice"]; ok {
+		t.Error("checkout calls are limited without CHECKOUT_MAX_CONCURRENCY")
+	}
+	if svc.concurrencyWait != 10*time.Millisecond {
+		t.Errorf("concurrency wait = %v, want 10ms", svc.concurrencyWait)
+	}
+}
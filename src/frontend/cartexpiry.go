@@ -0,0 +1,55 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "net/http"
+
+// The cart service may expire carts, which otherwise just look empty. A
+// session cookie marks that the cart had items, so that the cart page can
+// tell an expired cart from one the user emptied. Carts emptied elsewhere,
+// e.g. from another device of a signed-in user, look expired too.
+
+// hadCartItems reports whether the session's cart last had items.
+func hadCartItems(r *http.Request) bool {
+	_, err := r.Cookie(cookieCartItems)
+	return err == nil
+}
+
+// markCartItems records whether the session's cart has items, setting the
+// cookie only if that changed.
+func (fe *frontendServer) markCartItems(w http.ResponseWriter, r *http.Request, has bool) {
+	if has == hadCartItems(r) {
+		return
+	}
+	c := &http.Cookie{
+		Name:   cookieCartItems,
+		Value:  "1",
+		Domain: fe.cookieDomainFor(r),
+		MaxAge: cookieMaxAge,
+	}
+	if !has {
+		c.Value, c.MaxAge = "", -1
+	}
+	http.SetCookie(w, c)
+}
+
+// cartExpired reports whether the cart being viewed, empty or not, has
+// expired since it last had items. It updates the mark, so that an expired
+// cart is noted once.
+func (fe *frontendServer) cartExpired(w http.ResponseWriter, r *http.Request, empty bool) bool {
+	expired := fe.cartExpiryNotice && empty && hadCartItems(r)
+	fe.markCartItems(w, r, !empty)
+	return expired
+}
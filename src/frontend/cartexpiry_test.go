@@ -0,0 +1,85 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withCookies returns r with the cookies set by w.
+func withCookies(r *http.Request, w *httptest.ResponseRecorder) *http.Request {
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			r.AddCookie(c)
+		}
+	}
+	return r
+}
+
+// markCleared reports whether w clears the cart items cookie.
+func markCleared(w *httptest.ResponseRecorder) bool {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cookieCartItems && c.MaxAge < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestViewCartHandler_expiryNotice(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{cartExpiryNotice: true}, fb)
+
+	added := httptest.NewRecorder()
+	fe.addToCartHandler(added, newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity=1")))
+	if added.Code != http.StatusFound {
+		t.Fatalf("add to cart: status = %d, want %d", added.Code, http.StatusFound)
+	}
+
+	// The cart service expires the cart.
+	delete(fb.carts, testSessionID)
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, withCookies(newTestRequest(http.MethodGet, "/cart", nil), added))
+	if !strings.Contains(w.Body.String(), "Your cart expired") {
+		t.Error("cart page does not note that the cart expired")
+	}
+	if !markCleared(w) {
+		t.Errorf("Set-Cookie = %q, want the %s cookie cleared", w.Header()["Set-Cookie"], cookieCartItems)
+	}
+
+	w = httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+	if strings.Contains(w.Body.String(), "Your cart expired") {
+		t.Error("cart page notes the expiry again")
+	}
+}
+
+func TestEmptyCartHandler_clearsMark(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{cartExpiryNotice: true}, fb)
+
+	added := httptest.NewRecorder()
+	fe.addToCartHandler(added, newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity=1")))
+	w := httptest.NewRecorder()
+	fe.emptyCartHandler(w, withCookies(newTestRequest(http.MethodPost, "/cart/empty", nil), added))
+
+	if !markCleared(w) {
+		t.Errorf("Set-Cookie = %q, want the %s cookie cleared so that the cart does not look expired", w.Header()["Set-Cookie"], cookieCartItems)
+	}
+}
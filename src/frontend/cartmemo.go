@@ -0,0 +1,53 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+type ctxKeyCartMemo struct{}
+
+// cartMemo holds the cart fetched while handling a request, so that the
+// parts of a page needing it share a single cart service call.
+type cartMemo struct {
+	mu     sync.Mutex
+	userID string
+	items  []*pb.CartItem
+	ok     bool
+}
+
+// memoizeCart makes getCart fetch each cart at most once per request,
+// until it is changed.
+func memoizeCart(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), ctxKeyCartMemo{}, &cartMemo{})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// forgetCart drops the cart memoized for the request ctx belongs to, after
+// it was changed.
+func forgetCart(ctx context.Context) {
+	if m, ok := ctx.Value(ctxKeyCartMemo{}).(*cartMemo); ok {
+		m.mu.Lock()
+		m.ok = false
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestMemoizeCart_fetchesOncePerRequest(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	h := memoizeCart(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			if _, err := fe.getCart(r.Context(), sessionID(r)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/", nil))
+	if n := fb.callCount("GetCart"); n != 1 {
+		t.Errorf("GetCart called %d times in a request, want 1", n)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/", nil))
+	if n := fb.callCount("GetCart"); n != 2 {
+		t.Errorf("GetCart called %d times in two requests, want 2", n)
+	}
+}
+
+func TestMemoizeCart_forgetsChanges(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	var sizes []int
+	h := memoizeCart(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, id := range []string{"OLJCESPC7Z", "66VCHSJNUP"} {
+			if err := fe.insertCart(r.Context(), sessionID(r), id, 1); err != nil {
+				t.Fatal(err)
+			}
+			cart, err := fe.getCart(r.Context(), sessionID(r))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes = append(sizes, len(cart))
+		}
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/", nil))
+
+	if len(sizes) != 2 || sizes[0] != 1 || sizes[1] != 2 {
+		t.Errorf("cart sizes after each insert = %v, want [1 2]", sizes)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+	"github.com/pkg/errors"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// parseUSDAmount parses a positive decimal amount of US dollars such as
+// "500" or "249.99". It returns nil for an empty string.
+func parseUSDAmount(s string) (*pb.Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	v, ok := new(big.Rat).SetString(s)
+	if !ok || v.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid amount %q, want a positive number of %s", s, defaultCurrency)
+	}
+	nanos := new(big.Int).Quo(new(big.Int).Mul(v.Num(), big.NewInt(1e9)), v.Denom())
+	units, rem := new(big.Int).QuoRem(nanos, big.NewInt(1e9), new(big.Int))
+	if !units.IsInt64() {
+		return nil, fmt.Errorf("amount %q is too large", s)
+	}
+	return &pb.Money{CurrencyCode: defaultCurrency, Units: units.Int64(), Nanos: int32(rem.Int64())}, nil
+}
+
+// cartTotalExceeded returns a message for the user if adding quantity of p
+// to cart would bring its total above the maximum. Totals are compared in US dollars, the
+// currency of catalog prices, whatever the session currency, so that the
+// cap does not move with exchange rates.
+func (fe *frontendServer) cartTotalExceeded(ctx context.Context, cart []*pb.CartItem, p *pb.Product, quantity uint32) (string, error) {
+	if fe.maxCartTotal == nil {
+		return "", nil
+	}
+	products, err := fe.getProducts(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "could not retrieve products")
+	}
+	prices := make(map[string]pb.Money, len(products))
+	for _, v := range products {
+		prices[v.GetId()] = *v.GetPriceUsd()
+	}
+	total := money.MultiplySlow(*p.GetPriceUsd(), quantity)
+	for _, item := range cart {
+		price, ok := prices[item.GetProductId()]
+		if !ok {
+			continue
+		}
+		total = money.Must(money.Sum(total, money.MultiplySlow(price, uint32(item.GetQuantity()))))
+	}
+	if compareMoney(&total, fe.maxCartTotal) > 0 {
+		return fmt.Sprintf("your cart total would be %s, above the maximum of %s",
+			renderMoney(total), renderMoney(*fe.maxCartTotal)), nil
+	}
+	return "", nil
+}
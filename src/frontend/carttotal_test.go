@@ -0,0 +1,83 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestParseUSDAmount(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    *pb.Money
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"500", &pb.Money{CurrencyCode: "USD", Units: 500}, false},
+		{"39.98", &pb.Money{CurrencyCode: "USD", Units: 39, Nanos: 980000000}, false},
+		{"0", nil, true},
+		{"-5", nil, true},
+		{"lots", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseUSDAmount(tt.in)
+		if (err != nil) != tt.wantErr || got.String() != tt.want.String() {
+			t.Errorf("parseUSDAmount(%q) = %v, %v, want %v (error: %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAddToCartHandler_maxCartTotal(t *testing.T) {
+	// One pair of sunglasses at USD 19.99 is in the cart, and another is
+	// added, for a total of USD 39.98.
+	tests := []struct {
+		max      string
+		wantCode int
+	}{
+		{"39.99", http.StatusFound},
+		{"39.98", http.StatusFound},
+		{"39.97", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.max, func(t *testing.T) {
+			max, err := parseUSDAmount(tt.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fb := newFakeBackends()
+			fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+			fe := newTestFrontend(t, &frontendServer{maxCartTotal: max}, fb)
+
+			w := httptest.NewRecorder()
+			fe.addToCartHandler(w, newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity=1")))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			added := fb.callCount("AddItem") == 1
+			if wantAdded := tt.wantCode == http.StatusFound; added != wantAdded {
+				t.Errorf("item added = %v, want %v", added, wantAdded)
+			}
+			if !added && !strings.Contains(w.Body.String(), "above the maximum of USD 39.97") {
+				t.Errorf("rejection does not explain the cap:\n%s", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkoutForm is the checkout form as submitted from the cart page, or as
+// kept for the review page that submits it.
+type checkoutForm struct {
+	Email              string
+	StreetAddress      string
+	ZipCode            string
+	City               string
+	State              string
+	Country            string
+	CardNumber         string
+	CardMonth          string
+	CardYear           string
+	CardCVV            string
+	AcceptPriceChanges bool
+}
+
+func parseCheckoutForm(r *http.Request) checkoutForm {
+	return checkoutForm{
+		Email:              r.FormValue("email"),
+		StreetAddress:      r.FormValue("street_address"),
+		ZipCode:            r.FormValue("zip_code"),
+		City:               r.FormValue("city"),
+		State:              r.FormValue("state"),
+		Country:            r.FormValue("country"),
+		CardNumber:         r.FormValue("credit_card_number"),
+		CardMonth:          r.FormValue("credit_card_expiration_month"),
+		CardYear:           r.FormValue("credit_card_expiration_year"),
+		CardCVV:            r.FormValue("credit_card_cvv"),
+		AcceptPriceChanges: r.FormValue("accept_price_changes") == "true",
+	}
+}
+
+// CardLast4 returns the last four digits of the card number, for display.
+func (f checkoutForm) CardLast4() string {
+	return lastDigits(f.CardNumber, 4)
+}
+
+func (f checkoutForm) placeOrderRequest(userID, currency string) *pb.PlaceOrderRequest {
+	var (
+		zipCode, _ = strconv.ParseInt(f.ZipCode, 10, 32)
+		ccMonth, _ = strconv.ParseInt(f.CardMonth, 10, 32)
+		ccYear, _  = strconv.ParseInt(f.CardYear, 10, 32)
+		ccCVV, _   = strconv.ParseInt(f.CardCVV, 10, 32)
+	)
+	return &pb.PlaceOrderRequest{
+		Email: f.Email,
+		CreditCard: &pb.CreditCardInfo{
+			CreditCardNumber:          f.CardNumber,
+			CreditCardExpirationMonth: int32(ccMonth),
+			CreditCardExpirationYear:  int32(ccYear),
+			CreditCardCvv:             int32(ccCVV)},
+		UserId:       userID,
+		UserCurrency: currency,
+		Address: &pb.Address{
+			StreetAddress: f.StreetAddress,
+			City:          f.City,
+			State:         f.State,
+			ZipCode:       int32(zipCode),
+			Country:       f.Country},
+	}
+}
+
+// checkCheckout validates form and the session's cart before an order is
+// reviewed or placed, normalizing the country of form. If the checkout
+// cannot go ahead, it responds, reports the stage that failed to failed and
+// returns false.
+func (fe *frontendServer) checkCheckout(w http.ResponseWriter, r *http.Request, form *checkoutForm, failed func(stage string, code codes.Code)) ([]*pb.CartItem, bool) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	if !fe.countrySupported(form.Country) {
+		failed("validate", codes.InvalidArgument)
+		log.WithField("country", form.Country).Info("rejected order to unsupported country")
+		fe.renderCart(w, r, fmt.Sprintf("We do not ship to %q. Please choose one of the listed countries.", form.Country))
+		return nil, false
+	}
+	if len(fe.supportedCountries) > 0 {
+		form.Country = strings.ToUpper(strings.TrimSpace(form.Country))
+	}
+
+	// Stock may have changed since the cart page was rendered, so check
+	// again right before placing the order.
+	cart, err := fe.getCart(r.Context(), userID(r))
+	if err != nil {
+		failed("cart", status.Code(errors.Cause(err)))
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+		return nil, false
+	}
+	if fe.maxOrderLineItems > 0 && len(cart) > fe.maxOrderLineItems {
+		failed("validate", codes.InvalidArgument)
+		log.WithField("line_items", len(cart)).Info("rejected order with too many line items")
+		fe.renderCart(w, r, fmt.Sprintf("Orders are limited to %d different products, and your cart has %d. Please empty your cart and add fewer.",
+			fe.maxOrderLineItems, len(cart)))
+		return nil, false
+	}
+	unavailable, err := fe.unavailableItems(r.Context(), cart)
+	if err != nil {
+		failed("availability", status.Code(errors.Cause(err)))
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not check item availability"), http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(unavailable) > 0 {
+		failed("availability", codes.FailedPrecondition)
+		renderHTTPError(log, r, w, errors.Errorf("some items in your cart are no longer available (%s), please update your cart and try again",
+			strings.Join(unavailable, ", ")), http.StatusConflict)
+		return nil, false
+	}
+	// Prices that went up since the items were added need to be accepted on
+	// the cart page, which shows what changed.
+	if !form.AcceptPriceChanges {
+		increased, err := fe.priceIncreases(r.Context(), userID(r), cart)
+		if err != nil {
+			failed("prices", status.Code(errors.Cause(err)))
+			renderHTTPError(log, r, w, errors.Wrap(err, "could not check item prices"), http.StatusInternalServerError)
+			return nil, false
+		}
+		if len(increased) > 0 {
+			log.WithField("products", increased).Info("prices increased since added to cart, asking for confirmation")
+			fe.setFlash(w, r, "warning", "Some prices went up since you added the items. Please review your cart and check out again.")
+			w.Header().Set("Location", "/cart")
+			w.WriteHeader(http.StatusSeeOther)
+			return nil, false
+		}
+	}
+	return cart, true
+}
+
+// ensureOrderID gives order a fallback ID if the checkout service placed it
+// without one, so that it can still be referred to, and reports whether it
+// did.
+func (fe *frontendServer) ensureOrderID(order *pb.OrderResult) bool {
+	if order.GetOrderId() != "" {
+		return false
+	}
+	ids := fe.fallbackOrderIDs
+	if ids == nil {
+		ids = uuidSessionIDs{}
+	}
+	order.OrderId = fe.fallbackOrderIDPrefix + ids.newSessionID()
+	orderIDFallbacks.Inc()
+	return true
+}
+
+// reviewTTL is how long the checkout form of a review page is kept for it to
+// be submitted.
+const reviewTTL = 30 * time.Minute
+
+// reviewedCheckouts keeps the checkout form of the last review page of each
+// session, under the idempotency key the page carries, so that the page only
+// sends the key back rather than the card details. A form is dropped once
+// its order is placed, once unused for reviewTTL, or earlier if too many
+// sessions review orders since.
+type reviewedCheckouts struct {
+	mu    sync.Mutex
+	m     map[string]reviewedCheckout // session ID -> last review
+	bound sessionBound
+}
+
+type reviewedCheckout struct {
+	key  string
+	form checkoutForm
+}
+
+// put keeps form for the review page of the session with the key, in place
+// of any earlier one.
+func (s *reviewedCheckouts) put(sessionID, key string, form checkoutForm) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]reviewedCheckout)
+	}
+	if s.bound.ttl == 0 {
+		s.bound.ttl = reviewTTL
+	}
+	for _, id := range s.bound.touch(sessionID) {
+		delete(s.m, id)
+	}
+	s.m[sessionID] = reviewedCheckout{key: key, form: form}
+}
+
+// get returns the form kept for the review page of the session with the
+// key, and false if there is none or it expired.
+func (s *reviewedCheckouts) get(sessionID, key string) (checkoutForm, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.m[sessionID]
+	if !ok || v.key != key || s.bound.expired(sessionID) {
+		return checkoutForm{}, false
+	}
+	return v.form, true
+}
+
+// forget drops the form kept for the session, once its order is placed.
+func (s *reviewedCheckouts) forget(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, sessionID)
+	s.bound.remove(sessionID)
+}
+
+// placedOrders remembers the last order each session placed. Orders placed
+// from a review page are kept under the idempotency key the page carried, so
+// that submitting the page again shows that order instead of placing
+// another. An order is only needed while its confirmation may be submitted
+// again or shown on the home page, so it is dropped once its session has
+// not ordered for a cookie lifetime, or earlier if too many sessions have
+// ordered since.
+type placedOrders struct {
+	mu    sync.Mutex
+	m     map[string]placedOrder // session ID -> last order
+	bound sessionBound
+}
+
+// placedOrder is an order placed under key, or being placed if order is nil.
+type placedOrder struct {
+	key       string
+	order     *pb.OrderResult
+	breakdown costBreakdown
+}
+
+// claim reserves key for placing an order of the session. If the key was
+// already claimed, it returns false and the order placed under it, which is
+// nil while it is still being placed.
+func (s *placedOrders) claim(sessionID, key string) (placedOrder, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.use(sessionID)
+	if prev, ok := s.m[sessionID]; ok && prev.key == key {
+		return prev, false
+	}
+	s.m[sessionID] = placedOrder{key: key}
+	return placedOrder{}, true
+}
+
+// complete records the order placed under a claimed key.
+func (s *placedOrders) complete(sessionID, key string, order *pb.OrderResult, breakdown costBreakdown) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m[sessionID].key == key {
+		s.m[sessionID] = placedOrder{key: key, order: order, breakdown: breakdown}
+	}
+}
+
+// record remembers an order placed without a key as the last of the
+// session, unless an order is being placed under a key meanwhile.
+func (s *placedOrders) record(sessionID string, order *pb.OrderResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.use(sessionID)
+	if prev, ok := s.m[sessionID]; ok && prev.order == nil {
+		return
+	}
+	s.m[sessionID] = placedOrder{order: order}
+}
+
+// use drops the order of the session if expired, and those of the sessions
+// evicted to make room for it.
+func (s *placedOrders) use(sessionID string) {
+	if s.m == nil {
+		s.m = make(map[string]placedOrder)
+	}
+	if s.bound.expired(sessionID) {
+		delete(s.m, sessionID)
+	}
+	for _, id := range s.bound.touch(sessionID) {
+		delete(s.m, id)
+	}
+}
+
+// last returns the last order the session placed, or nil if none.
+func (s *placedOrders) last(sessionID string) *pb.OrderResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bound.expired(sessionID) {
+		return nil
+	}
+	return s.m[sessionID].order
+}
+
+// release gives up a claimed key whose order could not be placed, so that
+// it can be submitted again.
+func (s *placedOrders) release(sessionID, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.m[sessionID]; ok && prev.key == key && prev.order == nil {
+		delete(s.m, sessionID)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+var hiddenInputPattern = regexp.MustCompile(`<input type="hidden" name="([^"]+)" value="([^"]*)">`)
+
+// hiddenInputs returns the hidden fields of the forms in body.
+func hiddenInputs(body string) url.Values {
+	v := url.Values{}
+	for _, m := range hiddenInputPattern.FindAllStringSubmatch(body, -1) {
+		v.Add(m[1], html.UnescapeString(m[2]))
+	}
+	return v
+}
+
+const testCheckoutForm = "email=a%40example.com&street_address=1600+Amphitheatre+Parkway&zip_code=94043" +
+	"&city=Mountain+View&state=CA&country=US&credit_card_number=4432-8015-6152-0454" +
+	"&credit_card_expiration_month=1&credit_card_expiration_year=2030&credit_card_cvv=672"
+
+func TestReviewOrderHandler(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	fe := newTestFrontend(t, &frontendServer{checkoutReview: true}, fb)
+
+	w := httptest.NewRecorder()
+	fe.reviewOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout/review", strings.NewReader(testCheckoutForm)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d:\n%s", w.Code, http.StatusOK, w.Body.String())
+	}
+	body := w.Body.String()
+	for _, want := range []string{"Sunglasses", "Quantity: 2", "1600 Amphitheatre Parkway", "card ending in 0454", `action="/cart/checkout"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("review page does not contain %q", want)
+		}
+	}
+	for _, secret := range []string{"4432-8015-6152-0454", "4432801561520454", "672"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("review page contains the card detail %q", secret)
+		}
+	}
+	if form := hiddenInputs(body); form.Get("idempotency_key") == "" || len(form) != 1 {
+		t.Errorf("review page carries %v, want only an idempotency key", form)
+	}
+	if n := fb.callCount("PlaceOrder"); n != 0 {
+		t.Errorf("PlaceOrder called %d times by the review, want 0", n)
+	}
+}
+
+func TestReviewOrderHandler_rejectsUnavailableItems(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "DISCONTINUED", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{checkoutReview: true}, fb)
+
+	w := httptest.NewRecorder()
+	fe.reviewOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout/review", strings.NewReader(testCheckoutForm)))
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestPlaceOrderHandler_fromReview(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	fe := newTestFrontend(t, &frontendServer{checkoutReview: true}, fb)
+
+	w := httptest.NewRecorder()
+	fe.reviewOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout/review", strings.NewReader(testCheckoutForm)))
+	form := hiddenInputs(w.Body.String()).Encode()
+	var card *pb.CreditCardInfo
+	fb.placeOrder = func(req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
+		card = req.GetCreditCard()
+		fb.placeOrder = nil
+		return fb.PlaceOrder(context.Background(), req)
+	}
+
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(form)))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "fake-order-id") {
+			t.Fatalf("submission %d: status = %d, want the order confirmation:\n%s", i+1, w.Code, w.Body.String())
+		}
+	}
+	if n := fb.callCount("PlaceOrder"); n != 1 {
+		t.Errorf("PlaceOrder called %d times for two submissions of a review, want 1", n)
+	}
+	if card.GetCreditCardNumber() != "4432-8015-6152-0454" || card.GetCreditCardCvv() != 672 {
+		t.Errorf("order placed with card %v, want the one reviewed", card)
+	}
+}
+
+func TestPlaceOrderHandler_unknownReview(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{checkoutReview: true}, fb)
+
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader("idempotency_key=expired&"+testCheckoutForm)))
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "review has expired") {
+		t.Errorf("status = %d, want %d with the cart asking to check out again", w.Code, http.StatusBadRequest)
+	}
+	if n := fb.callCount("PlaceOrder"); n != 0 {
+		t.Errorf("PlaceOrder called %d times without a kept review, want 0", n)
+	}
+}
+
+func TestViewCartHandler_checkoutReview(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{checkoutReview: true}, fb)
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+
+	if body := w.Body.String(); !strings.Contains(body, `action="/cart/checkout/review"`) {
+		t.Errorf("cart page does not submit to the review step:\n%s", body)
+	}
+}
+
+func TestPlacedOrders(t *testing.T) {
+	var s placedOrders
+	if _, ok := s.claim("s1", "k1"); !ok {
+		t.Fatal("claim() of a new key = false")
+	}
+	if prev, ok := s.claim("s1", "k1"); ok || prev.order != nil {
+		t.Errorf("claim() of a key being placed = %v, %v, want false without an order", prev, ok)
+	}
+	s.release("s1", "k1")
+	if _, ok := s.claim("s1", "k1"); !ok {
+		t.Error("claim() of a released key = false")
+	}
+	s.complete("s1", "k1", &pb.OrderResult{OrderId: "o1"}, costBreakdown{})
+	if prev, ok := s.claim("s1", "k1"); ok || prev.order.GetOrderId() != "o1" {
+		t.Errorf("claim() of a placed key = %v, %v, want false with order o1", prev, ok)
+	}
+	if _, ok := s.claim("s2", "k1"); !ok {
+		t.Error("claim() of another session's key = false")
+	}
+}
+
+func TestPlacedOrders_evictsSessions(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := &placedOrders{bound: sessionBound{ttl: time.Hour, max: 2, now: func() time.Time { return now }}}
+
+	for _, id := range []string{"a", "b", "c"} {
+		s.record(id, &pb.OrderResult{OrderId: "order-" + id})
+		now = now.Add(time.Second)
+	}
+	if o := s.last("a"); o != nil {
+		t.Errorf("last order of the least recently used session = %v, want it evicted", o)
+	}
+	if len(s.m) != 2 {
+		t.Errorf("orders kept for %d sessions, want 2", len(s.m))
+	}
+
+	now = now.Add(time.Hour)
+	if o := s.last("c"); o != nil {
+		t.Errorf("last order = %v, want it expired", o)
+	}
+	if _, ok := s.claim("c", "k1"); !ok {
+		t.Error("claim() of a new key after expiry = false")
+	}
+}
+
+func TestPlaceOrderHandler_fallbackOrderID(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fb.placeOrder = func(req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
+		return &pb.PlaceOrderResponse{Order: &pb.OrderResult{ShippingCost: &pb.Money{CurrencyCode: "USD"}}}, nil
+	}
+	fe := newTestFrontend(t, &frontendServer{fallbackOrderIDPrefix: "local-"}, fb)
+	before := testutil.ToFloat64(orderIDFallbacks)
+
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(testCheckoutForm)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d:\n%s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if !regexp.MustCompile(`<strong>local-[0-9a-f-]{36}</strong>`).MatchString(w.Body.String()) {
+		t.Errorf("confirmation page does not show a fallback order ID:\n%s", w.Body.String())
+	}
+	if got := testutil.ToFloat64(orderIDFallbacks); got != before+1 {
+		t.Errorf("frontend_order_id_fallbacks_total = %v, want %v", got, before+1)
+	}
+}
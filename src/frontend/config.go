@@ -0,0 +1,189 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// knownConfigKeys are the settings that may be given in the file named by
+// CONFIG_FILE. Each is named after the environment variable it stands in for.
+var knownConfigKeys = map[string]bool{
+	"ACCESS_LOG_SAMPLE_RATE":          true,
+	"AD_COUNT":                        true,
+	"AD_MAX_CONCURRENCY":              true,
+	"AD_SERVICE_ADDR":                 true,
+	"AD_TIMEOUT":                      true,
+	"ALLOW_FLAG_OVERRIDE":             true,
+	"ALLOW_FORCE_TRACE":               true,
+	"BANNER_COLOR":                    true,
+	"BLOCKED_PRODUCT_IDS":             true,
+	"CANONICAL_HOST":                  true,
+	"CANONICAL_HTTPS":                 true,
+	"CARD_DESCRIPTION_MAX_LENGTH":     true,
+	"CARD_NAME_MAX_LENGTH":            true,
+	"CART_EXPIRY_NOTICE":              true,
+	"CART_MAX_CONCURRENCY":            true,
+	"CART_SERVICE_ADDR":               true,
+	"CART_TIMEOUT":                    true,
+	"CHECKOUT_DRY_RUN":                true,
+	"CHECKOUT_MAX_CONCURRENCY":        true,
+	"CHECKOUT_REVIEW":                 true,
+	"CHECKOUT_SERVICE_ADDR":           true,
+	"CHECKOUT_TIMEOUT":                true,
+	"CONN_CHECK_INTERVAL":             true,
+	"COOKIE_DOMAIN":                   true,
+	"CURRENCY_MAX_CONCURRENCY":        true,
+	"CURRENCY_POSITIONS":              true,
+	"CURRENCY_REFRESH_INTERVAL":       true,
+	"CURRENCY_ROUNDING":               true,
+	"CURRENCY_ROUNDING_GRANULARITY":   true,
+	"CURRENCY_SERVICE_ADDR":           true,
+	"CURRENCY_TIMEOUT":                true,
+	"DEBUG_DEGRADED_HEADER":           true,
+	"DEFAULT_ADD_QUANTITY":            true,
+	"DELIVERY_DAYS":                   true,
+	"DELIVERY_DAYS_BY_COUNTRY":        true,
+	"DEPENDENCY_WAIT_TIMEOUT":         true,
+	"DISABLE_PROFILER":                true,
+	"DISABLE_TRACING":                 true,
+	"DOWNSTREAM_CONCURRENCY_WAIT":     true,
+	"DOWNSTREAM_TIMEOUT":              true,
+	"ENVIRONMENT":                     true,
+	"ENV_PLATFORM":                    true,
+	"FALLBACK_ORDER_ID_PREFIX":        true,
+	"FALLBACK_ORDER_ID_SCHEME":        true,
+	"FALLBACK_RECOMMENDATION_IDS":     true,
+	"FEATURED_PRODUCT_IDS":            true,
+	"FLASH_SECRET":                    true,
+	"GRPC_MAX_RECV_MSG_BYTES":         true,
+	"GRPC_MAX_RETRIES":                true,
+	"HSTS_INCLUDE_SUBDOMAINS":         true,
+	"HSTS_MAX_AGE":                    true,
+	"HSTS_PRELOAD":                    true,
+	"HTTP_IDLE_TIMEOUT":               true,
+	"HTTP_READ_HEADER_TIMEOUT":        true,
+	"HTTP_READ_TIMEOUT":               true,
+	"HTTP_WRITE_TIMEOUT":              true,
+	"IMAGE_CDN_BASE":                  true,
+	"JAEGER_SERVICE_ADDR":             true,
+	"LISTEN_ADDR":                     true,
+	"LOG_DOWNSTREAM_CALLS":            true,
+	"LOG_REDACT_FIELDS":               true,
+	"LOW_STOCK_THRESHOLD":             true,
+	"MAX_CART_TOTAL":                  true,
+	"MAX_CONCURRENT_REQUESTS":         true,
+	"MAX_ORDER_LINE_ITEMS":            true,
+	"MAX_PAGE_SIZE":                   true,
+	"MAX_RENDERED_RECOMMENDATIONS":    true,
+	"META_DESCRIPTION":                true,
+	"MIN_ADD_QUANTITIES":              true,
+	"NEW_ARRIVAL_PRODUCT_IDS":         true,
+	"PORT":                            true,
+	"PREFETCH_CATALOG":                true,
+	"PRICE_CACHE_TTL":                 true,
+	"PRICE_DISPLAY":                   true,
+	"PRODUCT_CATALOG_MAX_CONCURRENCY": true,
+	"PRODUCT_CATALOG_SERVICE_ADDR":    true,
+	"PRODUCT_CATALOG_TIMEOUT":         true,
+	"PRODUCT_IMAGE_PLACEHOLDER":       true,
+	"PRODUCT_STOCK":                   true,
+	"PRODUCT_VARIANT_PRICES":          true,
+	"READINESS_INITIAL_DELAY":         true,
+	"READ_ONLY_MODE":                  true,
+	"RECOMMENDATION_COUNT":            true,
+	"RECOMMENDATION_MAX_CONCURRENCY":  true,
+	"RECOMMENDATION_SERVICE_ADDR":     true,
+	"RECOMMENDATION_TIMEOUT":          true,
+	"RENDER_TIMEOUT":                  true,
+	"RESTOCK_SIGNUPS":                 true,
+	"RETRY_BUDGET":                    true,
+	"ROBOTS_TXT":                      true,
+	"ROBOTS_TXT_FILE":                 true,
+	"SESSION_ID_SCHEME":               true,
+	"SHIPPING_MAX_CONCURRENCY":        true,
+	"SHIPPING_SERVICE_ADDR":           true,
+	"SHIPPING_TIMEOUT":                true,
+	"SHOW_BRANDING":                   true,
+	"SHOW_IN_CART_BADGE":              true,
+	"SLOW_REQUEST_THRESHOLD":          true,
+	"SRV_REFRESH_INTERVAL":            true,
+	"STATIC_DIRS":                     true,
+	"STORE_NAME":                      true,
+	"STREAM_CATALOG_THRESHOLD":        true,
+	"SUPPORTED_COUNTRIES":             true,
+	"TAX_RATE":                        true,
+	"TAX_RATES":                       true,
+	"TIME_ZONE":                       true,
+	"TLS_CERT":                        true,
+	"TLS_KEY":                         true,
+	"TLS_MIN_VERSION":                 true,
+	"TRACE_EXPORTER":                  true,
+	"TRUSTED_PROXIES":                 true,
+	"USER_JWT_HEADER":                 true,
+	"USER_JWT_SECRET":                 true,
+	"WAIT_FOR_DEPENDENCIES":           true,
+}
+
+// loadConfigFile reads a YAML (or JSON) file holding a flat mapping of
+// setting names to values, e.g.
+//
+//	PRODUCT_CATALOG_SERVICE_ADDR: productcatalogservice:3550
+//	CHECKOUT_DRY_RUN: true
+//
+// and exports each setting that is not already set in the environment, so
+// that environment variables take precedence over the file.
+func loadConfigFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read config file")
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return errors.Wrapf(err, "failed to parse config file %s", path)
+	}
+
+	var unknown []string
+	for k := range values {
+		if !knownConfigKeys[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return errors.Errorf("config file %s: unknown fields: %s", path, strings.Join(unknown, ", "))
+	}
+
+	for k, v := range values {
+		switch v.(type) {
+		case nil:
+			continue
+		case string, bool, int, float64:
+		default:
+			return errors.Errorf("config file %s: field %s must be a string, number or boolean", path, k)
+		}
+		if _, ok := os.LookupEnv(k); !ok {
+			os.Setenv(k, fmt.Sprint(v))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// unsetenv unsets an environment variable for the duration of the test.
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+	setenv(t, key, "")
+	os.Unsetenv(key)
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	for _, k := range []string{"PRODUCT_CATALOG_SERVICE_ADDR", "CART_SERVICE_ADDR", "CHECKOUT_DRY_RUN"} {
+		unsetenv(t, k)
+	}
+	setenv(t, "CART_SERVICE_ADDR", "cart-from-env:7070")
+
+	dir := writeFiles(t, map[string]string{"frontend.yaml": `
+PRODUCT_CATALOG_SERVICE_ADDR: productcatalogservice:3550
+CART_SERVICE_ADDR: cart-from-file:7070
+CHECKOUT_DRY_RUN: true
+`})
+	if err := loadConfigFile(filepath.Join(dir, "frontend.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	var catalogAddr, cartAddr string
+	var dryRun bool
+	mustMapEnv(&catalogAddr, "PRODUCT_CATALOG_SERVICE_ADDR")
+	mustMapEnv(&cartAddr, "CART_SERVICE_ADDR")
+	mustMapEnvBool(&dryRun, "CHECKOUT_DRY_RUN")
+	if catalogAddr != "productcatalogservice:3550" {
+		t.Errorf("catalog address = %q, want the value from the file", catalogAddr)
+	}
+	if cartAddr != "cart-from-env:7070" {
+		t.Errorf("cart address = %q, want the environment to take precedence", cartAddr)
+	}
+	if !dryRun {
+		t.Error("dry run not enabled from the file")
+	}
+}
+
+func TestLoadConfigFile_json(t *testing.T) {
+	unsetenv(t, "AD_SERVICE_ADDR")
+	dir := writeFiles(t, map[string]string{"frontend.json": `{"AD_SERVICE_ADDR": "adservice:9555"}`})
+	if err := loadConfigFile(filepath.Join(dir, "frontend.json")); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("AD_SERVICE_ADDR"); got != "adservice:9555" {
+		t.Errorf("AD_SERVICE_ADDR = %q", got)
+	}
+}
+
+func TestLoadConfigFile_invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown field", "PRODUCT_CATALOG_SERVICE_ADR: x\nCART_SERVICE_ADDR: y\n", "unknown fields: PRODUCT_CATALOG_SERVICE_ADR"},
+		{"nested value", "AD_SERVICE_ADDR:\n  host: adservice\n", "field AD_SERVICE_ADDR must be"},
+		{"malformed", "AD_SERVICE_ADDR: [\n", "failed to parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"frontend.yaml": tt.content})
+			err := loadConfigFile(filepath.Join(dir, "frontend.yaml"))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfigFile() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestKnownConfigKeys makes sure every environment variable read by the
+// frontend can also be given in the config file.
+func TestKnownConfigKeys(t *testing.T) {
+	re := regexp.MustCompile(`(?:Getenv|mustMapEnv\w*)\((?:[^,()]+, )?"([A-Z_]+)"`)
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f, "_test.go") {
+			continue
+		}
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range re.FindAllStringSubmatch(string(b), -1) {
+			if key := m[1]; key != "CONFIG_FILE" && !knownConfigKeys[key] {
+				t.Errorf("%s reads %s, which is missing from knownConfigKeys", f, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// parseCountries parses a comma-separated list of ISO 3166-1 alpha-2 country
+// codes, e.g. "US,CA,GB", normalized to upper case.
+func parseCountries(s string) ([]string, error) {
+	var out []string
+	for _, c := range splitList(s) {
+		c = strings.ToUpper(c)
+		if !countryCodePattern.MatchString(c) {
+			return nil, fmt.Errorf("invalid country code %q", c)
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// countrySupported reports whether orders can be shipped to the country.
+// Any country is accepted when no list is configured.
+func (fe *frontendServer) countrySupported(country string) bool {
+	if len(fe.supportedCountries) == 0 {
+		return true
+	}
+	return contains(fe.supportedCountries, strings.ToUpper(strings.TrimSpace(country)))
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCountries(t *testing.T) {
+	got, err := parseCountries(" us, CA ,,gb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"US", "CA", "GB"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCountries() = %v, want %v", got, want)
+	}
+	for _, s := range []string{"USA", "United States", "U1"} {
+		if _, err := parseCountries(s); err == nil {
+			t.Errorf("parseCountries(%q) = nil error", s)
+		}
+	}
+}
+
+func TestCountrySupported(t *testing.T) {
+	if !(&frontendServer{}).countrySupported("Atlantis") {
+		t.Error("country rejected without a configured list")
+	}
+	fe := &frontendServer{supportedCountries: []string{"US", "CA"}}
+	if !fe.countrySupported(" ca") {
+		t.Error("countrySupported(\" ca\") = false, want true")
+	}
+	if fe.countrySupported("GB") {
+		t.Error("countrySupported(\"GB\") = true, want false")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type ctxKeyCurrencyReset struct{}
+
+// currencyReset records that the session currency turned out to be
+// unsupported during a request, or was not valid to begin with, and was
+// replaced by the default currency.
+type currencyReset struct {
+	mu   sync.Mutex
+	done bool
+
+	// invalid is the value of a currency cookie ignored for not being a
+	// supported currency, which also resets it.
+	invalid string
+}
+
+func (c *currencyReset) isDone() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done
+}
+
+// isUnsupportedCurrency reports whether err is the currency service
+// rejecting the target currency of a conversion.
+func isUnsupportedCurrency(err error) bool {
+	code := status.Code(err)
+	return code == codes.InvalidArgument || code == codes.NotFound
+}
+
+// resetCurrency switches the request ctx belongs to over to the default
+// currency, reporting false if it cannot be reset (e.g. outside of
+// ensureCurrency). It logs and counts the first reset of a request only.
+func resetCurrency(ctx context.Context, unsupported string) bool {
+	c, ok := ctx.Value(ctxKeyCurrencyReset{}).(*currencyReset)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	first := !c.done
+	c.done = true
+	c.mu.Unlock()
+	if first {
+		currencyResets.Inc()
+		if log, ok := ctx.Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+			log.WithField("currency", unsupported).Warn("currency no longer supported, resetting to " + defaultCurrency)
+		}
+	}
+	return true
+}
+
+// currencyResetWriter updates the currency cookie before the response is
+// written if the session currency was reset while handling the request.
+type currencyResetWriter struct {
+	http.ResponseWriter
+	reset  *currencyReset
+	domain string
+	once   sync.Once
+}
+
+func (w *currencyResetWriter) setCookie() {
+	w.once.Do(func() {
+		if w.reset.isDone() {
+			http.SetCookie(w.ResponseWriter, &http.Cookie{
+				Name:   cookieCurrency,
+				Value:  defaultCurrency,
+				Domain: w.domain,
+				MaxAge: cookieMaxAge,
+			})
+		}
+	})
+}
+
+func (w *currencyResetWriter) WriteHeader(statusCode int) {
+	w.setCookie()
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *currencyResetWriter) Write(p []byte) (int, error) {
+	w.setCookie()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *currencyResetWriter) Flush() {
+	w.setCookie()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// refreshCurrencies fetches the supported currencies and swaps them in for
+// the requests to use, logging any currency added or removed. On failure the
+// last list is kept.
+func (fe *frontendServer) refreshCurrencies(ctx context.Context, log logrus.FieldLogger) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	currs, err := fe.fetchCurrencies(ctx)
+	if err != nil {
+		log.WithField("error", err).Warn("failed to refresh currencies, keeping the last list")
+		return
+	}
+	if prev, ok := fe.currencies.Load().([]string); ok {
+		if added, removed := diffCurrencies(prev, currs); len(added) > 0 || len(removed) > 0 {
+			log.WithFields(logrus.Fields{"added": added, "removed": removed}).Info("supported currencies changed")
+		}
+	}
+	fe.currencies.Store(currs)
+}
+
+// watchCurrencies refreshes the supported currencies each interval until ctx
+// is done.
+func (fe *frontendServer) watchCurrencies(ctx context.Context, log logrus.FieldLogger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fe.refreshCurrencies(ctx, log)
+		}
+	}
+}
+
+// diffCurrencies returns the currencies in next but not prev, and those in
+// prev but not next.
+func diffCurrencies(prev, next []string) (added, removed []string) {
+	for _, c := range next {
+		if !contains(prev, c) {
+			added = append(added, c)
+		}
+	}
+	for _, c := range prev {
+		if !contains(next, c) {
+			removed = append(removed, c)
+		}
+	}
+	return added, removed
+}
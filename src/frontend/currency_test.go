@@ -0,0 +1,171 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestProductHandler_resetsUnsupportedCurrency(t *testing.T) {
+	fb := newFakeBackends()
+	fb.convert = func(req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+		if req.GetToCode() == "TRY" {
+			return nil, status.Error(codes.InvalidArgument, "unsupported currency: TRY")
+		}
+		return &pb.Money{CurrencyCode: req.GetToCode(), Units: req.GetFrom().GetUnits(), Nanos: req.GetFrom().GetNanos()}, nil
+	}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	before := testutil.ToFloat64(currencyResets)
+
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "TRY"})
+	w := httptest.NewRecorder()
+	fe.ensureCurrency(http.HandlerFunc(fe.productHandler)).ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "USD 19.99") || strings.Contains(body, "TRY 19.99") {
+		t.Errorf("product page is not rendered in the default currency")
+	}
+	var reset bool
+	for _, c := range w.Result().Cookies() {
+		reset = reset || c.Name == cookieCurrency && c.Value == defaultCurrency
+	}
+	if !reset {
+		t.Errorf("Set-Cookie = %q, want the currency cookie reset to %s", w.Header()["Set-Cookie"], defaultCurrency)
+	}
+	if got := testutil.ToFloat64(currencyResets); got != before+1 {
+		t.Errorf("frontend_currency_reset_total = %v, want %v", got, before+1)
+	}
+}
+
+func TestConvertCurrency_otherErrorsAreNotReset(t *testing.T) {
+	fb := newFakeBackends()
+	fb.convert = func(*pb.CurrencyConversionRequest) (*pb.Money, error) {
+		return nil, status.Error(codes.Unavailable, "down")
+	}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "EUR"})
+	w := httptest.NewRecorder()
+	fe.ensureCurrency(http.HandlerFunc(fe.productHandler)).ServeHTTP(w, r)
+
+	// The page falls back to the base currency price instead.
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("unexpected cookies %v", w.Result().Cookies())
+	}
+}
+
+func TestEnsureCurrency_invalidCookie(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	before := testutil.ToFloat64(currencyResets)
+
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "<script>"})
+	w := httptest.NewRecorder()
+	fe.ensureCurrency(http.HandlerFunc(fe.productHandler)).ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "USD 19.99") {
+		t.Errorf("product page is not rendered in the default currency")
+	}
+	var reset bool
+	for _, c := range w.Result().Cookies() {
+		reset = reset || c.Name == cookieCurrency && c.Value == defaultCurrency
+	}
+	if !reset {
+		t.Errorf("Set-Cookie = %q, want the currency cookie reset to %s", w.Header()["Set-Cookie"], defaultCurrency)
+	}
+	if got := testutil.ToFloat64(currencyResets); got != before {
+		t.Errorf("frontend_currency_reset_total = %v, want %v: invalid cookies are not currencies going unsupported", got, before)
+	}
+}
+
+func TestRefreshCurrencies(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	var buf bytes.Buffer
+	log := newBufferLogger(&buf)
+
+	fe.refreshCurrencies(context.Background(), log)
+	fb.currencies = []string{"USD", "EUR", "GBP"}
+	if got, _ := fe.getCurrencies(context.Background()); !reflect.DeepEqual(got, []string{"USD", "EUR", "JPY"}) {
+		t.Errorf("getCurrencies() before the refresh = %v, want the last list", got)
+	}
+
+	fe.refreshCurrencies(context.Background(), log)
+	if got, _ := fe.getCurrencies(context.Background()); !reflect.DeepEqual(got, []string{"USD", "EUR", "GBP"}) {
+		t.Errorf("getCurrencies() after the refresh = %v, want the new list", got)
+	}
+	e := lastEntry(t, &buf, "supported currencies changed")
+	if !reflect.DeepEqual(e["added"], []interface{}{"GBP"}) || !reflect.DeepEqual(e["removed"], []interface{}{"JPY"}) {
+		t.Errorf("logged added %v and removed %v, want [GBP] and [JPY]", e["added"], e["removed"])
+	}
+
+	fb.failing = map[string]error{"GetSupportedCurrencies": status.Error(codes.Unavailable, "down")}
+	fe.refreshCurrencies(context.Background(), log)
+	if got, err := fe.getCurrencies(context.Background()); err != nil || !reflect.DeepEqual(got, []string{"USD", "EUR", "GBP"}) {
+		t.Errorf("getCurrencies() after a failed refresh = %v, %v, want the last good list", got, err)
+	}
+}
+
+func TestProductHandler_conversionFailure(t *testing.T) {
+	fb := newFakeBackends()
+	fb.recommendations = []string{"66VCHSJNUP"}
+	fb.convert = func(*pb.CurrencyConversionRequest) (*pb.Money, error) {
+		return nil, status.Error(codes.Unavailable, "currency service down")
+	}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	before := testutil.ToFloat64(priceConversionFallbacks)
+
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "EUR"})
+	w := httptest.NewRecorder()
+	fe.ensureCurrency(http.HandlerFunc(fe.productHandler)).ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"Sunglasses", "USD 19.99", "Converted price unavailable", "/product/66VCHSJNUP"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("product page does not contain %q", want)
+		}
+	}
+	if got := testutil.ToFloat64(priceConversionFallbacks); got != before+1 {
+		t.Errorf("frontend_price_conversion_fallbacks_total = %v, want %v", got, before+1)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// suffixedCurrencies are the currencies whose code is rendered after the
+// amount, as in "10.00 EUR", rather than before it, as configured by
+// CURRENCY_POSITIONS. By default every currency is prefixed, as the store's
+// English pages write them.
+var suffixedCurrencies = map[string]bool{}
+
+// parseCurrencyPositions parses comma-separated "code=prefix" or
+// "code=suffix" pairs, e.g. "EUR=suffix,TRY=suffix", into the set of
+// suffixed currencies.
+func parseCurrencyPositions(s string) (map[string]bool, error) {
+	suffixed := make(map[string]bool)
+	for _, kv := range splitList(s) {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid currency position entry %q, want code=prefix or code=suffix", kv)
+		}
+		code := strings.ToUpper(strings.TrimSpace(kv[:i]))
+		if len(code) != 3 || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return nil, fmt.Errorf("invalid currency code %q", kv[:i])
+		}
+		switch pos := strings.ToLower(strings.TrimSpace(kv[i+1:])); pos {
+		case "prefix":
+			delete(suffixed, code)
+		case "suffix":
+			suffixed[code] = true
+		default:
+			return nil, fmt.Errorf("invalid position %q for currency %s, want prefix or suffix", kv[i+1:], code)
+		}
+	}
+	return suffixed, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestParseCurrencyPositions(t *testing.T) {
+	tests := map[string]map[string]bool{
+		"":                                      {},
+		"EUR=suffix":                            {"EUR": true},
+		" eur = Suffix , try=suffix,USD=prefix": {"EUR": true, "TRY": true},
+		"EUR=suffix,EUR=prefix":                 {},
+	}
+	for in, want := range tests {
+		if got, err := parseCurrencyPositions(in); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("parseCurrencyPositions(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"EUR", "EUR=after", "EURO=suffix", "E1R=suffix", "=suffix"} {
+		if _, err := parseCurrencyPositions(in); err == nil {
+			t.Errorf("parseCurrencyPositions(%q) did not fail", in)
+		}
+	}
+}
+
+func TestRenderMoney_currencyPositions(t *testing.T) {
+	defer func(m map[string]bool) { suffixedCurrencies = m }(suffixedCurrencies)
+	suffixedCurrencies = map[string]bool{"EUR": true}
+
+	tests := []struct {
+		money pb.Money
+		want  string
+	}{
+		{pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000}, "USD 19.99"},
+		{pb.Money{CurrencyCode: "JPY", Units: 2180}, "JPY 2180.00"},
+		{pb.Money{CurrencyCode: "EUR", Units: 10, Nanos: 500000000}, "10.50 EUR"},
+	}
+	for _, tt := range tests {
+		if got := renderMoney(tt.money); got != tt.want {
+			t.Errorf("renderMoney(%v) = %q, want %q", tt.money, got, tt.want)
+		}
+	}
+	min, max := &pb.Money{CurrencyCode: "EUR", Units: 20}, &pb.Money{CurrencyCode: "EUR", Units: 30}
+	if got, want := renderPriceRange(min, max), "20.00 EUR–30.00 EUR"; got != want {
+		t.Errorf("renderPriceRange() = %q, want %q", got, want)
+	}
+}
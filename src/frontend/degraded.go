@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type ctxKeyDegraded struct{}
+
+// degradedHeader lists the optional features skipped because of errors
+// while handling a request, when DEBUG_DEGRADED_HEADER is set.
+const degradedHeader = "X-Degraded-Features"
+
+// degradedFeatures collects the optional features skipped for a request.
+type degradedFeatures struct {
+	mu       sync.Mutex
+	features map[string]bool
+}
+
+// markDegraded records that the optional feature, named like its feature
+// flag, was skipped for the request ctx belongs to. It does nothing unless
+// the request reports degraded features.
+func markDegraded(ctx context.Context, feature string) {
+	d, ok := ctx.Value(ctxKeyDegraded{}).(*degradedFeatures)
+	if !ok {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.features == nil {
+		d.features = make(map[string]bool)
+	}
+	d.features[feature] = true
+}
+
+// String returns the skipped features, sorted and comma-separated.
+func (d *degradedFeatures) String() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]string, 0, len(d.features))
+	for f := range d.features {
+		out = append(out, f)
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
+
+// reportDegraded sets the X-Degraded-Features header on responses that
+// skipped optional features, if enabled. The header is set before the
+// response is first written, so features skipped after that, while
+// streaming a page, are not reported.
+func reportDegraded(enabled bool, next http.Handler) http.Handler {
+	if !enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := &degradedFeatures{}
+		ctx := context.WithValue(r.Context(), ctxKeyDegraded{}, d)
+		next.ServeHTTP(&degradedWriter{ResponseWriter: w, degraded: d}, r.WithContext(ctx))
+	})
+}
+
+// degradedWriter sets the X-Degraded-Features header before the response is
+// written.
+type degradedWriter struct {
+	http.ResponseWriter
+	degraded *degradedFeatures
+	once     sync.Once
+}
+
+func (w *degradedWriter) setHeader() {
+	w.once.Do(func() {
+		if v := w.degraded.String(); v != "" {
+			w.Header().Set(degradedHeader, v)
+		}
+	})
+}
+
+func (w *degradedWriter) WriteHeader(statusCode int) {
+	w.setHeader()
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *degradedWriter) Write(p []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *degradedWriter) Flush() {
+	w.setHeader()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
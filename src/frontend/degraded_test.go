@@ -0,0 +1,60 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReportDegraded(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		failing map[string]error
+		want    string
+	}{
+		{"healthy", true, nil, ""},
+		{"ads down", true, map[string]error{"GetAds": status.Error(codes.Unavailable, "down")}, "ads"},
+		{"all down", true, map[string]error{
+			"GetAds":              status.Error(codes.Unavailable, "down"),
+			"ListRecommendations": status.Error(codes.Unavailable, "down"),
+		}, "ads,recommendations"},
+		{"disabled", false, map[string]error{"GetAds": status.Error(codes.Unavailable, "down")}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFakeBackends()
+			fb.failing = tt.failing
+			fe := newTestFrontend(t, &frontendServer{fallbackRecommendationIDs: []string{"1YMWWN1N4O"}}, fb)
+			h := reportDegraded(tt.enabled, http.HandlerFunc(fe.productHandler))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"}))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get(degradedHeader); got != tt.want {
+				t.Errorf("%s = %q, want %q", degradedHeader, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deliveryWindow is the range of business days an order takes to arrive.
+type deliveryWindow struct {
+	min, max int
+}
+
+// defaultDeliveryWindow applies when DELIVERY_DAYS is not set.
+var defaultDeliveryWindow = deliveryWindow{min: 3, max: 5}
+
+// parseDeliveryWindow parses a number of business days, e.g. "3", or a
+// range of them, e.g. "3-5".
+func parseDeliveryWindow(s string) (deliveryWindow, error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	min, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	max, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if err1 != nil || err2 != nil || min < 0 || max < min || max == 0 {
+		return deliveryWindow{}, fmt.Errorf("invalid delivery days %q, want days or min-max", s)
+	}
+	return deliveryWindow{min: min, max: max}, nil
+}
+
+// parseDeliveryWindows parses comma-separated "country=days" pairs, e.g.
+// "Canada=5-8,United Kingdom=7-10". Countries are matched
+// case-insensitively, like tax rates.
+func parseDeliveryWindows(s string) (map[string]deliveryWindow, error) {
+	windows := make(map[string]deliveryWindow)
+	for _, kv := range splitList(s) {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid delivery days entry %q, want country=days", kv)
+		}
+		w, err := parseDeliveryWindow(kv[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		windows[strings.ToLower(strings.TrimSpace(kv[:i]))] = w
+	}
+	return windows, nil
+}
+
+// deliveryEstimate is the range of dates an order is expected to arrive in.
+type deliveryEstimate struct {
+	Earliest, Latest time.Time
+}
+
+func (e deliveryEstimate) String() string {
+	const layout = "Mon, Jan 2"
+	if e.Earliest.Equal(e.Latest) {
+		return e.Earliest.Format(layout)
+	}
+	return e.Earliest.Format(layout) + " – " + e.Latest.Format(layout)
+}
+
+// estimateDelivery returns the delivery dates of an order to the country
+// placed at now, in the store's time zone. Shipping quotes carry no transit
+// time, so the window comes from DELIVERY_DAYS_BY_COUNTRY, falling back to
+// DELIVERY_DAYS.
+func (fe *frontendServer) estimateDelivery(now time.Time, country string) deliveryEstimate {
+	w, ok := fe.deliveryWindows[strings.ToLower(strings.TrimSpace(country))]
+	if !ok {
+		w = fe.deliveryWindow
+	}
+	if w.max == 0 {
+		w = defaultDeliveryWindow
+	}
+	loc := fe.timeZone
+	if loc == nil {
+		loc = time.Local
+	}
+	now = now.In(loc)
+	return deliveryEstimate{Earliest: addBusinessDays(now, w.min), Latest: addBusinessDays(now, w.max)}
+}
+
+// addBusinessDays returns the day n business days after t, skipping
+// weekends. Zero days from a weekend is the following Monday.
+func addBusinessDays(t time.Time, n int) time.Time {
+	for t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		t = t.AddDate(0, 0, 1)
+	}
+	for n > 0 {
+		t = t.AddDate(0, 0, 1)
+		if t.Weekday() != time.Saturday && t.Weekday() != time.Sunday {
+			n--
+		}
+	}
+	return t
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestParseDeliveryWindow(t *testing.T) {
+	tests := map[string]deliveryWindow{
+		"3-5":    {3, 5},
+		" 2 - 4": {2, 4},
+		"7":      {7, 7},
+		"0-1":    {0, 1},
+	}
+	for in, want := range tests {
+		if got, err := parseDeliveryWindow(in); err != nil || got != want {
+			t.Errorf("parseDeliveryWindow(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "0", "5-3", "-1-2", "three", "3-"} {
+		if _, err := parseDeliveryWindow(in); err == nil {
+			t.Errorf("parseDeliveryWindow(%q) did not fail", in)
+		}
+	}
+	if _, err := parseDeliveryWindows("Canada"); err == nil {
+		t.Error("parseDeliveryWindows() accepted an entry without days")
+	}
+}
+
+func TestAddBusinessDays(t *testing.T) {
+	// 2026-10-14 is a Wednesday.
+	wed := time.Date(2026, 10, 14, 15, 0, 0, 0, time.UTC)
+	sat := time.Date(2026, 10, 17, 15, 0, 0, 0, time.UTC)
+	tests := []struct {
+		from time.Time
+		n    int
+		want string
+	}{
+		{wed, 0, "2026-10-14"},
+		{wed, 2, "2026-10-16"},
+		{wed, 3, "2026-10-19"}, // over the weekend
+		{wed, 8, "2026-10-26"},
+		{sat, 0, "2026-10-19"},
+		{sat, 1, "2026-10-20"},
+	}
+	for _, tt := range tests {
+		if got := addBusinessDays(tt.from, tt.n).Format("2006-01-02"); got != tt.want {
+			t.Errorf("addBusinessDays(%s, %d) = %s, want %s", tt.from.Format("Mon 2006-01-02"), tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestEstimateDelivery(t *testing.T) {
+	windows, err := parseDeliveryWindows("Canada=5-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Friday evening in UTC is already Saturday in UTC+9.
+	now := time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		fe      *frontendServer
+		country string
+		want    string
+	}{
+		{"default", &frontendServer{timeZone: time.UTC}, "US", "Wed, Oct 21 – Fri, Oct 23"},
+		{"configured", &frontendServer{timeZone: time.UTC, deliveryWindow: deliveryWindow{1, 1}}, "US", "Mon, Oct 19"},
+		{"by country", &frontendServer{timeZone: time.UTC, deliveryWindows: windows}, " canada", "Fri, Oct 23 – Wed, Oct 28"},
+		{"missing country", &frontendServer{timeZone: time.UTC, deliveryWindows: windows}, "", "Wed, Oct 21 – Fri, Oct 23"},
+		{"time zone", &frontendServer{timeZone: time.FixedZone("UTC+9", 9*60*60)}, "US", "Thu, Oct 22 – Mon, Oct 26"},
+	}
+	for _, tt := range tests {
+		if got := tt.fe.estimateDelivery(now, tt.country).String(); got != tt.want {
+			t.Errorf("%s: estimateDelivery() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReviewOrderHandler_deliveryEstimate(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{checkoutReview: true}, fb)
+
+	w := httptest.NewRecorder()
+	fe.reviewOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout/review", strings.NewReader(testCheckoutForm)))
+
+	want := "Estimated delivery: <strong>" + fe.estimateDelivery(time.Now(), "US").String() + "</strong>"
+	if body := w.Body.String(); !strings.Contains(body, want) {
+		t.Errorf("review page does not contain %q", want)
+	}
+}
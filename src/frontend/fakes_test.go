@@ -0,0 +1,226 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"path"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// fakeBackends implements every downstream service of the frontend on top of
+// in-memory data. Tests customize it through its fields and the optional func
+// overrides before calling newTestFrontend.
+type fakeBackends struct {
+	mu sync.Mutex
+
+	products        []*pb.Product
+	currencies      []string
+	carts           map[string][]*pb.CartItem
+	recommendations []string
+	ads             []*pb.Ad
+
+	convert    func(*pb.CurrencyConversionRequest) (*pb.Money, error)
+	placeOrder func(*pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error)
+
+	// failing maps method names to the error their calls fail with, after
+	// being counted.
+	failing map[string]error
+
+	// adContextKeys records the context keys of every GetAds request.
+	adContextKeys [][]string
+
+	// calls counts the RPCs received, keyed by method name (e.g. "GetProduct").
+	calls map[string]int
+}
+
+func newFakeBackends() *fakeBackends {
+	return &fakeBackends{
+		products: []*pb.Product{
+			{Id: "OLJCESPC7Z", Name: "Sunglasses", Picture: "/static/img/products/sunglasses.jpg",
+				PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000}, Categories: []string{"accessories"}},
+			{Id: "66VCHSJNUP", Name: "Tank Top", Picture: "/static/img/products/tank-top.jpg",
+				PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 18, Nanos: 990000000}, Categories: []string{"clothing", "tops"}},
+			{Id: "1YMWWN1N4O", Name: "Watch", Picture: "/static/img/products/watch.jpg",
+				PriceUsd: &pb.Money{CurrencyCode: "USD", Units: 109, Nanos: 990000000}, Categories: []string{"accessories"}},
+		},
+		currencies: []string{"USD", "EUR", "JPY"},
+		carts:      map[string][]*pb.CartItem{},
+		ads:        []*pb.Ad{{RedirectUrl: "/product/1YMWWN1N4O", Text: "Watch for sale"}},
+		calls:      map[string]int{},
+	}
+}
+
+// callCount returns the number of calls received for the named method.
+func (f *fakeBackends) callCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+func (f *fakeBackends) countCalls(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	f.mu.Lock()
+	method := path.Base(info.FullMethod)
+	f.calls[method]++
+	err := f.failing[method]
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (f *fakeBackends) ListProducts(context.Context, *pb.Empty) (*pb.ListProductsResponse, error) {
+	return &pb.ListProductsResponse{Products: f.products}, nil
+}
+
+func (f *fakeBackends) GetProduct(_ context.Context, req *pb.GetProductRequest) (*pb.Product, error) {
+	for _, p := range f.products {
+		if p.GetId() == req.GetId() {
+			return p, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "no product with ID %s", req.GetId())
+}
+
+func (f *fakeBackends) SearchProducts(context.Context, *pb.SearchProductsRequest) (*pb.SearchProductsResponse, error) {
+	return &pb.SearchProductsResponse{Results: f.products}, nil
+}
+
+func (f *fakeBackends) GetSupportedCurrencies(context.Context, *pb.Empty) (*pb.GetSupportedCurrenciesResponse, error) {
+	return &pb.GetSupportedCurrenciesResponse{CurrencyCodes: f.currencies}, nil
+}
+
+// Convert keeps the amount and only swaps the currency code, unless
+// overridden.
+func (f *fakeBackends) Convert(_ context.Context, req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+	if f.convert != nil {
+		return f.convert(req)
+	}
+	return &pb.Money{CurrencyCode: req.GetToCode(), Units: req.GetFrom().GetUnits(), Nanos: req.GetFrom().GetNanos()}, nil
+}
+
+func (f *fakeBackends) AddItem(_ context.Context, req *pb.AddItemRequest) (*pb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, item := range f.carts[req.GetUserId()] {
+		if item.GetProductId() == req.GetItem().GetProductId() {
+			item.Quantity += req.GetItem().GetQuantity()
+			return &pb.Empty{}, nil
+		}
+	}
+	f.carts[req.GetUserId()] = append(f.carts[req.GetUserId()], req.GetItem())
+	return &pb.Empty{}, nil
+}
+
+func (f *fakeBackends) GetCart(_ context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &pb.Cart{UserId: req.GetUserId(), Items: f.carts[req.GetUserId()]}, nil
+}
+
+func (f *fakeBackends) EmptyCart(_ context.Context, req *pb.EmptyCartRequest) (*pb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.carts, req.GetUserId())
+	return &pb.Empty{}, nil
+}
+
+func (f *fakeBackends) ListRecommendations(context.Context, *pb.ListRecommendationsRequest) (*pb.ListRecommendationsResponse, error) {
+	return &pb.ListRecommendationsResponse{ProductIds: f.recommendations}, nil
+}
+
+func (f *fakeBackends) GetQuote(context.Context, *pb.GetQuoteRequest) (*pb.GetQuoteResponse, error) {
+	return &pb.GetQuoteResponse{CostUsd: &pb.Money{CurrencyCode: "USD", Units: 8, Nanos: 990000000}}, nil
+}
+
+func (f *fakeBackends) ShipOrder(context.Context, *pb.ShipOrderRequest) (*pb.ShipOrderResponse, error) {
+	return &pb.ShipOrderResponse{TrackingId: "AB-1234-5678"}, nil
+}
+
+func (f *fakeBackends) PlaceOrder(_ context.Context, req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
+	if f.placeOrder != nil {
+		return f.placeOrder(req)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var items []*pb.OrderItem
+	for _, item := range f.carts[req.GetUserId()] {
+		for _, p := range f.products {
+			if p.GetId() == item.GetProductId() {
+				items = append(items, &pb.OrderItem{Item: item, Cost: p.GetPriceUsd()})
+			}
+		}
+	}
+	delete(f.carts, req.GetUserId())
+	return &pb.PlaceOrderResponse{Order: &pb.OrderResult{
+		OrderId:            "fake-order-id",
+		ShippingTrackingId: "AB-1234-5678",
+		ShippingCost:       &pb.Money{CurrencyCode: "USD", Units: 8, Nanos: 990000000},
+		ShippingAddress:    req.GetAddress(),
+		Items:              items,
+	}}, nil
+}
+
+func (f *fakeBackends) GetAds(_ context.Context, req *pb.AdRequest) (*pb.AdResponse, error) {
+	f.mu.Lock()
+	f.adContextKeys = append(f.adContextKeys, req.GetContextKeys())
+	f.mu.Unlock()
+	return &pb.AdResponse{Ads: f.ads}, nil
+}
+
+// newTestFrontend serves fb over an in-memory listener and points every
+// downstream connection of fe at it, dialing with fe's own dial options.
+func newTestFrontend(t *testing.T, fe *frontendServer, fb *fakeBackends) *frontendServer {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(fb.countCalls))
+	pb.RegisterProductCatalogServiceServer(srv, fb)
+	pb.RegisterCurrencyServiceServer(srv, fb)
+	pb.RegisterCartServiceServer(srv, fb)
+	pb.RegisterRecommendationServiceServer(srv, fb)
+	pb.RegisterShippingServiceServer(srv, fb)
+	pb.RegisterCheckoutServiceServer(srv, fb)
+	pb.RegisterAdServiceServer(srv, fb)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	opts := append(fe.dialOptions(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	conn, err := grpc.Dial("bufnet", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fe.productCatalogSvcConn = conn
+	fe.currencySvcConn = conn
+	fe.cartSvcConn = conn
+	fe.recommendationSvcConn = conn
+	fe.shippingSvcConn = conn
+	fe.checkoutSvcConn = conn
+	fe.adSvcConn = conn
+	return fe
+}
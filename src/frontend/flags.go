@@ -0,0 +1,82 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type ctxKeyFeatureFlags struct{}
+
+const (
+	flagAds             = "ads"
+	flagRecommendations = "recommendations"
+)
+
+// defaultFeatureFlags are the flags that can be toggled per request and
+// their values when not overridden.
+var defaultFeatureFlags = map[string]bool{
+	flagAds:             true,
+	flagRecommendations: true,
+}
+
+// featureEnabled reports whether the named flag is on for the request ctx
+// belongs to.
+func featureEnabled(ctx context.Context, name string) bool {
+	if overrides, ok := ctx.Value(ctxKeyFeatureFlags{}).(map[string]bool); ok {
+		if v, ok := overrides[name]; ok {
+			return v
+		}
+	}
+	return defaultFeatureFlags[name]
+}
+
+// parseFeatureFlags parses an X-Feature-Flags header such as
+// "ads=false, recommendations=true", ignoring unknown flags and malformed
+// entries.
+func parseFeatureFlags(header string) map[string]bool {
+	out := make(map[string]bool)
+	for _, kv := range strings.Split(header, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(kv[:i]))
+		if _, ok := defaultFeatureFlags[name]; !ok {
+			continue
+		}
+		v, err := strconv.ParseBool(strings.TrimSpace(kv[i+1:]))
+		if err != nil {
+			continue
+		}
+		out[name] = v
+	}
+	return out
+}
+
+// overrideFeatureFlags applies the X-Feature-Flags header to the request's
+// flags when overrides are allowed. Otherwise the header is ignored.
+func (fe *frontendServer) overrideFeatureFlags(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h := r.Header.Get("X-Feature-Flags"); fe.allowFlagOverride && h != "" {
+			ctx := context.WithValue(r.Context(), ctxKeyFeatureFlags{}, parseFeatureFlags(h))
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestOverrideFeatureFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		allow     bool
+		header    string
+		wantAds   bool
+		wantRecos bool
+	}{
+		{"allowed", true, "ads=false", false, true},
+		{"allowed, both", true, "ads=false, recommendations=0", false, false},
+		{"allowed, no header", true, "", true, true},
+		{"production ignores header", false, "ads=false, recommendations=false", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFakeBackends()
+			fb.recommendations = []string{"OLJCESPC7Z"}
+			fe := newTestFrontend(t, &frontendServer{allowFlagOverride: tt.allow}, fb)
+
+			var gotAds, gotRecos bool
+			h := fe.overrideFeatureFlags(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+				gotAds = len(fe.chooseAds(r.Context(), nil, log)) > 0
+				recos, err := fe.getRecommendations(r.Context(), testSessionID, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gotRecos = len(recos) > 0
+			}))
+			r := newTestRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Feature-Flags", tt.header)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if gotAds != tt.wantAds || gotRecos != tt.wantRecos {
+				t.Errorf("ads, recommendations = %v, %v, want %v, %v", gotAds, gotRecos, tt.wantAds, tt.wantRecos)
+			}
+		})
+	}
+}
+
+func TestParseFeatureFlags(t *testing.T) {
+	got := parseFeatureFlags("ads=false, unknown=true, recommendations=maybe, =1,ads")
+	if want := map[string]bool{flagAds: false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFeatureFlags() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// flashMaxAge is how long a flash message is kept, in seconds. It only needs
+// to survive one redirect.
+const flashMaxAge = 60
+
+// flash is a message shown once on the page a redirect leads to, e.g. after
+// adding to the cart. It is carried in a signed cookie, so that it cannot
+// be used to put arbitrary text on the site. Kind is the style of the alert:
+// "success", "info" or "warning".
+type flash struct {
+	Kind string
+	Text string
+}
+
+// defaultFlashKey signs the flash messages without FLASH_SECRET. Replicas
+// behind a load balancer need a shared secret, as the redirect may be
+// followed by another replica.
+var defaultFlashKey = newFlashKey()
+
+func newFlashKey() []byte {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		panic(err)
+	}
+	return k
+}
+
+func (fe *frontendServer) flashMAC(payload string) []byte {
+	key := fe.flashKey
+	if len(key) == 0 {
+		key = defaultFlashKey
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// setFlash sets the message to show on the next page rendered.
+func (fe *frontendServer) setFlash(w http.ResponseWriter, r *http.Request, kind, text string) {
+	payload := kind + ":" + text
+	http.SetCookie(w, &http.Cookie{
+		Name: cookieFlash,
+		Value: base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+			base64.RawURLEncoding.EncodeToString(fe.flashMAC(payload)),
+		Domain:   fe.cookieDomainFor(r),
+		MaxAge:   flashMaxAge,
+		HttpOnly: true,
+	})
+}
+
+// takeFlash returns the message set for this page, if any, and clears it so
+// that it is shown once. It must be called before the response is written.
+func (fe *frontendServer) takeFlash(w http.ResponseWriter, r *http.Request) *flash {
+	c, err := r.Cookie(cookieFlash)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   cookieFlash,
+		Domain: fe.cookieDomainFor(r),
+		MaxAge: -1,
+	})
+
+	i := strings.IndexByte(c.Value, '.')
+	if i < 0 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(c.Value[:i])
+	if err != nil {
+		return nil
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(c.Value[i+1:])
+	if err != nil || !hmac.Equal(sig, fe.flashMAC(string(payload))) {
+		return nil
+	}
+	kind, text := string(payload), ""
+	if j := strings.IndexByte(kind, ':'); j >= 0 {
+		kind, text = kind[:j], kind[j+1:]
+	}
+	return &flash{Kind: kind, Text: text}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func flashCleared(w *httptest.ResponseRecorder) bool {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cookieFlash && c.MaxAge < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFlash_addToCart(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	added := httptest.NewRecorder()
+	fe.addToCartHandler(added, newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity=1")))
+	if added.Code != http.StatusFound {
+		t.Fatalf("add to cart: status = %d, want %d", added.Code, http.StatusFound)
+	}
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, withCookies(newTestRequest(http.MethodGet, "/cart", nil), added))
+	if !strings.Contains(w.Body.String(), "Added Sunglasses to your cart.") {
+		t.Error("cart page does not show the flash message set before the redirect")
+	}
+	if !flashCleared(w) {
+		t.Errorf("Set-Cookie = %q, want the flash message cleared", w.Header()["Set-Cookie"])
+	}
+
+	// The browser dropped the cleared cookie.
+	w = httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+	if strings.Contains(w.Body.String(), "Added Sunglasses to your cart.") {
+		t.Error("cart page shows the flash message again")
+	}
+}
+
+func TestFlash_clearedOnRejectedCheckout(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{supportedCountries: []string{"CA"}}, fb)
+
+	set := httptest.NewRecorder()
+	fe.setFlash(set, newTestRequest(http.MethodGet, "/", nil), "info", "Your cart was emptied.")
+
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, withCookies(newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(testCheckoutForm)), set))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(w.Body.String(), "Your cart was emptied.") {
+		t.Error("cart page does not show the flash message")
+	}
+	if !flashCleared(w) {
+		t.Errorf("Set-Cookie = %q, want the flash message cleared", w.Header()["Set-Cookie"])
+	}
+}
+
+func TestFlash_emptyCartShownOnRevalidatedHome(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+	etag := w.Header().Get("ETag")
+
+	emptied := httptest.NewRecorder()
+	fe.emptyCartHandler(emptied, newTestRequest(http.MethodPost, "/cart/empty", nil))
+
+	r := withCookies(newTestRequest(http.MethodGet, "/", nil), emptied)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	fe.homeHandler(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Your cart was emptied.") {
+		t.Errorf("status = %d, want %d with the flash message, although the page is otherwise unchanged", w.Code, http.StatusOK)
+	}
+}
+
+func TestFlash_rejectsTampering(t *testing.T) {
+	fe := newTestFrontend(t, &frontendServer{}, newFakeBackends())
+
+	set := httptest.NewRecorder()
+	fe.setFlash(set, newTestRequest(http.MethodGet, "/", nil), "info", "Your cart was emptied.")
+	c := set.Result().Cookies()[0]
+	c.Value = strings.Replace(c.Value, ".", "A.", 1)
+
+	r := newTestRequest(http.MethodGet, "/cart", nil)
+	r.AddCookie(c)
+	w := httptest.NewRecorder()
+	if f := fe.takeFlash(w, r); f != nil {
+		t.Errorf("takeFlash() = %+v for a tampered cookie, want nil", f)
+	}
+	if !flashCleared(w) {
+		t.Error("the tampered cookie is not cleared")
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// ranges, e.g. "10.0.0.0/8, 192.168.1.10".
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// fromTrustedProxy reports whether the peer of r is one of the trusted
+// proxies, whose X-Forwarded-* headers can be believed.
+func (fe *frontendServer) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range fe.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// externalOrigin returns the scheme and host the client used to reach the
+// frontend. Behind a trusted proxy they are taken from X-Forwarded-Proto and
+// X-Forwarded-Host; otherwise, or if the headers are absent or malformed,
+// from the request itself.
+func (fe *frontendServer) externalOrigin(r *http.Request) (scheme, host string) {
+	scheme, host = "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if !fe.fromTrustedProxy(r) {
+		return scheme, host
+	}
+	if v := firstForwardedValue(r.Header.Get("X-Forwarded-Proto")); v == "http" || v == "https" {
+		scheme = v
+	}
+	if v := firstForwardedValue(r.Header.Get("X-Forwarded-Host")); v != "" && !strings.ContainsAny(v, "/\\@ ") {
+		host = v
+	}
+	return scheme, host
+}
+
+// externalHost returns the host the client used to reach the frontend.
+func (fe *frontendServer) externalHost(r *http.Request) string {
+	_, host := fe.externalOrigin(r)
+	return host
+}
+
+// absoluteURL returns the external URL of path, an absolute path on this
+// site.
+func (fe *frontendServer) absoluteURL(r *http.Request, path string) string {
+	scheme, host := fe.externalOrigin(r)
+	return scheme + "://" + host + path
+}
+
+// redirectToCanonicalHost permanently redirects requests reaching the
+// frontend under another host than canonicalHost, or over plain HTTP when
+// canonicalHTTPS is set, to the same path and query on the canonical origin.
+// The origin is the external one, so a TLS-terminating proxy must be trusted
+// for canonicalHTTPS not to redirect in a loop. Probes and scrapes are served
+// under any host.
+func (fe *frontendServer) redirectToCanonicalHost(next http.Handler) http.Handler {
+	if fe.canonicalHost == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimitedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scheme, host := fe.externalOrigin(r)
+		wantScheme := scheme
+		if fe.canonicalHTTPS {
+			wantScheme = "https"
+		}
+		if scheme == wantScheme && strings.EqualFold(host, fe.canonicalHost) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// 308 keeps the method and body of form posts, which a 301 may not.
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, wantScheme+"://"+fe.canonicalHost+r.URL.RequestURI(), code)
+	})
+}
+
+// hstsHeader returns the Strict-Transport-Security header value for the
+// given policy, or "" if maxAge is zero and HSTS is disabled.
+func hstsHeader(maxAge time.Duration, includeSubDomains, preload bool) string {
+	if maxAge <= 0 {
+		return ""
+	}
+	v := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if includeSubDomains {
+		v += "; includeSubDomains"
+	}
+	if preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// strictTransportSecurity sets the HSTS header on responses to requests made
+// over HTTPS, as seen by the client. Browsers ignore it over plain HTTP, and
+// it is not sent there so that local HTTP testing is never locked out.
+func (fe *frontendServer) strictTransportSecurity(next http.Handler) http.Handler {
+	if fe.hsts == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if scheme, _ := fe.externalOrigin(r); scheme == "https" {
+			w.Header().Set("Strict-Transport-Security", fe.hsts)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// firstForwardedValue returns the first entry of a comma-separated
+// X-Forwarded-* header, which was set by the proxy closest to the client.
+func firstForwardedValue(v string) string {
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(v))
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAbsoluteURL(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe := &frontendServer{trustedProxies: proxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		proto      string
+		host       string
+		want       string
+	}{
+		{"trusted range", "10.1.2.3:4567", "https", "shop.example.com", "https://shop.example.com/cart"},
+		{"trusted address", "192.168.1.10:4567", "https", "shop.example.com", "https://shop.example.com/cart"},
+		{"multiple hops", "10.1.2.3:4567", "https, http", "shop.example.com, frontend", "https://shop.example.com/cart"},
+		{"trusted without headers", "10.1.2.3:4567", "", "", "http://frontend:8080/cart"},
+		{"untrusted", "203.0.113.7:4567", "https", "evil.example.com", "http://frontend:8080/cart"},
+		{"malformed headers", "10.1.2.3:4567", "javascript", "evil.example.com/path", "http://frontend:8080/cart"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = "frontend:8080"
+			r.RemoteAddr = tt.remoteAddr
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if tt.host != "" {
+				r.Header.Set("X-Forwarded-Host", tt.host)
+			}
+			if got := fe.absoluteURL(r, "/cart"); got != tt.want {
+				t.Errorf("absoluteURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies_invalid(t *testing.T) {
+	for _, s := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := parseTrustedProxies(s); err == nil {
+			t.Errorf("parseTrustedProxies(%q) = nil error", s)
+		}
+	}
+}
+
+func TestSetCurrencyHandler_redirectsBehindProxy(t *testing.T) {
+	proxies, _ := parseTrustedProxies("10.0.0.0/8")
+	fe := &frontendServer{trustedProxies: proxies}
+
+	r := newTestRequest(http.MethodPost, "/setCurrency", nil)
+	r.Host = "frontend:8080"
+	r.RemoteAddr = "10.1.2.3:4567"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "shop.example.com")
+	r.Header.Set("Referer", "https://shop.example.com/product/OLJCESPC7Z")
+	w := httptest.NewRecorder()
+	fe.setCurrencyHandler(w, r)
+
+	if got, want := w.Header().Get("Location"), "https://shop.example.com/product/OLJCESPC7Z"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+}
+
+func TestRedirectToCanonicalHost(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe := &frontendServer{canonicalHost: "www.example.com", canonicalHTTPS: true, trustedProxies: proxies}
+	h := fe.redirectToCanonicalHost(noopHandler)
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		proto    string
+		wantCode int
+		wantLoc  string
+	}{
+		{"other host", http.MethodGet, "http://example.com/product/OLJCESPC7Z?ref=ad", "https", http.StatusMovedPermanently, "https://www.example.com/product/OLJCESPC7Z?ref=ad"},
+		{"plain http", http.MethodGet, "http://www.example.com/cart", "http", http.StatusMovedPermanently, "https://www.example.com/cart"},
+		{"form post", http.MethodPost, "http://example.com/cart", "https", http.StatusPermanentRedirect, "https://www.example.com/cart"},
+		{"canonical", http.MethodGet, "http://WWW.example.com/cart", "https", http.StatusOK, ""},
+		{"health check", http.MethodGet, "http://10.1.2.3:8080/_healthz", "", http.StatusOK, ""},
+		{"metrics", http.MethodGet, "http://10.1.2.3:8080/metrics", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.RemoteAddr = "10.1.2.3:4567"
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLoc {
+				t.Errorf("Location = %q, want %q", got, tt.wantLoc)
+			}
+		})
+	}
+}
+
+func TestRedirectToCanonicalHost_unset(t *testing.T) {
+	h := (&frontendServer{}).redirectToCanonicalHost(noopHandler)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://anything.example.com/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d without CANONICAL_HOST, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestStrictTransportSecurity(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe := &frontendServer{
+		trustedProxies: proxies,
+		hsts:           hstsHeader(365*24*time.Hour, true, true),
+	}
+	h := fe.strictTransportSecurity(noopHandler)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		proto      string
+		want       string
+	}{
+		{"https", "203.0.113.7:4567", true, "", "max-age=31536000; includeSubDomains; preload"},
+		{"http", "203.0.113.7:4567", false, "", ""},
+		{"trusted proxy https", "10.1.2.3:4567", false, "https", "max-age=31536000; includeSubDomains; preload"},
+		{"trusted proxy http", "10.1.2.3:4567", true, "http", ""},
+		{"untrusted proxy https", "203.0.113.7:4567", false, "https", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if got := w.Header().Get("Strict-Transport-Security"); got != tt.want {
+				t.Errorf("Strict-Transport-Security = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHSTSHeader(t *testing.T) {
+	if got := hstsHeader(0, true, true); got != "" {
+		t.Errorf("hstsHeader(0) = %q, want HSTS disabled", got)
+	}
+	if got, want := hstsHeader(time.Hour, false, false), "max-age=3600"; got != want {
+		t.Errorf("hstsHeader(1h) = %q, want %q", got, want)
+	}
+}
@@ -16,18 +16,26 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"html/template"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
@@ -38,14 +46,38 @@ type platformDetails struct {
 	provider string
 }
 
+const defaultStoreName = "Online Boutique"
+
+// branding is the store identity shown in the header and footer of every
+// page, configured by STORE_NAME and SHOW_BRANDING.
+type branding struct {
+	storeName string
+	// show controls the upstream demo notice and links in the footer.
+	show bool
+}
+
 var (
 	templates = template.Must(template.New("").
 			Funcs(template.FuncMap{
-			"renderMoney": renderMoney,
+			"renderMoney":      renderMoney,
+			"renderPriceRange": renderPriceRange,
+			"renderPriceFrom":  renderPriceFrom,
+			"cardName":         cardName,
+			"cardDescription":  cardDescription,
+			"imageURL":         imageURL,
 		}).ParseGlob("templates/*.html"))
-	plat platformDetails
+	plat  platformDetails
+	brand = branding{storeName: defaultStoreName, show: true}
 )
 
+type productView struct {
+	Item  *pb.Product
+	Price *pb.Money
+	// MaxPrice is the highest price of the product's variants, if they
+	// differ, with Price the lowest.
+	MaxPrice *pb.Money
+}
+
 func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.WithField("currency", currentCurrency(r)).Info("home")
@@ -59,24 +91,26 @@ func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve products"), http.StatusInternalServerError)
 		return
 	}
-	cart, err := fe.getCart(r.Context(), sessionID(r))
+	sortProducts(products, r.URL.Query().Get("sort"))
+	cart, err := fe.getCart(r.Context(), userID(r))
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
 		return
 	}
 
-	type productView struct {
-		Item  *pb.Product
-		Price *pb.Money
-	}
-	ps := make([]productView, len(products))
-	for i, p := range products {
-		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
-		if err != nil {
-			renderHTTPError(log, r, w, errors.Wrapf(err, "failed to do currency conversion for product %s", p.GetId()), http.StatusInternalServerError)
-			return
-		}
-		ps[i] = productView{p, price}
+	// The page only changes with the catalog, the currency, the query and the
+	// session's cart, so revalidations can skip the conversions and render.
+	lastOrder := fe.orders.last(userID(r))
+	etag := homeETag(products, currentCurrency(r), r.URL.RawQuery, userID(r), cartSize(cart), lastOrder.GetOrderId())
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Add("Vary", "Cookie")
+	// A page with a flash message is always rendered, as the message is
+	// cleared once taken.
+	flash := fe.takeFlash(w, r)
+	if flash == nil && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
 	//get env and render correct platform banner.
@@ -84,23 +118,216 @@ func (fe *frontendServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 	plat = platformDetails{}
 	plat.setPlatformDetails(strings.ToLower(env))
 
-	if err := templates.ExecuteTemplate(w, "home", map[string]interface{}{
+	data := map[string]interface{}{
 		"session_id":    sessionID(r),
 		"request_id":    r.Context().Value(ctxKeyRequestID{}),
 		"user_currency": currentCurrency(r),
 		"show_currency": true,
 		"currencies":    currencies,
-		"products":      ps,
 		"cart_size":     cartSize(cart),
+		"buy_again":     buyAgain(lastOrder, products),
+		"read_only":     fe.readOnly,
+		"tax_inclusive": fe.taxInclusive,
+		"flash":         flash,
+		"meta":          fe.pageMeta(r, "/", "", ""),
 		"banner_color":  os.Getenv("BANNER_COLOR"), // illustrates canary deployments
-		"ad":            fe.chooseAd(r.Context(), []string{}, log),
 		"platform_css":  plat.css,
 		"platform_name": plat.provider,
-	}); err != nil {
+	}
+	if fe.streamCatalogThreshold > 0 && len(products) > fe.streamCatalogThreshold {
+		fe.streamHome(w, r, log, data, products)
+		return
+	}
+
+	ps, err := fe.productViews(r.Context(), products, currentCurrency(r))
+	if err != nil {
+		renderHTTPError(log, r, w, err, http.StatusInternalServerError)
+		return
+	}
+	data["products"] = ps
+	data["featured"] = featuredProducts(ps, fe.featuredProductIDs)
+	data["new_arrivals"] = featuredProducts(ps, fe.newArrivalIDs)
+	data["ads"] = fe.chooseAds(r.Context(), []string{}, log)
+
+	if clientGone(log, r) {
+		return
+	}
+	renderPage(log, r, w, http.StatusOK, "home", data)
+}
+
+// streamHome renders the home page like the "home" template, but converts
+// and writes the product cards streamChunkSize at a time, flushing each
+// chunk, so that a very large catalog is neither rendered in memory at once
+// nor holds back the start of the page.
+func (fe *frontendServer) streamHome(w http.ResponseWriter, r *http.Request, log logrus.FieldLogger, data map[string]interface{}, products []*pb.Product) {
+	var candidates []*pb.Product
+	for _, p := range products {
+		if contains(fe.featuredProductIDs, p.GetId()) || contains(fe.newArrivalIDs, p.GetId()) {
+			candidates = append(candidates, p)
+		}
+	}
+	highlighted, err := fe.productViews(r.Context(), candidates, currentCurrency(r))
+	if err != nil {
+		renderHTTPError(log, r, w, err, http.StatusInternalServerError)
+		return
+	}
+	data["featured"] = featuredProducts(highlighted, fe.featuredProductIDs)
+	data["new_arrivals"] = featuredProducts(highlighted, fe.newArrivalIDs)
+	data["ads"] = fe.chooseAds(r.Context(), []string{}, log)
+
+	if clientGone(log, r) {
+		return
+	}
+	if err := renderTemplate(w, "home_top", data); err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to render home_top"), http.StatusInternalServerError)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	for i := 0; i < len(products); i += streamChunkSize {
+		end := i + streamChunkSize
+		if end > len(products) {
+			end = len(products)
+		}
+		ps, err := fe.productViews(r.Context(), products[i:end], currentCurrency(r))
+		if err != nil {
+			// The page has started, so it can only be cut short.
+			if !clientGone(log, r) {
+				log.WithField("error", err).Error("failed to stream the product list")
+			}
+			return
+		}
+		for _, p := range ps {
+			if err := renderTemplate(w, "product_card", p); err != nil {
+				log.Error(err)
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err := renderTemplate(w, "home_bottom", data); err != nil {
 		log.Error(err)
 	}
 }
 
+// productViews converts the prices of ps to currency, as displayed.
+func (fe *frontendServer) productViews(ctx context.Context, ps []*pb.Product, currency string) ([]productView, error) {
+	out := make([]productView, len(ps))
+	for i, p := range ps {
+		price, maxPrice, err := fe.productPriceRange(ctx, p, currency)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to do currency conversion for product %s", p.GetId())
+		}
+		out[i] = productView{p, price, maxPrice}
+	}
+	return out, nil
+}
+
+// buyAgainItem is an item of a previous order that can be added again.
+type buyAgainItem struct {
+	Item     *pb.Product
+	Quantity int32
+}
+
+// buyAgain returns the items of order that are still in products, in the
+// order's order. It returns nil if there is no order.
+func buyAgain(order *pb.OrderResult, products []*pb.Product) []buyAgainItem {
+	byID := make(map[string]*pb.Product, len(products))
+	for _, p := range products {
+		byID[p.GetId()] = p
+	}
+	var out []buyAgainItem
+	for _, v := range order.GetItems() {
+		if p, ok := byID[v.GetItem().GetProductId()]; ok {
+			out = append(out, buyAgainItem{p, v.GetItem().GetQuantity()})
+		}
+	}
+	return out
+}
+
+// homeETag returns a weak entity tag for the home page. It is weak since
+// the chosen ads vary between otherwise equivalent renders.
+func homeETag(products []*pb.Product, currency, query, sessionID string, cartSize int, lastOrderID string) string {
+	h := sha256.New()
+	for _, p := range products {
+		fmt.Fprintf(h, "%s|%s|%s|%s|%s\n", p.GetId(), p.GetName(), p.GetPicture(), p.GetPriceUsd().String(), strings.Join(p.GetCategories(), ","))
+	}
+	fmt.Fprintf(h, "%s|%s|%s|%d|%s|%s|%s", currency, query, sessionID, cartSize, lastOrderID, os.Getenv("BANNER_COLOR"), os.Getenv("ENV_PLATFORM"))
+	return fmt.Sprintf("W/%q", hex.EncodeToString(h.Sum(nil)[:16]))
+}
+
+// etagMatches reports whether the If-None-Match header value matches etag,
+// using the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// featuredProducts returns the views of the products with the given IDs, in
+// that order, skipping IDs that are not in the catalog.
+func featuredProducts(ps []productView, ids []string) []productView {
+	byID := make(map[string]productView, len(ps))
+	for _, p := range ps {
+		byID[p.Item.GetId()] = p
+	}
+	var out []productView
+	for _, id := range ids {
+		if p, ok := byID[id]; ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// productOrders are the orders the home page can list products in, by the
+// value of its "sort" parameter. Each compares a and b, returning a negative
+// number if a comes first.
+var productOrders = map[string]func(a, b *pb.Product) int{
+	"name": func(a, b *pb.Product) int {
+		return strings.Compare(strings.ToLower(a.GetName()), strings.ToLower(b.GetName()))
+	},
+	"price": func(a, b *pb.Product) int {
+		return compareMoney(a.GetPriceUsd(), b.GetPriceUsd())
+	},
+	"price_desc": func(a, b *pb.Product) int {
+		return compareMoney(b.GetPriceUsd(), a.GetPriceUsd())
+	},
+}
+
+// sortProducts sorts products in the named order, breaking ties by product
+// ID so that the order is the same on every request. Products are left in
+// catalog order if the order is unknown.
+func sortProducts(products []*pb.Product, order string) {
+	cmp, ok := productOrders[order]
+	if !ok {
+		return
+	}
+	sort.Slice(products, func(i, j int) bool {
+		if c := cmp(products[i], products[j]); c != 0 {
+			return c < 0
+		}
+		return products[i].GetId() < products[j].GetId()
+	})
+}
+
+// compareMoney compares two amounts of the same currency, ordered as by
+// lessMoney.
+func compareMoney(a, b *pb.Money) int {
+	switch {
+	case lessMoney(a, b):
+		return -1
+	case lessMoney(b, a):
+		return 1
+	}
+	return 0
+}
+
 func (plat *platformDetails) setPlatformDetails(env string) {
 	if env == "aws" {
 		plat.provider = "AWS"
@@ -128,6 +355,10 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 		Debug("serving product page")
 
 	p, err := fe.getProduct(r.Context(), id)
+	if isProductUnavailable(err) {
+		fe.productNotFound(w, r, id, err)
+		return
+	}
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
 		return
@@ -138,66 +369,151 @@ func (fe *frontendServer) productHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	cart, err := fe.getCart(r.Context(), sessionID(r))
+	cart, err := fe.getCart(r.Context(), userID(r))
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
 		return
 	}
 
-	price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
-	if err != nil {
-		renderHTTPError(log, r, w, errors.Wrap(err, "failed to convert currency"), http.StatusInternalServerError)
-		return
+	// A failed conversion only costs the page its converted price.
+	price, maxPrice, err := fe.productPriceRange(r.Context(), p, currentCurrency(r))
+	conversionFailed := err != nil
+	if conversionFailed {
+		log.WithField("error", err).Warn("failed to convert the product price, showing it in " + defaultCurrency)
+		priceConversionFallbacks.Inc()
+		price, maxPrice = priceRange(fe.variantPrices(p))
+		if !lessMoney(price, maxPrice) {
+			maxPrice = nil
+		}
 	}
 
-	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), []string{id})
+	recommendations, err := fe.getRecommendations(r.Context(), userID(r), []string{id})
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to get product recommendations"), http.StatusInternalServerError)
 		return
 	}
 
-	product := struct {
-		Item  *pb.Product
-		Price *pb.Money
-	}{p, price}
+	product := productView{p, price, maxPrice}
+
+	if clientGone(log, r) {
+		return
+	}
+	renderPage(log, r, w, http.StatusOK, "product", map[string]interface{}{
+		"session_id":        sessionID(r),
+		"request_id":        r.Context().Value(ctxKeyRequestID{}),
+		"ads":               fe.chooseAds(r.Context(), adContextKeys([]*pb.Product{p}), log),
+		"user_currency":     currentCurrency(r),
+		"show_currency":     true,
+		"currencies":        currencies,
+		"product":           product,
+		"tax_inclusive":     fe.taxInclusive,
+		"quantities":        fe.quantityOptions(id),
+		"quantity":          fe.defaultQuantity(id),
+		"low_stock":         fe.lowStock(p),
+		"out_of_stock":      fe.outOfStock(p),
+		"restock_signup":    fe.restockSignups != nil,
+		"in_cart":           fe.inCart(cart, id),
+		"price_unconverted": conversionFailed,
+		"read_only":         fe.readOnly,
+		"flash":             fe.takeFlash(w, r),
+		"meta":              fe.pageMeta(r, "/product/"+p.GetId(), p.GetName(), p.GetDescription()),
+		"recommendations":   recommendations,
+		"cart_size":         cartSize(cart),
+		"platform_css":      plat.css,
+		"platform_name":     plat.provider,
+	})
+}
 
-	if err := templates.ExecuteTemplate(w, "product", map[string]interface{}{
+// productNotFound responds 404 with recommended products so that the user
+// can recover, or with the plain error page if there are none to show.
+func (fe *frontendServer) productNotFound(w http.ResponseWriter, r *http.Request, id string, err error) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	err = errors.Wrapf(err, "product %q not found", id)
+	recommendations, recErr := fe.getRecommendations(r.Context(), userID(r), nil)
+	if recErr != nil || len(recommendations) == 0 {
+		if recErr != nil {
+			log.WithField("error", recErr).Warn("failed to get suggestions for missing product")
+		}
+		renderHTTPError(log, r, w, err, http.StatusNotFound)
+		return
+	}
+	log.WithField("error", err).Info("product not found")
+	renderPage(log, r, w, http.StatusNotFound, "product_not_found", map[string]interface{}{
 		"session_id":      sessionID(r),
+		"flash":           fe.takeFlash(w, r),
 		"request_id":      r.Context().Value(ctxKeyRequestID{}),
-		"ad":              fe.chooseAd(r.Context(), p.Categories, log),
 		"user_currency":   currentCurrency(r),
-		"show_currency":   true,
-		"currencies":      currencies,
-		"product":         product,
+		"show_currency":   false,
 		"recommendations": recommendations,
-		"cart_size":       cartSize(cart),
 		"platform_css":    plat.css,
 		"platform_name":   plat.provider,
-	}); err != nil {
-		log.Println(err)
-	}
+	})
 }
 
 func (fe *frontendServer) addToCartHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
-	quantity, _ := strconv.ParseUint(r.FormValue("quantity"), 10, 32)
 	productID := r.FormValue("product_id")
+	quantity := uint64(fe.defaultQuantity(productID))
+	if v := r.FormValue("quantity"); v != "" {
+		quantity, _ = strconv.ParseUint(v, 10, 32)
+	}
 	if productID == "" || quantity == 0 {
 		renderHTTPError(log, r, w, errors.New("invalid form input"), http.StatusBadRequest)
 		return
 	}
+	if min := fe.minQuantity(productID); quantity < uint64(min) {
+		renderHTTPError(log, r, w, errors.Errorf("the minimum quantity for this product is %d", min), http.StatusBadRequest)
+		return
+	}
 	log.WithField("product", productID).WithField("quantity", quantity).Debug("adding to cart")
 
 	p, err := fe.getProduct(r.Context(), productID)
+	if isProductUnavailable(err) {
+		renderHTTPError(log, r, w, errors.Wrapf(err, "product %q not found", productID), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
 		return
 	}
 
-	if err := fe.insertCart(r.Context(), sessionID(r), p.GetId(), int32(quantity)); err != nil {
+	if fe.maxCartTotal != nil {
+		cart, err := fe.getCart(r.Context(), userID(r))
+		if err != nil {
+			renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
+			return
+		}
+		exceeded, err := fe.cartTotalExceeded(r.Context(), cart, p, uint32(quantity))
+		if err != nil {
+			renderHTTPError(log, r, w, err, http.StatusInternalServerError)
+			return
+		}
+		if exceeded != "" {
+			renderHTTPError(log, r, w, errors.New(exceeded), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := fe.insertCart(r.Context(), userID(r), p.GetId(), int32(quantity)); err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to add to cart"), http.StatusInternalServerError)
 		return
 	}
+	fe.prices.record(userID(r), p.GetId(), *p.GetPriceUsd())
+	fe.markCartItems(w, r, true)
+	fe.setFlash(w, r, "success", fmt.Sprintf("Added %s to your cart.", p.GetName()))
+
+	// Remember where the user was so the cart page can send them back.
+	returnTo := r.FormValue("return_to")
+	if returnTo == "" {
+		returnTo = r.Header.Get("referer")
+	}
+	if target, ok := internalPath(returnTo, fe.externalHost(r)); ok {
+		http.SetCookie(w, &http.Cookie{
+			Name:   cookieContinueShopping,
+			Value:  target,
+			Domain: fe.cookieDomainFor(r),
+		})
+	}
 	w.Header().Set("location", "/cart")
 	w.WriteHeader(http.StatusFound)
 }
@@ -206,15 +522,24 @@ func (fe *frontendServer) emptyCartHandler(w http.ResponseWriter, r *http.Reques
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("emptying cart")
 
-	if err := fe.emptyCart(r.Context(), sessionID(r)); err != nil {
+	if err := fe.emptyCart(r.Context(), userID(r)); err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to empty cart"), http.StatusInternalServerError)
 		return
 	}
+	fe.prices.forget(userID(r))
+	fe.markCartItems(w, r, false)
+	fe.setFlash(w, r, "info", "Your cart was emptied.")
 	w.Header().Set("location", "/")
 	w.WriteHeader(http.StatusFound)
 }
 
 func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request) {
+	fe.renderCart(w, r, "")
+}
+
+// renderCart renders the cart page. A non-empty checkoutErr is shown above
+// the checkout form, with a 400 status, for submissions rejected inline.
+func (fe *frontendServer) renderCart(w http.ResponseWriter, r *http.Request, checkoutErr string) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("view user cart")
 	currencies, err := fe.getCurrencies(r.Context())
@@ -222,13 +547,13 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
 		return
 	}
-	cart, err := fe.getCart(r.Context(), sessionID(r))
+	cart, err := fe.getCart(r.Context(), userID(r))
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve cart"), http.StatusInternalServerError)
 		return
 	}
 
-	recommendations, err := fe.getRecommendations(r.Context(), sessionID(r), cartIDs(cart))
+	recommendations, err := fe.getRecommendations(r.Context(), userID(r), cartIDs(cart))
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to get product recommendations"), http.StatusInternalServerError)
 		return
@@ -241,18 +566,34 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	type cartItemView struct {
-		Item     *pb.Product
-		Quantity int32
-		Price    *pb.Money
+		Item          *pb.Product
+		Quantity      int32
+		Price         *pb.Money
+		Unavailable   bool
+		PreviousPrice *pb.Money // unit price when added, if it increased since
+		LowStock      int       // units left, if few enough to badge
 	}
 	items := make([]cartItemView, len(cart))
-	totalPrice := pb.Money{CurrencyCode: currentCurrency(r)}
+	products := make([]*pb.Product, 0, len(cart))
+	subtotal := pb.Money{CurrencyCode: currentCurrency(r)}
+	hasUnavailable, pricesIncreased := false, false
 	for i, item := range cart {
 		p, err := fe.getProduct(r.Context(), item.GetProductId())
+		if isProductUnavailable(err) {
+			// Flag items that went away since they were added rather than
+			// failing the page, so the user can adjust their cart.
+			items[i] = cartItemView{
+				Item:        &pb.Product{Id: item.GetProductId()},
+				Quantity:    item.GetQuantity(),
+				Unavailable: true}
+			hasUnavailable = true
+			continue
+		}
 		if err != nil {
 			renderHTTPError(log, r, w, errors.Wrapf(err, "could not retrieve product #%s", item.GetProductId()), http.StatusInternalServerError)
 			return
 		}
+		products = append(products, p)
 		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
 		if err != nil {
 			renderHTTPError(log, r, w, errors.Wrapf(err, "could not convert currency for product #%s", item.GetProductId()), http.StatusInternalServerError)
@@ -263,13 +604,33 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 		items[i] = cartItemView{
 			Item:     p,
 			Quantity: item.GetQuantity(),
-			Price:    &multPrice}
-		totalPrice = money.Must(money.Sum(totalPrice, multPrice))
+			Price:    &multPrice,
+			LowStock: fe.lowStock(p)}
+		if old, ok := fe.priceIncreased(userID(r), p); ok {
+			prev, err := fe.convertCurrency(r.Context(), &old, currentCurrency(r))
+			if err != nil {
+				renderHTTPError(log, r, w, errors.Wrapf(err, "could not convert currency for product #%s", item.GetProductId()), http.StatusInternalServerError)
+				return
+			}
+			items[i].PreviousPrice = prev
+			pricesIncreased = true
+		}
+		subtotal = money.Must(money.Sum(subtotal, multPrice))
 	}
-	totalPrice = money.Must(money.Sum(totalPrice, *shippingCost))
+	// The destination is not known yet, so the tax is estimated at the flat
+	// rate.
+	breakdown := fe.costBreakdown(subtotal, *shippingCost, "")
+	expired := fe.cartExpired(w, r, len(cart) == 0)
 
 	year := time.Now().Year()
-	if err := templates.ExecuteTemplate(w, "cart", map[string]interface{}{
+	code := http.StatusOK
+	if checkoutErr != "" {
+		code = http.StatusBadRequest
+	}
+	if clientGone(log, r) {
+		return
+	}
+	renderPage(log, r, w, code, "cart", map[string]interface{}{
 		"session_id":       sessionID(r),
 		"request_id":       r.Context().Value(ctxKeyRequestID{}),
 		"user_currency":    currentCurrency(r),
@@ -278,85 +639,236 @@ func (fe *frontendServer) viewCartHandler(w http.ResponseWriter, r *http.Request
 		"cart_size":        cartSize(cart),
 		"shipping_cost":    shippingCost,
 		"show_currency":    true,
-		"total_cost":       totalPrice,
+		"total_cost":       breakdown.Total,
+		"breakdown":        breakdown,
+		"tax_inclusive":    fe.taxInclusive,
 		"items":            items,
+		"has_unavailable":  hasUnavailable,
+		"prices_increased": pricesIncreased,
 		"expiration_years": []int{year, year + 1, year + 2, year + 3, year + 4},
+		"countries":        fe.supportedCountries,
+		"selected_country": strings.ToUpper(r.FormValue("country")),
+		"checkout_error":   checkoutErr,
+		"cart_expired":     expired,
+		"flash":            fe.takeFlash(w, r),
+		"checkout_review":  fe.checkoutReview,
+		"read_only":        fe.readOnly,
+		"continue_url":     fe.continueShoppingURL(r),
+		"ads":              fe.chooseAds(r.Context(), adContextKeys(products), log),
 		"platform_css":     plat.css,
 		"platform_name":    plat.provider,
-	}); err != nil {
-		log.Println(err)
-	}
+	})
 }
 
 func (fe *frontendServer) placeOrderHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("placing order")
 
-	var (
-		email         = r.FormValue("email")
-		streetAddress = r.FormValue("street_address")
-		zipCode, _    = strconv.ParseInt(r.FormValue("zip_code"), 10, 32)
-		city          = r.FormValue("city")
-		state         = r.FormValue("state")
-		country       = r.FormValue("country")
-		ccNumber      = r.FormValue("credit_card_number")
-		ccMonth, _    = strconv.ParseInt(r.FormValue("credit_card_expiration_month"), 10, 32)
-		ccYear, _     = strconv.ParseInt(r.FormValue("credit_card_expiration_year"), 10, 32)
-		ccCVV, _      = strconv.ParseInt(r.FormValue("credit_card_cvv"), 10, 32)
-	)
-
-	order, err := pb.NewCheckoutServiceClient(fe.checkoutSvcConn).
-		PlaceOrder(r.Context(), &pb.PlaceOrderRequest{
-			Email: email,
-			CreditCard: &pb.CreditCardInfo{
-				CreditCardNumber:          ccNumber,
-				CreditCardExpirationMonth: int32(ccMonth),
-				CreditCardExpirationYear:  int32(ccYear),
-				CreditCardCvv:             int32(ccCVV)},
-			UserId:       sessionID(r),
-			UserCurrency: currentCurrency(r),
-			Address: &pb.Address{
-				StreetAddress: streetAddress,
-				City:          city,
-				State:         state,
-				ZipCode:       int32(zipCode),
-				Country:       country},
-		})
+	// Every outcome is logged with the stage reached, never with any of the
+	// payment details.
+	start := time.Now()
+	clog := log.WithFields(logrus.Fields{
+		"session":     sessionID(r),
+		"http.req.id": r.Context().Value(ctxKeyRequestID{})})
+	failed := func(stage string, code codes.Code) {
+		clog.WithFields(logrus.Fields{
+			"stage":   stage,
+			"code":    code.String(),
+			"took_ms": int64(time.Since(start) / time.Millisecond)}).Warn("checkout failed")
+	}
+
+	// Resubmitting a review page shows the order already placed from it.
+	key := r.FormValue("idempotency_key")
+	placed := false
+	if key != "" {
+		prev, ok := fe.orders.claim(userID(r), key)
+		if !ok && prev.order == nil {
+			renderHTTPError(log, r, w, errors.New("this order is already being placed"), http.StatusConflict)
+			return
+		}
+		if !ok {
+			clog.WithField("order", prev.order.GetOrderId()).Info("order already placed, showing it again")
+			fe.renderOrder(w, r, prev.order, prev.breakdown)
+			return
+		}
+		defer func() {
+			if !placed {
+				fe.orders.release(userID(r), key)
+			}
+		}()
+	}
+
+	form := parseCheckoutForm(r)
+	if key != "" {
+		var ok bool
+		if form, ok = fe.reviews.get(userID(r), key); !ok {
+			failed("validate", codes.FailedPrecondition)
+			fe.renderCart(w, r, "Your order review has expired. Please check out again.")
+			return
+		}
+	}
+	cart, ok := fe.checkCheckout(w, r, &form, failed)
+	if !ok {
+		return
+	}
+
+	req := form.placeOrderRequest(userID(r), currentCurrency(r))
+	var err error
+	var order *pb.OrderResult
+	if fe.checkoutDryRun {
+		order, err = fe.dryRunOrder(r.Context(), req, cart)
+	} else {
+		var resp *pb.PlaceOrderResponse
+		resp, err = pb.NewCheckoutServiceClient(fe.checkoutSvcConn).PlaceOrder(r.Context(), req)
+		order = resp.GetOrder()
+	}
 	if err != nil {
+		failed("place_order", status.Code(errors.Cause(err)))
 		renderHTTPError(log, r, w, errors.Wrap(err, "failed to complete the order"), http.StatusInternalServerError)
 		return
 	}
-	log.WithField("order", order.GetOrder().GetOrderId()).Info("order placed")
+	// The checkout service empties the cart.
+	forgetCart(r.Context())
+	fe.prices.forget(userID(r))
+	fe.markCartItems(w, r, false)
 
-	order.GetOrder().GetItems()
-	recommendations, _ := fe.getRecommendations(r.Context(), sessionID(r), nil)
-
-	totalPaid := *order.GetOrder().GetShippingCost()
-	for _, v := range order.GetOrder().GetItems() {
-		multPrice := money.MultiplySlow(*v.GetCost(), uint32(v.GetItem().GetQuantity()))
-		totalPaid = money.Must(money.Sum(totalPaid, multPrice))
+	// Round the line values in place so that the rendered order agrees with
+	// the total computed from them.
+	shippingCost := fe.round(*order.GetShippingCost())
+	order.ShippingCost = &shippingCost
+	subtotal := pb.Money{CurrencyCode: shippingCost.GetCurrencyCode()}
+	items := 0
+	for _, v := range order.GetItems() {
+		items += int(v.GetItem().GetQuantity())
+		cost := fe.round(*v.GetCost())
+		v.Cost = &cost
+		multPrice := money.MultiplySlow(cost, uint32(v.GetItem().GetQuantity()))
+		subtotal = money.Must(money.Sum(subtotal, multPrice))
+	}
+	breakdown := fe.costBreakdown(subtotal, shippingCost, form.Country)
+	fallbackID := fe.ensureOrderID(order)
+	if fallbackID {
+		clog.WithField("order", order.GetOrderId()).Warn("checkout service returned no order ID, using a fallback")
 	}
+	clog.WithFields(logrus.Fields{
+		"order":             order.GetOrderId(),
+		"fallback_order_id": fallbackID,
+		"items":             items,
+		"total":             renderMoney(breakdown.Total),
+		"currency":          breakdown.Total.GetCurrencyCode(),
+		"dry_run":           fe.checkoutDryRun,
+		"took_ms":           int64(time.Since(start) / time.Millisecond)}).Info("order placed")
+	placed = true
+	if key != "" {
+		fe.reviews.forget(userID(r))
+		fe.orders.complete(userID(r), key, order, breakdown)
+	} else {
+		fe.orders.record(userID(r), order)
+	}
+	fe.renderOrder(w, r, order, breakdown)
+}
 
+// renderOrder renders the confirmation page of a placed order.
+func (fe *frontendServer) renderOrder(w http.ResponseWriter, r *http.Request, order *pb.OrderResult, breakdown costBreakdown) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	recommendations, _ := fe.getRecommendations(r.Context(), userID(r), nil)
 	currencies, err := fe.getCurrencies(r.Context())
 	if err != nil {
 		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
 		return
 	}
 
-	if err := templates.ExecuteTemplate(w, "order", map[string]interface{}{
+	if clientGone(log, r) {
+		return
+	}
+	renderPage(log, r, w, http.StatusOK, "order", map[string]interface{}{
 		"session_id":      sessionID(r),
 		"request_id":      r.Context().Value(ctxKeyRequestID{}),
 		"user_currency":   currentCurrency(r),
 		"show_currency":   false,
 		"currencies":      currencies,
-		"order":           order.GetOrder(),
-		"total_paid":      &totalPaid,
+		"order":           order,
+		"total_paid":      &breakdown.Total,
+		"breakdown":       breakdown,
+		"delivery":        fe.estimateDelivery(time.Now(), order.GetShippingAddress().GetCountry()),
+		"tax_inclusive":   fe.taxInclusive,
 		"recommendations": recommendations,
 		"platform_css":    plat.css,
 		"platform_name":   plat.provider,
-	}); err != nil {
-		log.Println(err)
+	})
+}
+
+// reviewOrderHandler checks the checkout form like placeOrderHandler, then
+// renders a read-only summary of the order whose final button places it.
+// The summary carries a new idempotency key, under which the form is kept on
+// the server, so that submitting it twice places a single order.
+func (fe *frontendServer) reviewOrderHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	log.Debug("reviewing order")
+
+	form := parseCheckoutForm(r)
+	cart, ok := fe.checkCheckout(w, r, &form, func(stage string, code codes.Code) {
+		log.WithFields(logrus.Fields{"stage": stage, "code": code.String()}).Info("checkout review rejected")
+	})
+	if !ok {
+		return
 	}
+	currencies, err := fe.getCurrencies(r.Context())
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve currencies"), http.StatusInternalServerError)
+		return
+	}
+	shippingCost, err := fe.getShippingQuote(r.Context(), cart, currentCurrency(r))
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to get shipping quote"), http.StatusInternalServerError)
+		return
+	}
+
+	type reviewItemView struct {
+		Item     *pb.Product
+		Quantity int32
+		Price    *pb.Money
+	}
+	items := make([]reviewItemView, len(cart))
+	subtotal := pb.Money{CurrencyCode: currentCurrency(r)}
+	for i, item := range cart {
+		p, err := fe.getProduct(r.Context(), item.GetProductId())
+		if err != nil {
+			renderHTTPError(log, r, w, errors.Wrapf(err, "could not retrieve product #%s", item.GetProductId()), http.StatusInternalServerError)
+			return
+		}
+		price, err := fe.convertCurrency(r.Context(), p.GetPriceUsd(), currentCurrency(r))
+		if err != nil {
+			renderHTTPError(log, r, w, errors.Wrapf(err, "could not convert currency for product #%s", item.GetProductId()), http.StatusInternalServerError)
+			return
+		}
+		multPrice := money.MultiplySlow(*price, uint32(item.GetQuantity()))
+		items[i] = reviewItemView{Item: p, Quantity: item.GetQuantity(), Price: &multPrice}
+		subtotal = money.Must(money.Sum(subtotal, multPrice))
+	}
+	breakdown := fe.costBreakdown(subtotal, *shippingCost, form.Country)
+	key, _ := uuid.NewRandom()
+	fe.reviews.put(userID(r), key.String(), form)
+
+	if clientGone(log, r) {
+		return
+	}
+	renderPage(log, r, w, http.StatusOK, "checkout_review", map[string]interface{}{
+		"session_id":      sessionID(r),
+		"request_id":      r.Context().Value(ctxKeyRequestID{}),
+		"user_currency":   currentCurrency(r),
+		"show_currency":   false,
+		"currencies":      currencies,
+		"cart_size":       cartSize(cart),
+		"items":           items,
+		"breakdown":       breakdown,
+		"tax_inclusive":   fe.taxInclusive,
+		"checkout":        form,
+		"delivery":        fe.estimateDelivery(time.Now(), form.Country),
+		"idempotency_key": key.String(),
+		"platform_css":    plat.css,
+		"platform_name":   plat.provider,
+	})
 }
 
 func (fe *frontendServer) logoutHandler(w http.ResponseWriter, r *http.Request) {
@@ -365,6 +877,7 @@ func (fe *frontendServer) logoutHandler(w http.ResponseWriter, r *http.Request)
 	for _, c := range r.Cookies() {
 		c.Expires = time.Now().Add(-time.Hour * 24 * 365)
 		c.MaxAge = -1
+		c.Domain = fe.cookieDomainFor(r)
 		http.SetCookie(w, c)
 	}
 	w.Header().Set("Location", "/")
@@ -381,36 +894,72 @@ func (fe *frontendServer) setCurrencyHandler(w http.ResponseWriter, r *http.Requ
 		http.SetCookie(w, &http.Cookie{
 			Name:   cookieCurrency,
 			Value:  cur,
+			Domain: fe.cookieDomainFor(r),
 			MaxAge: cookieMaxAge,
 		})
 	}
-	referer := r.Header.Get("referer")
-	if referer == "" {
-		referer = "/"
+	target, ok := internalPath(r.Header.Get("referer"), fe.externalHost(r))
+	if !ok {
+		target = "/"
 	}
-	w.Header().Set("Location", referer)
+	w.Header().Set("Location", fe.absoluteURL(r, target))
 	w.WriteHeader(http.StatusFound)
 }
 
-// chooseAd queries for advertisements available and randomly chooses one, if
-// available. It ignores the error retrieving the ad since it is not critical.
-func (fe *frontendServer) chooseAd(ctx context.Context, ctxKeys []string, log logrus.FieldLogger) *pb.Ad {
+// chooseAds queries for advertisements available and randomly chooses up to
+// the configured number of them. It ignores the error retrieving the ads
+// since they are not critical.
+func (fe *frontendServer) chooseAds(ctx context.Context, ctxKeys []string, log logrus.FieldLogger) []*pb.Ad {
+	if !featureEnabled(ctx, flagAds) {
+		return nil
+	}
 	ads, err := fe.getAd(ctx, ctxKeys)
 	if err != nil {
 		log.WithField("error", err).Warn("failed to retrieve ads")
+		markDegraded(ctx, flagAds)
 		return nil
 	}
-	return ads[rand.Intn(len(ads))]
+	ads = append([]*pb.Ad(nil), ads...)
+	rand.Shuffle(len(ads), func(i, j int) { ads[i], ads[j] = ads[j], ads[i] })
+	if n := fe.adLimit(); len(ads) > n {
+		ads = ads[:n]
+	}
+	return ads
+}
+
+// adContextKeys returns the distinct categories of ps, in order of first
+// appearance, to be used as ad context keywords.
+func adContextKeys(ps []*pb.Product) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, p := range ps {
+		for _, c := range p.GetCategories() {
+			if !seen[c] {
+				seen[c] = true
+				keys = append(keys, c)
+			}
+		}
+	}
+	return keys
 }
 
 func renderHTTPError(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, err error, code int) {
+	if clientGone(log, r) {
+		return
+	}
 	log.WithField("error", err).Error("request error")
 	errMsg := fmt.Sprintf("%+v", err)
 
+	var traceID string
+	if span := trace.FromContext(r.Context()); span != nil {
+		traceID = span.SpanContext().TraceID.String()
+	}
+
 	w.WriteHeader(code)
-	if templateErr := templates.ExecuteTemplate(w, "error", map[string]interface{}{
+	if templateErr := renderTemplate(w, errorTemplate(code), map[string]interface{}{
 		"session_id":  sessionID(r),
 		"request_id":  r.Context().Value(ctxKeyRequestID{}),
+		"trace_id":    traceID,
 		"error":       errMsg,
 		"status_code": code,
 		"status":      http.StatusText(code),
@@ -419,7 +968,175 @@ func renderHTTPError(log logrus.FieldLogger, r *http.Request, w http.ResponseWri
 	}
 }
 
+// errorTemplate returns the template of the error page for the status code:
+// "error_<code>" if one is defined, or the generic "error" otherwise.
+func errorTemplate(code int) string {
+	if name := "error_" + strconv.Itoa(code); templates.Lookup(name) != nil {
+		return name
+	}
+	return "error"
+}
+
+// clientGone reports whether the client canceled the request, e.g. by
+// navigating away, in which case there is no one to render a page for.
+func clientGone(log logrus.FieldLogger, r *http.Request) bool {
+	if r.Context().Err() != context.Canceled {
+		return false
+	}
+	clientCancellations.Inc()
+	log.Debug("client canceled the request, not rendering")
+	return true
+}
+
+// renderPage renders the named page template with the status code, or the
+// error page if the template fails, so that a failing template never leaves
+// the client with a half-written page. The status is only written once the
+// template succeeded.
+func renderPage(log logrus.FieldLogger, r *http.Request, w http.ResponseWriter, code int, name string, data interface{}) {
+	buf, err := executeTemplate(w, name, data)
+	if err == errRenderTimeout {
+		return
+	}
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrapf(err, "failed to render %s", name), http.StatusInternalServerError)
+		return
+	}
+	if code != http.StatusOK {
+		w.WriteHeader(code)
+	}
+	if err := buf.writeTo(w); err != nil && err != errRenderTimeout {
+		log.WithField("error", err).Warn("failed to write page")
+	}
+}
+
+// renderTemplate executes the named template, recording the time taken in
+// the template render histogram. Page data maps get the store branding.
+//
+// The output is buffered and only written to w if the template succeeds, so
+// nothing is written on error. The render timeout of w still applies while
+// executing the template.
+func renderTemplate(w http.ResponseWriter, name string, data interface{}) error {
+	buf, err := executeTemplate(w, name, data)
+	if err != nil {
+		return err
+	}
+	return buf.writeTo(w)
+}
+
+// executeTemplate executes the named template for w into a buffer, recording
+// the template metrics.
+func executeTemplate(w http.ResponseWriter, name string, data interface{}) (*renderBuffer, error) {
+	if m, ok := data.(map[string]interface{}); ok {
+		m["store_name"] = brand.storeName
+		m["show_branding"] = brand.show
+	}
+	buf := newRenderBuffer(w)
+	start := time.Now()
+	err := templates.ExecuteTemplate(buf, name, data)
+	templateRenderDuration.WithLabelValues(templateLabel(name)).Observe(time.Since(start).Seconds())
+	if err == errRenderTimeout {
+		return nil, err
+	}
+	if err != nil {
+		templateErrors.WithLabelValues(templateLabel(name)).Inc()
+		return nil, err
+	}
+	return buf, nil
+}
+
+// dryRunOrder synthesizes the result of placing an order for the given cart
+// without calling the checkout service, and empties the cart like a real
+// order would.
+func (fe *frontendServer) dryRunOrder(ctx context.Context, req *pb.PlaceOrderRequest, cart []*pb.CartItem) (*pb.OrderResult, error) {
+	items := make([]*pb.OrderItem, len(cart))
+	for i, item := range cart {
+		p, err := fe.getProduct(ctx, item.GetProductId())
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not retrieve product #%s", item.GetProductId())
+		}
+		price, err := fe.convertCurrency(ctx, p.GetPriceUsd(), req.GetUserCurrency())
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not convert currency for product #%s", item.GetProductId())
+		}
+		items[i] = &pb.OrderItem{Item: item, Cost: price}
+	}
+	shippingCost, err := fe.getShippingQuote(ctx, cart, req.GetUserCurrency())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get shipping quote")
+	}
+	if err := fe.emptyCart(ctx, req.GetUserId()); err != nil {
+		return nil, errors.Wrap(err, "failed to empty cart")
+	}
+	orderID, _ := uuid.NewRandom()
+	return &pb.OrderResult{
+		OrderId:            "dry-run-" + orderID.String(),
+		ShippingTrackingId: "DRY-RUN",
+		ShippingCost:       shippingCost,
+		ShippingAddress:    req.GetAddress(),
+		Items:              items,
+	}, nil
+}
+
+// unavailableItems returns the IDs of cart items whose product can no longer
+// be found in the catalog.
+func (fe *frontendServer) unavailableItems(ctx context.Context, cart []*pb.CartItem) ([]string, error) {
+	var out []string
+	for _, item := range cart {
+		_, err := fe.getProduct(ctx, item.GetProductId())
+		if isProductUnavailable(err) {
+			out = append(out, item.GetProductId())
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "could not retrieve product #%s", item.GetProductId())
+		}
+	}
+	return out, nil
+}
+
+// isProductUnavailable reports whether err indicates that the product no
+// longer exists in the catalog.
+func isProductUnavailable(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+// continueShoppingURL returns the page remembered when the user last added an
+// item to their cart, or the home page.
+func (fe *frontendServer) continueShoppingURL(r *http.Request) string {
+	if c, err := r.Cookie(cookieContinueShopping); err == nil {
+		if target, ok := internalPath(c.Value, fe.externalHost(r)); ok {
+			return target
+		}
+	}
+	return "/"
+}
+
+// internalPath returns the path and query of target if it is a same-origin
+// URL or an absolute path on this site, guarding against open redirects.
+func internalPath(target, host string) (string, bool) {
+	if target == "" || strings.ContainsAny(target, "\\\r\n") {
+		return "", false
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Opaque != "" || u.User != nil {
+		return "", false
+	}
+	if u.IsAbs() || u.Host != "" {
+		if (u.Scheme != "http" && u.Scheme != "https") || !strings.EqualFold(u.Host, host) {
+			return "", false
+		}
+	}
+	if !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") {
+		return "", false
+	}
+	return u.RequestURI(), true
+}
+
 func currentCurrency(r *http.Request) string {
+	if c, ok := r.Context().Value(ctxKeyCurrencyReset{}).(*currencyReset); ok && c.isDone() {
+		return defaultCurrency
+	}
+	if v, ok := r.Context().Value(ctxKeyCurrency{}).(string); ok {
+		return v
+	}
 	c, _ := r.Cookie(cookieCurrency)
 	if c != nil {
 		return c.Value
@@ -452,6 +1169,27 @@ func cartSize(c []*pb.CartItem) int {
 	return cartSize
 }
 
+// inCart returns the quantity of the product in the cart, or zero if it is
+// not in the cart or the badge is disabled.
+func (fe *frontendServer) inCart(c []*pb.CartItem, productID string) int {
+	if !fe.showInCart {
+		return 0
+	}
+	n := 0
+	for _, item := range c {
+		if item.GetProductId() == productID {
+			n += int(item.GetQuantity())
+		}
+	}
+	return n
+}
+
+// renderMoney renders an amount with its currency code before it, or after
+// it for the suffixed currencies.
 func renderMoney(money pb.Money) string {
-	return fmt.Sprintf("%s %d.%02d", money.GetCurrencyCode(), money.GetUnits(), money.GetNanos()/10000000)
+	amount := fmt.Sprintf("%d.%02d", money.GetUnits(), money.GetNanos()/10000000)
+	if suffixedCurrencies[money.GetCurrencyCode()] {
+		return amount + " " + money.GetCurrencyCode()
+	}
+	return money.GetCurrencyCode() + " " + amount
 }
@@ -0,0 +1,912 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+const testSessionID = "test-session"
+
+// newTestRequest returns a request carrying a session ID and a discarding
+// logger in its context, as set up by the middlewares.
+func newTestRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	if body != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	ctx := context.WithValue(r.Context(), ctxKeyLog{}, logrus.FieldLogger(log))
+	ctx = context.WithValue(ctx, ctxKeySessionID{}, testSessionID)
+	return r.WithContext(ctx)
+}
+
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestRenderTemplate_observesDuration(t *testing.T) {
+	before := histogramCount(t, templateRenderDuration.WithLabelValues("error"))
+
+	w := httptest.NewRecorder()
+	if err := renderTemplate(w, "error", map[string]interface{}{
+		"error":       "test",
+		"status_code": http.StatusInternalServerError,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := histogramCount(t, templateRenderDuration.WithLabelValues("error")); got != before+1 {
+		t.Errorf("render count for \"error\" = %d, want %d", got, before+1)
+	}
+}
+
+func TestRenderPage_templateError(t *testing.T) {
+	defer func(t *template.Template) { templates = t }(templates)
+	templates = template.Must(template.New("").Parse(`
+		{{ define "broken" }}<p>partial page</p>{{ .product.Name }}{{ end }}
+		{{ define "error" }}<p>error page: {{ .status_code }}</p>{{ end }}`))
+	before := testutil.ToFloat64(templateErrors.WithLabelValues("broken"))
+	var buf bytes.Buffer
+
+	r := newTestRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	// The status of the page is not written, as its template fails.
+	renderPage(newBufferLogger(&buf), r, w, http.StatusNotFound, "broken", map[string]interface{}{
+		"product": (*pb.Product)(nil),
+	})
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if body := w.Body.String(); strings.Contains(body, "partial page") || !strings.Contains(body, "error page: 500") {
+		t.Errorf("body = %q, want only the error page", body)
+	}
+	if got := testutil.ToFloat64(templateErrors.WithLabelValues("broken")); got != before+1 {
+		t.Errorf("frontend_template_errors_total = %v, want %v", got, before+1)
+	}
+	if e := lastEntry(t, &buf, "request error"); !strings.Contains(fmt.Sprint(e["error"]), "failed to render broken") {
+		t.Errorf("logged error %q, want the template failure", e["error"])
+	}
+}
+
+func TestRenderTemplate_escapesStoreName(t *testing.T) {
+	defer func(b branding) { brand = b }(brand)
+	brand = branding{storeName: `<script>alert("x")</script> & Co`, show: false}
+
+	w := httptest.NewRecorder()
+	if err := renderTemplate(w, "error", map[string]interface{}{
+		"error":       "test",
+		"status_code": http.StatusInternalServerError,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	body := w.Body.String()
+	if strings.Contains(body, "<script>alert") {
+		t.Error("store name rendered unescaped")
+	}
+	if want := "&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; &amp; Co"; !strings.Contains(body, want) {
+		t.Errorf("body does not contain the escaped store name %q", want)
+	}
+	if strings.Contains(body, "This is not a Google product") {
+		t.Error("upstream branding rendered with SHOW_BRANDING=false")
+	}
+}
+
+func TestTemplateLabel(t *testing.T) {
+	if got := templateLabel("home"); got != "home" {
+		t.Errorf("templateLabel(\"home\") = %q", got)
+	}
+	if got := templateLabel("no-such-template"); got != "unknown" {
+		t.Errorf("templateLabel(\"no-such-template\") = %q, want \"unknown\"", got)
+	}
+}
+
+func TestUnavailableItems(t *testing.T) {
+	fe := newTestFrontend(t, &frontendServer{}, newFakeBackends())
+	cart := []*pb.CartItem{
+		{ProductId: "OLJCESPC7Z", Quantity: 1},
+		{ProductId: "DISCONTINUED", Quantity: 2},
+	}
+	got, err := fe.unavailableItems(context.Background(), cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []string{"DISCONTINUED"}) {
+		t.Errorf("unavailableItems() = %v, want [DISCONTINUED]", got)
+	}
+}
+
+func TestViewCartHandler_flagsUnavailableItems(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "DISCONTINUED", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "No longer available") || strings.Contains(body, "Place order</button>") {
+		t.Errorf("cart page does not flag the unavailable item and block checkout:\n%s", body)
+	}
+}
+
+func TestPlaceOrderHandler_rejectsUnavailableItems(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "DISCONTINUED", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader("email=a@example.com")))
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if n := fb.callCount("PlaceOrder"); n != 0 {
+		t.Errorf("PlaceOrder called %d times, want 0", n)
+	}
+}
+
+func TestPlaceOrderHandler_dryRun(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	fe := newTestFrontend(t, &frontendServer{checkoutDryRun: true}, fb)
+
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader("email=a@example.com&country=US")))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d:\n%s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if n := fb.callCount("PlaceOrder"); n != 0 {
+		t.Errorf("PlaceOrder called %d times in dry-run mode, want 0", n)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "dry-run-") {
+		t.Errorf("confirmation page has no synthesized order ID:\n%s", body)
+	}
+	// 2 x 19.99 + 8.99 shipping
+	if !strings.Contains(body, "USD 48.97") {
+		t.Errorf("confirmation page does not show the computed total:\n%s", body)
+	}
+	if len(fb.carts[testSessionID]) != 0 {
+		t.Errorf("cart was not emptied: %v", fb.carts[testSessionID])
+	}
+}
+
+// withBufferLogger returns r with its logger replaced by one writing to buf.
+func withBufferLogger(r *http.Request, buf *bytes.Buffer) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxKeyLog{}, logrus.FieldLogger(newBufferLogger(buf))))
+}
+
+// lastEntry returns the last log entry with the message msg.
+func lastEntry(t *testing.T, buf *bytes.Buffer, msg string) map[string]interface{} {
+	t.Helper()
+	var found map[string]interface{}
+	for _, e := range logEntries(t, buf) {
+		if e["msg"] == msg {
+			found = e
+		}
+	}
+	if found == nil {
+		t.Fatalf("no %q log entry", msg)
+	}
+	return found
+}
+
+func TestPlaceOrderHandler_logsSuccess(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	fe := newTestFrontend(t, &frontendServer{checkoutDryRun: true}, fb)
+
+	var buf bytes.Buffer
+	form := "email=a@example.com&country=US&credit_card_number=4432-8015-6152-0454&credit_card_cvv=672"
+	r := newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(form))
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyRequestID{}, "test-request"))
+	fe.placeOrderHandler(httptest.NewRecorder(), withBufferLogger(r, &buf))
+
+	e := lastEntry(t, &buf, "order placed")
+	want := map[string]interface{}{
+		"session":     testSessionID,
+		"http.req.id": "test-request",
+		"items":       float64(2),
+		"total":       "USD 48.97",
+		"currency":    "USD",
+		"dry_run":     true,
+	}
+	for k, v := range want {
+		if e[k] != v {
+			t.Errorf("%s = %v, want %v", k, e[k], v)
+		}
+	}
+	if id, _ := e["order"].(string); !strings.HasPrefix(id, "dry-run-") {
+		t.Errorf("order = %v, want the dry-run order ID", e["order"])
+	}
+	if _, ok := e["took_ms"]; !ok {
+		t.Error("no took_ms field")
+	}
+	if log := buf.String(); strings.Contains(log, "4432") || strings.Contains(log, "672") {
+		t.Errorf("payment details logged:\n%s", log)
+	}
+}
+
+func TestPlaceOrderHandler_logsFailure(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fb.failing = map[string]error{"PlaceOrder": status.Error(codes.Unavailable, "checkout is down")}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	var buf bytes.Buffer
+	fe.placeOrderHandler(httptest.NewRecorder(), withBufferLogger(
+		newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader("email=a@example.com")), &buf))
+
+	e := lastEntry(t, &buf, "checkout failed")
+	if e["stage"] != "place_order" || e["code"] != "Unavailable" {
+		t.Errorf("stage, code = %v, %v, want place_order, Unavailable", e["stage"], e["code"])
+	}
+}
+
+func TestPlaceOrderHandler_supportedCountry(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{supportedCountries: []string{"US", "CA"}}, fb)
+	var got *pb.Address
+	fb.placeOrder = func(req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
+		got = req.GetAddress()
+		return &pb.PlaceOrderResponse{Order: &pb.OrderResult{OrderId: "1", ShippingCost: &pb.Money{CurrencyCode: "USD"}}}, nil
+	}
+
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader("email=a@example.com&country=ca")))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d:\n%s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if got.GetCountry() != "CA" {
+		t.Errorf("order country = %q, want \"CA\"", got.GetCountry())
+	}
+}
+
+func TestPlaceOrderHandler_tooManyLineItems(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{
+		{ProductId: "OLJCESPC7Z", Quantity: 1},
+		{ProductId: "66VCHSJNUP", Quantity: 1},
+		{ProductId: "1YMWWN1N4O", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{maxOrderLineItems: 2}, fb)
+
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(testCheckoutForm)))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "checkout-error") || !strings.Contains(body, "limited to 2 different products") {
+		t.Errorf("cart page does not show the line item limit inline:\n%s", body)
+	}
+	if n := fb.callCount("PlaceOrder"); n != 0 {
+		t.Errorf("PlaceOrder called %d times, want 0", n)
+	}
+}
+
+func TestPlaceOrderHandler_unsupportedCountry(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{supportedCountries: []string{"US", "CA"}}, fb)
+
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader("email=a@example.com&country=Atlantis")))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "checkout-error") || !strings.Contains(body, "Atlantis") {
+		t.Errorf("cart page does not show the country error inline:\n%s", body)
+	}
+	if !strings.Contains(body, `<option value="US">US</option>`) {
+		t.Errorf("cart page does not offer the supported countries:\n%s", body)
+	}
+	if n := fb.callCount("PlaceOrder"); n != 0 {
+		t.Errorf("PlaceOrder called %d times, want 0", n)
+	}
+}
+
+func TestInternalPath(t *testing.T) {
+	const host = "shop.example.com"
+	tests := []struct {
+		in     string
+		want   string
+		wantOK bool
+	}{
+		{"/product/OLJCESPC7Z", "/product/OLJCESPC7Z", true},
+		{"/?page=2", "/?page=2", true},
+		{"http://shop.example.com/product/1", "/product/1", true},
+		{"https://SHOP.example.com/", "/", true},
+		{"", "", false},
+		{"product/1", "", false},
+		{"//evil.example.com/", "", false},
+		{"/\\evil.example.com/", "", false},
+		{"https://evil.example.com/product/1", "", false},
+		{"https://shop.example.com@evil.example.com/", "", false},
+		{"javascript:alert(1)", "", false},
+		{"ftp://shop.example.com/", "", false},
+		{"/cart\r\nSet-Cookie: x=y", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := internalPath(tt.in, host)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("internalPath(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestAddToCartHandler_remembersReferer(t *testing.T) {
+	tests := []struct {
+		name       string
+		referer    string
+		wantCookie string
+	}{
+		{"same origin", "http://example.com/product/OLJCESPC7Z", "/product/OLJCESPC7Z"},
+		{"other origin", "http://evil.example.com/", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe := newTestFrontend(t, &frontendServer{}, newFakeBackends())
+			r := newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity=1"))
+			r.Header.Set("Referer", tt.referer)
+			w := httptest.NewRecorder()
+			fe.addToCartHandler(w, r)
+
+			var got string
+			for _, c := range w.Result().Cookies() {
+				if c.Name == cookieContinueShopping {
+					got = c.Value
+				}
+			}
+			if got != tt.wantCookie {
+				t.Errorf("continue shopping cookie = %q, want %q", got, tt.wantCookie)
+			}
+		})
+	}
+}
+
+func TestAdContextKeys_perPage(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(fe *frontendServer) http.HandlerFunc
+		req     *http.Request
+		want    []string
+	}{
+		{"home", func(fe *frontendServer) http.HandlerFunc { return fe.homeHandler },
+			newTestRequest(http.MethodGet, "/", nil), nil},
+		{"product", func(fe *frontendServer) http.HandlerFunc { return fe.productHandler },
+			mux.SetURLVars(newTestRequest(http.MethodGet, "/product/66VCHSJNUP", nil), map[string]string{"id": "66VCHSJNUP"}),
+			[]string{"clothing", "tops"}},
+		{"cart", func(fe *frontendServer) http.HandlerFunc { return fe.viewCartHandler },
+			newTestRequest(http.MethodGet, "/cart", nil), []string{"accessories", "clothing", "tops"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFakeBackends()
+			fb.carts[testSessionID] = []*pb.CartItem{
+				{ProductId: "OLJCESPC7Z", Quantity: 1},
+				{ProductId: "66VCHSJNUP", Quantity: 1},
+				{ProductId: "1YMWWN1N4O", Quantity: 1},
+			}
+			fe := newTestFrontend(t, &frontendServer{}, fb)
+
+			w := httptest.NewRecorder()
+			tt.handler(fe)(w, tt.req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if len(fb.adContextKeys) != 1 {
+				t.Fatalf("GetAds called %d times, want 1", len(fb.adContextKeys))
+			}
+			if got := fb.adContextKeys[0]; len(got) != 0 || len(tt.want) != 0 {
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("context keys = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestChooseAds_degradesOnError(t *testing.T) {
+	fb := newFakeBackends()
+	fb.ads = nil
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	if ads := fe.chooseAds(context.Background(), []string{"accessories"}, log); len(ads) != 0 {
+		t.Errorf("chooseAds() = %v, want none when no ads are returned", ads)
+	}
+	fe.adSvcConn.Close()
+	if ads := fe.chooseAds(context.Background(), []string{"accessories"}, log); len(ads) != 0 {
+		t.Errorf("chooseAds() = %v, want none when the ad service fails", ads)
+	}
+}
+
+func TestProductHandler_rendersConfiguredCounts(t *testing.T) {
+	fb := newFakeBackends()
+	fb.recommendations = []string{"OLJCESPC7Z", "66VCHSJNUP", "1YMWWN1N4O"}
+	fb.ads = []*pb.Ad{
+		{RedirectUrl: "/product/OLJCESPC7Z", Text: "Sunglasses for sale"},
+		{RedirectUrl: "/product/66VCHSJNUP", Text: "Tank tops for sale"},
+		{RedirectUrl: "/product/1YMWWN1N4O", Text: "Watch for sale"},
+	}
+	fe := newTestFrontend(t, &frontendServer{recommendationCount: 2, adCount: 2}, fb)
+
+	w := httptest.NewRecorder()
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/66VCHSJNUP", nil), map[string]string{"id": "66VCHSJNUP"})
+	fe.productHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	if n := strings.Count(body, `<div class="h-card card mb-3 box-shadow">`); n != 2 {
+		t.Errorf("rendered %d recommendations, want 2", n)
+	}
+	if n := strings.Count(body, "<strong>Advertisement:</strong>"); n != 2 {
+		t.Errorf("rendered %d ads, want 2", n)
+	}
+}
+
+func TestHomeHandler_conditionalGet(t *testing.T) {
+	fe := newTestFrontend(t, &frontendServer{}, newFakeBackends())
+
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("status = %d, ETag = %q, want 200 with a weak ETag", w.Code, etag)
+	}
+
+	w = httptest.NewRecorder()
+	r := newTestRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", etag)
+	fe.homeHandler(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("status = %d with %d bytes, want 304 with an empty body", w.Code, w.Body.Len())
+	}
+
+	w = httptest.NewRecorder()
+	r = newTestRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyCurrency{}, "EUR"))
+	r.Header.Set("If-None-Match", etag)
+	fe.homeHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d after a currency change, want 200", w.Code)
+	}
+}
+
+func TestHomeHandler_stopsWhenClientGone(t *testing.T) {
+	fb := newFakeBackends()
+	r := newTestRequest(http.MethodGet, "/", nil)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	fb.convert = func(req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+		cancel() // the client navigates away during the first conversion
+		return &pb.Money{CurrencyCode: req.GetToCode(), Units: req.GetFrom().GetUnits()}, nil
+	}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	before := testutil.ToFloat64(clientCancellations)
+
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, r.WithContext(ctx))
+
+	if n := fb.callCount("Convert"); n != 1 {
+		t.Errorf("Convert called %d times, want 1", n)
+	}
+	if n := fb.callCount("GetAds"); n != 0 {
+		t.Errorf("GetAds called %d times after cancellation, want 0", n)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("rendered a page for a canceled request:\n%s", w.Body.String())
+	}
+	if got := testutil.ToFloat64(clientCancellations); got != before+1 {
+		t.Errorf("frontend_client_cancellations_total = %v, want %v", got, before+1)
+	}
+}
+
+// flushRecorder records the size of the body at every flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes []int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushes = append(f.flushes, f.Body.Len())
+	f.ResponseRecorder.Flush()
+}
+
+func TestHomeHandler_streamsLargeCatalog(t *testing.T) {
+	fb := newFakeBackends()
+	fb.products = nil
+	for i := 0; i < 60; i++ {
+		fb.products = append(fb.products, &pb.Product{Id: fmt.Sprintf("P%03d", i), Name: "Product",
+			PriceUsd: &pb.Money{CurrencyCode: "USD", Units: int64(i + 1)}})
+	}
+	fe := newTestFrontend(t, &frontendServer{streamCatalogThreshold: 50, featuredProductIDs: []string{"P042"}}, fb)
+
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if len(w.flushes) != 3 {
+		t.Fatalf("flushed %d times, want 3 (60 products in chunks of %d)", len(w.flushes), streamChunkSize)
+	}
+	body := w.Body.String()
+	first := body[:w.flushes[0]]
+	if !strings.Contains(first, "/product/P023") || strings.Contains(first, "/product/P024") {
+		t.Errorf("first chunk does not end after the first %d products", streamChunkSize)
+	}
+	if !strings.Contains(first, "Featured") {
+		t.Error("first chunk does not include the featured products")
+	}
+	if !strings.Contains(body, "/product/P059") || !strings.Contains(body, "</html>") {
+		t.Error("streamed page is incomplete")
+	}
+	if n := fb.callCount("Convert"); n != 61 {
+		t.Errorf("Convert called %d times, want 61 (each product and the featured one)", n)
+	}
+}
+
+func TestHomeHandler_buffersSmallCatalog(t *testing.T) {
+	fe := newTestFrontend(t, &frontendServer{streamCatalogThreshold: 50}, newFakeBackends())
+
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+
+	if len(w.flushes) != 0 {
+		t.Errorf("flushed %d times for a small catalog, want 0", len(w.flushes))
+	}
+	if !strings.Contains(w.Body.String(), "/product/OLJCESPC7Z") {
+		t.Error("product list missing")
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`W/"abc"`, true},
+		{`"abc"`, true},
+		{`"xyz", W/"abc"`, true},
+		{`*`, true},
+		{`W/"xyz"`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, `W/"abc"`); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestHomeHandler_featuredProducts(t *testing.T) {
+	fe := newTestFrontend(t, &frontendServer{featuredProductIDs: []string{"1YMWWN1N4O", "GONE", "OLJCESPC7Z"}}, newFakeBackends())
+
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+
+	body := w.Body.String()
+	start, end := strings.Index(body, "Featured</h3>"), strings.Index(body, "Hot products")
+	if start < 0 || end < start {
+		t.Fatalf("home page has no featured section above the grid:\n%s", body)
+	}
+	featured := body[start:end]
+	watch, sunglasses := strings.Index(featured, "Watch"), strings.Index(featured, "Sunglasses")
+	if watch < 0 || sunglasses < 0 || watch > sunglasses {
+		t.Errorf("featured section does not list Watch then Sunglasses:\n%s", featured)
+	}
+	if n := strings.Count(featured, `class="h-card card`); n != 2 {
+		t.Errorf("featured section has %d products, want 2", n)
+	}
+}
+
+func TestHomeHandler_noFeaturedProducts(t *testing.T) {
+	fe := newTestFrontend(t, &frontendServer{}, newFakeBackends())
+
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+
+	if strings.Contains(w.Body.String(), "Featured</h3>") {
+		t.Error("home page renders a featured section without FEATURED_PRODUCT_IDS")
+	}
+	if strings.Contains(w.Body.String(), "New arrivals</h3>") {
+		t.Error("home page renders a new arrivals section without NEW_ARRIVAL_PRODUCT_IDS")
+	}
+}
+
+func TestHomeHandler_newArrivals(t *testing.T) {
+	fe := newTestFrontend(t, &frontendServer{newArrivalIDs: []string{"66VCHSJNUP", "GONE"}}, newFakeBackends())
+
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+
+	body := w.Body.String()
+	start, end := strings.Index(body, "New arrivals</h3>"), strings.Index(body, "Hot products")
+	if start < 0 || end < start {
+		t.Fatalf("home page has no new arrivals section above the grid:\n%s", body)
+	}
+	section := body[start:end]
+	if n := strings.Count(section, `class="h-card card`); n != 1 || !strings.Contains(section, "Tank Top") {
+		t.Errorf("new arrivals section has %d products, want only Tank Top:\n%s", n, section)
+	}
+	if strings.Contains(body, "Featured</h3>") {
+		t.Error("home page renders a featured section without FEATURED_PRODUCT_IDS")
+	}
+}
+
+func TestHomeHandler_buyAgain(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+	if strings.Contains(w.Body.String(), "Buy it again") {
+		t.Error("home page renders a buy again section before any order")
+	}
+
+	w = httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(testCheckoutForm)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("placing the order: status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	w = httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+	body := w.Body.String()
+	start, end := strings.Index(body, "Buy it again</h3>"), strings.Index(body, "Hot products")
+	if start < 0 || end < start {
+		t.Fatalf("home page has no buy again section above the grid:\n%s", body)
+	}
+	section := body[start:end]
+	for _, want := range []string{"Sunglasses", `name="product_id" value="OLJCESPC7Z"`, `name="quantity" value="2"`} {
+		if !strings.Contains(section, want) {
+			t.Errorf("buy again section does not contain %q:\n%s", want, section)
+		}
+	}
+}
+
+func TestSortProducts_stableTies(t *testing.T) {
+	usd := func(units int64) *pb.Money { return &pb.Money{CurrencyCode: "USD", Units: units} }
+	catalog := []*pb.Product{
+		{Id: "C", Name: "Mug", PriceUsd: usd(5)},
+		{Id: "A", Name: "mug", PriceUsd: usd(5)},
+		{Id: "D", Name: "Bag", PriceUsd: usd(9)},
+		{Id: "B", Name: "Cap", PriceUsd: usd(5)},
+	}
+	tests := map[string][]string{
+		"name":       {"D", "B", "A", "C"},
+		"price":      {"A", "B", "C", "D"},
+		"price_desc": {"D", "A", "B", "C"},
+		"":           {"C", "A", "D", "B"},
+	}
+	for order, want := range tests {
+		for i := 0; i < 10; i++ {
+			products := append([]*pb.Product(nil), catalog...)
+			if order != "" {
+				rand.Shuffle(len(products), func(i, j int) { products[i], products[j] = products[j], products[i] })
+			}
+			sortProducts(products, order)
+			if got := productIDs(products); !reflect.DeepEqual(got, want) {
+				t.Fatalf("sortProducts(%q) = %v, want %v", order, got, want)
+			}
+		}
+	}
+}
+
+func TestBuyAgain_skipsMissingProducts(t *testing.T) {
+	order := &pb.OrderResult{Items: []*pb.OrderItem{
+		{Item: &pb.CartItem{ProductId: "GONE", Quantity: 1}},
+		{Item: &pb.CartItem{ProductId: "1YMWWN1N4O", Quantity: 3}},
+	}}
+	got := buyAgain(order, newFakeBackends().products)
+	if len(got) != 1 || got[0].Item.GetId() != "1YMWWN1N4O" || got[0].Quantity != 3 {
+		t.Errorf("buyAgain() = %v, want 3 of 1YMWWN1N4O", got)
+	}
+	if got := buyAgain(nil, newFakeBackends().products); got != nil {
+		t.Errorf("buyAgain(nil) = %v, want nil", got)
+	}
+}
+
+func TestProductHandler_notFoundSuggestions(t *testing.T) {
+	fb := newFakeBackends()
+	fb.recommendations = []string{"OLJCESPC7Z", "66VCHSJNUP"}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	w := httptest.NewRecorder()
+	fe.productHandler(w, mux.SetURLVars(newTestRequest(http.MethodGet, "/product/GONE", nil), map[string]string{"id": "GONE"}))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `class="recommendations"`) || !strings.Contains(body, "/product/OLJCESPC7Z") {
+		t.Errorf("404 page has no suggestions:\n%s", body)
+	}
+}
+
+func TestProductHandler_notFoundWithoutSuggestions(t *testing.T) {
+	fb := newFakeBackends()
+	fb.failing = map[string]error{"ListRecommendations": status.Error(codes.Unavailable, "down")}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	w := httptest.NewRecorder()
+	fe.productHandler(w, mux.SetURLVars(newTestRequest(http.MethodGet, "/product/GONE", nil), map[string]string{"id": "GONE"}))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if strings.Contains(w.Body.String(), `class="recommendations"`) {
+		t.Error("plain 404 page renders suggestions")
+	}
+}
+
+func TestBlockedProducts(t *testing.T) {
+	fb := newFakeBackends()
+	fb.recommendations = []string{"OLJCESPC7Z", "66VCHSJNUP"}
+	fe := newTestFrontend(t, &frontendServer{blockedProductIDs: map[string]bool{"OLJCESPC7Z": true}}, fb)
+
+	w := httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+	if body := w.Body.String(); strings.Contains(body, "Sunglasses") || !strings.Contains(body, "Tank Top") {
+		t.Errorf("home page does not hide only the blocked product:\n%s", body)
+	}
+
+	recommendations, err := fe.getRecommendations(context.Background(), testSessionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recommendations) != 1 || recommendations[0].GetId() != "66VCHSJNUP" {
+		t.Errorf("getRecommendations() = %v, want only 66VCHSJNUP", recommendations)
+	}
+
+	w = httptest.NewRecorder()
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	fe.productHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("blocked product page status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if n := fb.callCount("GetProduct"); n != 0 {
+		t.Errorf("GetProduct called %d times for a blocked product, want 0", n)
+	}
+
+	w = httptest.NewRecorder()
+	fe.addToCartHandler(w, newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity=1")))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("adding a blocked product: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if n := fb.callCount("AddItem"); n != 0 {
+		t.Errorf("AddItem called %d times for a blocked product, want 0", n)
+	}
+}
+
+func TestRenderHTTPError_templatePerStatus(t *testing.T) {
+	tests := map[int]string{
+		http.StatusForbidden:           "Access denied",
+		http.StatusNotFound:            "Page not found",
+		http.StatusTooManyRequests:     "Slow down",
+		http.StatusInternalServerError: "Something went wrong",
+		http.StatusServiceUnavailable:  "Store temporarily unavailable",
+		http.StatusBadRequest:          "Uh, oh!",
+	}
+	for code, want := range tests {
+		r := newTestRequest(http.MethodGet, "/", nil)
+		ctx, span := trace.StartSpan(r.Context(), "test", trace.WithSampler(trace.AlwaysSample()))
+		ctx = context.WithValue(ctx, ctxKeyRequestID{}, "req-1234")
+		w := httptest.NewRecorder()
+		renderHTTPError(newBufferLogger(&bytes.Buffer{}), r.WithContext(ctx), w, errors.New("failed"), code)
+		span.End()
+
+		body := w.Body.String()
+		if w.Code != code || !strings.Contains(body, want) {
+			t.Errorf("status %d: got %d, want the page titled %q:\n%s", code, w.Code, want, body)
+		}
+		if !strings.Contains(body, "req-1234") || !strings.Contains(body, span.SpanContext().TraceID.String()) {
+			t.Errorf("status %d: page does not show the request and trace IDs", code)
+		}
+	}
+}
+
+func TestErrorTemplate(t *testing.T) {
+	if got := errorTemplate(http.StatusNotFound); got != "error_404" {
+		t.Errorf("errorTemplate(404) = %q, want error_404", got)
+	}
+	if got := errorTemplate(http.StatusConflict); got != "error" {
+		t.Errorf("errorTemplate(409) = %q, want the generic error", got)
+	}
+}
+
+func TestProductHandler_inCartBadge(t *testing.T) {
+	tests := []struct {
+		name string
+		cart []*pb.CartItem
+		show bool
+		want string
+	}{
+		{"in cart", []*pb.CartItem{{ProductId: "66VCHSJNUP", Quantity: 1}, {ProductId: "OLJCESPC7Z", Quantity: 3}}, true, "In your cart: 3"},
+		{"not in cart", []*pb.CartItem{{ProductId: "66VCHSJNUP", Quantity: 1}}, true, ""},
+		{"empty cart", nil, true, ""},
+		{"disabled", []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 3}}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFakeBackends()
+			fb.carts[testSessionID] = tt.cart
+			fe := newTestFrontend(t, &frontendServer{showInCart: tt.show}, fb)
+
+			w := httptest.NewRecorder()
+			r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+			fe.productHandler(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			body := w.Body.String()
+			if tt.want == "" {
+				if strings.Contains(body, "in-cart") {
+					t.Errorf("product page has an in-cart badge:\n%s", body)
+				}
+			} else if !strings.Contains(body, tt.want) {
+				t.Errorf("product page does not contain %q:\n%s", tt.want, body)
+			}
+		})
+	}
+}
@@ -17,13 +17,20 @@ package main
 import (
 	"context"
 	"fmt"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/profiler"
 	"contrib.go.opencensus.io/exporter/jaeger"
 	"contrib.go.opencensus.io/exporter/stackdriver"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -35,6 +42,11 @@ import (
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 )
 
 const (
@@ -42,9 +54,19 @@ const (
 	defaultCurrency = "USD"
 	cookieMaxAge    = 60 * 60 * 48
 
-	cookiePrefix    = "shop_"
-	cookieSessionID = cookiePrefix + "session-id"
-	cookieCurrency  = cookiePrefix + "currency"
+	cookiePrefix           = "shop_"
+	cookieSessionID        = cookiePrefix + "session-id"
+	cookieCurrency         = cookiePrefix + "currency"
+	cookieContinueShopping = cookiePrefix + "continue-shopping"
+	cookieCartItems        = cookiePrefix + "cart-items"
+	cookieFlash            = cookiePrefix + "flash"
+
+	defaultRecommendationCount = 4
+	defaultAdCount             = 1
+
+	// streamChunkSize is the number of product cards written between flushes
+	// when the home page is streamed.
+	streamChunkSize = 24
 )
 
 var (
@@ -69,8 +91,11 @@ type frontendServer struct {
 	cartSvcAddr string
 	cartSvcConn *grpc.ClientConn
 
-	recommendationSvcAddr string
-	recommendationSvcConn *grpc.ClientConn
+	// recommendationSvcAddr and adSvcAddr may list comma-separated
+	// addresses; calls fail over from the first to the fallbacks in order.
+	recommendationSvcAddr      string
+	recommendationSvcConn      *grpc.ClientConn
+	recommendationSvcFallbacks []*grpc.ClientConn
 
 	checkoutSvcAddr string
 	checkoutSvcConn *grpc.ClientConn
@@ -78,8 +103,209 @@ type frontendServer struct {
 	shippingSvcAddr string
 	shippingSvcConn *grpc.ClientConn
 
-	adSvcAddr string
-	adSvcConn *grpc.ClientConn
+	adSvcAddr      string
+	adSvcConn      *grpc.ClientConn
+	adSvcFallbacks []*grpc.ClientConn
+
+	// roundingMode and roundingGranularity (in nanos) are applied to every
+	// converted price.
+	roundingMode        money.RoundingMode
+	roundingGranularity int64
+
+	// dependencies are checked by /readyz and the degraded-page middleware.
+	dependencies []dependency
+	// readyAfter ends the grace period at startup during which /readyz
+	// reports the frontend as not ready yet, whatever its dependencies.
+	readyAfter time.Time
+
+	// grpcMaxRecvMsgBytes overrides gRPC's default 4MB receive limit for
+	// downstream calls when set.
+	grpcMaxRecvMsgBytes int
+
+	// recommendationCount and adCount cap the items shown per page; zero
+	// means the default.
+	recommendationCount int
+	adCount             int
+
+	// maxRenderedRecommendations caps the recommended products rendered,
+	// counting only those found in the catalog. Zero disables the cap.
+	maxRenderedRecommendations int
+
+	// fallbackRecommendationIDs are shown instead when the recommendation
+	// service fails or recommends nothing.
+	fallbackRecommendationIDs []string
+
+	// checkoutDryRun synthesizes orders instead of calling the checkout
+	// service, for demos and load tests.
+	checkoutDryRun bool
+
+	// checkoutReview adds a step reviewing the order before it is placed.
+	checkoutReview bool
+
+	// cookieDomain, if set, is the Domain attribute of the cookies set by the
+	// frontend, allowing them to be shared across subdomains.
+	cookieDomain string
+
+	// canonicalHost, if set, is the only host pages are served under, other
+	// hosts being redirected to it, as are plain HTTP requests if
+	// canonicalHTTPS is set.
+	canonicalHost  string
+	canonicalHTTPS bool
+
+	// metaDescription describes pages without a description of their own to
+	// search engines.
+	metaDescription string
+
+	// hsts is the Strict-Transport-Security header sent over HTTPS, if set.
+	hsts string
+
+	// trustedProxies are the peers whose X-Forwarded-Proto and
+	// X-Forwarded-Host headers are honored when building external URLs.
+	trustedProxies []*net.IPNet
+
+	// flatTaxRate and taxRates (by lowercase country name) estimate the tax
+	// shown in cost breakdowns.
+	flatTaxRate *big.Rat
+	taxRates    map[string]*big.Rat
+	// taxInclusive displays the prices charged as including the estimated
+	// tax, breaking it out of them rather than adding it.
+	taxInclusive bool
+
+	// sessionIDs generates the IDs of new sessions, as UUIDs if nil.
+	sessionIDs sessionIDGenerator
+
+	// fallbackOrderIDs generates, after fallbackOrderIDPrefix, the IDs of
+	// orders the checkout service placed without one, as UUIDs if nil.
+	fallbackOrderIDs      sessionIDGenerator
+	fallbackOrderIDPrefix string
+
+	// maxRetries is the number of times a call failing with Unavailable is
+	// retried, within the retries budget. Zero disables retries.
+	maxRetries int
+	retries    *retryBudget
+
+	// downstreamTimeout bounds downstream calls, and serviceTimeouts the
+	// calls to particular services, by service label. Zero means no timeout.
+	downstreamTimeout time.Duration
+	serviceTimeouts   map[string]time.Duration
+
+	// serviceSemaphores cap the concurrent calls to services, by service
+	// label, with calls waiting up to concurrencyWait for a slot.
+	serviceSemaphores map[string]chan struct{}
+	concurrencyWait   time.Duration
+
+	// logDownstreamCalls logs every downstream call attempt at debug level.
+	logDownstreamCalls bool
+
+	// defaultAddQuantity is added to the cart when the form has no quantity,
+	// and preselected on product pages. minQuantities are the smallest
+	// quantities of products that can be added, by product ID.
+	defaultAddQuantity int
+	minQuantities      map[string]int
+
+	// productVariants are the USD prices of the variants of products beyond
+	// the catalog price, by product ID, rendered as price ranges.
+	productVariants map[string][]*pb.Money
+
+	// stock is the number of units in stock by product ID, for the products
+	// it is known for.
+	stock map[string]int
+	// lowStockThreshold is the stock below which products are badged as
+	// running out. Zero disables the badge.
+	lowStockThreshold int
+
+	// currencies holds the supported currencies ([]string) while they are
+	// refreshed in the background. Until then, every request fetches them.
+	currencies atomic.Value
+
+	// users resolves the user a request is made by. Requests are
+	// identified by their session when it is nil or resolves none.
+	users UserResolver
+
+	// flashKey signs the flash messages, with a key random to the process
+	// if empty.
+	flashKey []byte
+
+	// maxCartTotal caps the total of carts, in US dollars. Items cannot be
+	// added beyond it. Nil means no cap.
+	maxCartTotal *pb.Money
+
+	// maxOrderLineItems caps the number of distinct products per order.
+	// Zero disables the cap.
+	maxOrderLineItems int
+
+	// readOnly disables cart changes and checkout, leaving the store to be
+	// browsed only.
+	readOnly bool
+
+	// showInCart badges product pages with the quantity already in the
+	// session's cart.
+	showInCart bool
+
+	// cartExpiryNotice tells users on the cart page when a cart that had
+	// items comes back empty.
+	cartExpiryNotice bool
+
+	// supportedCountries are the ISO country codes offered at checkout. Any
+	// country may be entered when empty.
+	supportedCountries []string
+
+	// deliveryWindow is the number of business days orders take to arrive,
+	// and deliveryWindows overrides it by lower-cased country.
+	deliveryWindow  deliveryWindow
+	deliveryWindows map[string]deliveryWindow
+
+	// timeZone is the store's time zone, in which delivery dates are
+	// estimated. The server's local time zone is used when nil.
+	timeZone *time.Location
+
+	// imagePlaceholderPath replaces the pictures missing from the catalog.
+	imagePlaceholderPath string
+
+	// streamCatalogThreshold is the catalog size above which the home page
+	// is streamed in chunks rather than rendered at once. Zero disables
+	// streaming.
+	streamCatalogThreshold int
+
+	// maxPageSize caps the page size clients may request from paginated
+	// views, defaultMaxPageSize if zero.
+	maxPageSize int
+
+	// featuredProductIDs are highlighted above the home page grid, in order.
+	featuredProductIDs []string
+
+	// newArrivalIDs are listed in the home page's "New arrivals" section, in
+	// order. Catalog products carry no creation time to derive it from.
+	newArrivalIDs []string
+
+	// blockedProductIDs are hidden from every page and cannot be added to
+	// carts, as if the catalog did not list them.
+	blockedProductIDs map[string]bool
+
+	// prices snapshots item prices at add-to-cart time to detect changes
+	// by checkout.
+	prices priceSnapshots
+
+	// reviews keeps the checkout forms of review pages until submitted.
+	reviews reviewedCheckouts
+	// orders remembers the orders placed from review pages, so that
+	// resubmissions do not place them twice.
+	orders placedOrders
+
+	// restockSignups records who to notify when out of stock products are
+	// back, unless RESTOCK_SIGNUPS is disabled.
+	restockSignups RestockSignups
+
+	// priceCache caches converted product prices across requests, if
+	// PRICE_CACHE_TTL is set.
+	priceCache *priceCache
+
+	// robotsTxt is served as /robots.txt.
+	robotsTxt string
+
+	// allowFlagOverride honors the X-Feature-Flags request header. It is
+	// meant for testing and must stay off in production.
+	allowFlagOverride bool
 }
 
 func main() {
@@ -96,9 +322,25 @@ func main() {
 	}
 	log.Out = os.Stdout
 
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := loadConfigFile(path); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("loaded config file %s", path)
+	}
+	log.AddHook(constantFields{"environment": deploymentEnvironment()})
+	redacted := defaultRedactedFields
+	if v, ok := os.LookupEnv("LOG_REDACT_FIELDS"); ok {
+		redacted = splitList(v)
+	}
+	log.AddHook(newRedactFields(redacted))
+
 	if os.Getenv("DISABLE_TRACING") == "" {
+		if err := checkTraceExporter(os.Getenv("TRACE_EXPORTER")); err != nil {
+			log.Fatalf("TRACE_EXPORTER: %v", err)
+		}
 		log.Info("Tracing enabled.")
-		go initTracing(log)
+		go initTracing(log, os.Getenv("TRACE_EXPORTER"))
 	} else {
 		log.Info("Tracing disabled.")
 	}
@@ -123,92 +365,342 @@ func main() {
 	mustMapEnv(&svc.checkoutSvcAddr, "CHECKOUT_SERVICE_ADDR")
 	mustMapEnv(&svc.shippingSvcAddr, "SHIPPING_SERVICE_ADDR")
 	mustMapEnv(&svc.adSvcAddr, "AD_SERVICE_ADDR")
+	mustMapRounding(svc, os.Getenv("CURRENCY_ROUNDING"), os.Getenv("CURRENCY_ROUNDING_GRANULARITY"))
+	mustMapEnvInt(&svc.grpcMaxRecvMsgBytes, "GRPC_MAX_RECV_MSG_BYTES")
+	mustMapEnvBool(&svc.checkoutDryRun, "CHECKOUT_DRY_RUN")
+	mustMapEnvBool(&svc.checkoutReview, "CHECKOUT_REVIEW")
+	mustMapEnvBool(&svc.readOnly, "READ_ONLY_MODE")
+	restockSignups := true
+	mustMapEnvBool(&restockSignups, "RESTOCK_SIGNUPS")
+	if restockSignups {
+		svc.restockSignups = &memoryRestockSignups{}
+	}
+	svc.users = sessionUserResolver{}
+	if secret := os.Getenv("USER_JWT_SECRET"); secret != "" {
+		header := "Authorization"
+		if v := os.Getenv("USER_JWT_HEADER"); v != "" {
+			header = v
+		}
+		svc.users = newJWTUserResolver(header, []byte(secret))
+	}
+	svc.flashKey = []byte(os.Getenv("FLASH_SECRET"))
+	mustMapEnvBool(&svc.allowFlagOverride, "ALLOW_FLAG_OVERRIDE")
+	mustMapEnvIntInRange(&svc.maxRetries, "GRPC_MAX_RETRIES", 0, 5)
+	mustMapEnvBool(&svc.logDownstreamCalls, "LOG_DOWNSTREAM_CALLS")
+	mustMapServiceTimeouts(svc)
+	mustMapServiceConcurrency(svc)
+	var debugDegradedHeader bool
+	mustMapEnvBool(&debugDegradedHeader, "DEBUG_DEGRADED_HEADER")
+	retryBudgetTokens := defaultRetryBudget
+	mustMapEnvInt(&retryBudgetTokens, "RETRY_BUDGET")
+	svc.retries = newRetryBudget(retryBudgetTokens)
+	svc.featuredProductIDs = splitList(os.Getenv("FEATURED_PRODUCT_IDS"))
+	svc.newArrivalIDs = splitList(os.Getenv("NEW_ARRIVAL_PRODUCT_IDS"))
+	svc.fallbackRecommendationIDs = splitList(os.Getenv("FALLBACK_RECOMMENDATION_IDS"))
+	for _, id := range splitList(os.Getenv("BLOCKED_PRODUCT_IDS")) {
+		if svc.blockedProductIDs == nil {
+			svc.blockedProductIDs = make(map[string]bool)
+		}
+		svc.blockedProductIDs[id] = true
+	}
+	svc.imagePlaceholderPath = os.Getenv("PRODUCT_IMAGE_PLACEHOLDER")
+	mustMapEnvInt(&svc.streamCatalogThreshold, "STREAM_CATALOG_THRESHOLD")
+	mustMapEnvInt(&svc.maxPageSize, "MAX_PAGE_SIZE")
+	mustMapEnvInt(&svc.defaultAddQuantity, "DEFAULT_ADD_QUANTITY")
+	mustMapEnvInt(&svc.lowStockThreshold, "LOW_STOCK_THRESHOLD")
+	mustMapEnvInt(&svc.maxOrderLineItems, "MAX_ORDER_LINE_ITEMS")
+	svc.showInCart = true
+	mustMapEnvBool(&svc.showInCart, "SHOW_IN_CART_BADGE")
+	svc.cartExpiryNotice = true
+	mustMapEnvBool(&svc.cartExpiryNotice, "CART_EXPIRY_NOTICE")
+	var priceCacheTTL time.Duration
+	mustMapEnvDuration(&priceCacheTTL, "PRICE_CACHE_TTL")
+	if priceCacheTTL > 0 {
+		svc.priceCache = newPriceCache(priceCacheTTL)
+	}
+	mustMapEnvIntInRange(&svc.recommendationCount, "RECOMMENDATION_COUNT", 1, 20)
+	mustMapEnvInt(&svc.maxRenderedRecommendations, "MAX_RENDERED_RECOMMENDATIONS")
+	mustMapEnvIntInRange(&svc.adCount, "AD_COUNT", 1, 5)
+	if v := os.Getenv("STORE_NAME"); v != "" {
+		brand.storeName = v
+	}
+	mustMapEnvBool(&brand.show, "SHOW_BRANDING")
+	mustMapEnvInt(&cardLimits.name, "CARD_NAME_MAX_LENGTH")
+	mustMapEnvInt(&cardLimits.description, "CARD_DESCRIPTION_MAX_LENGTH")
+	svc.canonicalHost = strings.ToLower(os.Getenv("CANONICAL_HOST"))
+	mustMapEnvBool(&svc.canonicalHTTPS, "CANONICAL_HTTPS")
+	svc.metaDescription = os.Getenv("META_DESCRIPTION")
+	var hstsMaxAge time.Duration
+	var hstsIncludeSubDomains, hstsPreload bool
+	mustMapEnvDuration(&hstsMaxAge, "HSTS_MAX_AGE")
+	mustMapEnvBool(&hstsIncludeSubDomains, "HSTS_INCLUDE_SUBDOMAINS")
+	mustMapEnvBool(&hstsPreload, "HSTS_PRELOAD")
+	svc.hsts = hstsHeader(hstsMaxAge, hstsIncludeSubDomains, hstsPreload)
+	svc.cookieDomain = strings.TrimPrefix(strings.ToLower(os.Getenv("COOKIE_DOMAIN")), ".")
+	trustedProxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("TRUSTED_PROXIES: %v", err)
+	}
+	svc.trustedProxies = trustedProxies
+	if v := os.Getenv("TAX_RATE"); v != "" {
+		if svc.flatTaxRate, err = parseTaxRate(v); err != nil {
+			log.Fatalf("TAX_RATE: %v", err)
+		}
+	}
+	if svc.taxRates, err = parseTaxRates(os.Getenv("TAX_RATES")); err != nil {
+		log.Fatalf("TAX_RATES: %v", err)
+	}
+	if svc.taxInclusive, err = parsePriceDisplay(os.Getenv("PRICE_DISPLAY")); err != nil {
+		log.Fatalf("PRICE_DISPLAY: %v", err)
+	}
+	if svc.sessionIDs, err = parseSessionIDScheme(os.Getenv("SESSION_ID_SCHEME")); err != nil {
+		log.Fatalf("SESSION_ID_SCHEME: %v", err)
+	}
+	if svc.fallbackOrderIDs, err = parseSessionIDScheme(os.Getenv("FALLBACK_ORDER_ID_SCHEME")); err != nil {
+		log.Fatalf("FALLBACK_ORDER_ID_SCHEME: %v", err)
+	}
+	svc.fallbackOrderIDPrefix = "fallback-"
+	if v := os.Getenv("FALLBACK_ORDER_ID_PREFIX"); v != "" {
+		svc.fallbackOrderIDPrefix = v
+	}
+	if svc.minQuantities, err = parseMinQuantities(os.Getenv("MIN_ADD_QUANTITIES")); err != nil {
+		log.Fatalf("MIN_ADD_QUANTITIES: %v", err)
+	}
+	if svc.productVariants, err = parseVariantPrices(os.Getenv("PRODUCT_VARIANT_PRICES")); err != nil {
+		log.Fatalf("PRODUCT_VARIANT_PRICES: %v", err)
+	}
+	if svc.stock, err = parseProductStock(os.Getenv("PRODUCT_STOCK")); err != nil {
+		log.Fatalf("PRODUCT_STOCK: %v", err)
+	}
+	if svc.supportedCountries, err = parseCountries(os.Getenv("SUPPORTED_COUNTRIES")); err != nil {
+		log.Fatalf("SUPPORTED_COUNTRIES: %v", err)
+	}
+	if svc.robotsTxt, err = loadRobotsTxt(os.Getenv("ROBOTS_TXT"), os.Getenv("ROBOTS_TXT_FILE")); err != nil {
+		log.Fatalf("ROBOTS_TXT: %v", err)
+	}
+	if svc.maxCartTotal, err = parseUSDAmount(os.Getenv("MAX_CART_TOTAL")); err != nil {
+		log.Fatalf("MAX_CART_TOTAL: %v", err)
+	}
+	if v := os.Getenv("DELIVERY_DAYS"); v != "" {
+		if svc.deliveryWindow, err = parseDeliveryWindow(v); err != nil {
+			log.Fatalf("DELIVERY_DAYS: %v", err)
+		}
+	}
+	if svc.deliveryWindows, err = parseDeliveryWindows(os.Getenv("DELIVERY_DAYS_BY_COUNTRY")); err != nil {
+		log.Fatalf("DELIVERY_DAYS_BY_COUNTRY: %v", err)
+	}
+	if v := os.Getenv("TIME_ZONE"); v != "" {
+		if svc.timeZone, err = time.LoadLocation(v); err != nil {
+			log.Fatalf("TIME_ZONE: %v", err)
+		}
+	}
+	if suffixedCurrencies, err = parseCurrencyPositions(os.Getenv("CURRENCY_POSITIONS")); err != nil {
+		log.Fatalf("CURRENCY_POSITIONS: %v", err)
+	}
+	staticRoots, err := parseStaticDirs(os.Getenv("STATIC_DIRS"))
+	if err != nil {
+		log.Fatalf("STATIC_DIRS: %v", err)
+	}
+	if imageCDNBase, err = parseImageCDNBase(os.Getenv("IMAGE_CDN_BASE")); err != nil {
+		log.Fatalf("IMAGE_CDN_BASE: %v", err)
+	}
 
-	mustConnGRPC(ctx, &svc.currencySvcConn, svc.currencySvcAddr)
-	mustConnGRPC(ctx, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
-	mustConnGRPC(ctx, &svc.cartSvcConn, svc.cartSvcAddr)
-	mustConnGRPC(ctx, &svc.recommendationSvcConn, svc.recommendationSvcAddr)
-	mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
-	mustConnGRPC(ctx, &svc.checkoutSvcConn, svc.checkoutSvcAddr)
-	mustConnGRPC(ctx, &svc.adSvcConn, svc.adSvcAddr)
-
-	// taken from https://pkg.go.dev/github.com/prometheus/client_golang/prometheus/promhttp#example-InstrumentHandlerDuration
-
-	inFlightGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "frontend_in_flight_requests",
-		Help: "A gauge of requests currently being served by the frontend.",
-	})
-
-	counter := prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "frontend_api_requests_total",
-			Help: "A counter for requests to the frontend.",
-		},
-		[]string{"code", "method"},
-	)
-
-	// duration is partitioned by the HTTP method and handler. It uses custom
-	// buckets based on the expected request duration.
-	duration := prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "frontend_request_duration_seconds",
-			Help:    "A histogram of latencies for requests in the frontend.",
-			Buckets: []float64{.25, .5, 1, 2.5, 5, 10},
-		},
-		[]string{"handler", "method"},
-	)
-
-	// responseSize has no labels, making it a zero-dimensional
-	// ObserverVec.
-	responseSize := prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "frontend_response_size_bytes",
-			Help:    "A histogram of response sizes for requests.",
-			Buckets: []float64{200, 500, 900, 1500},
-		},
-		[]string{},
-	)
-
-	prometheus.MustRegister(inFlightGauge, counter, duration, responseSize)
-
-	// Instrument the handlers with all the metrics, injecting the "handler"
-	// label by currying.
-	chain := func(name string, f func(http.ResponseWriter, *http.Request)) http.Handler {
-		return promhttp.InstrumentHandlerInFlight(
-			inFlightGauge,
-			promhttp.InstrumentHandlerDuration(duration.MustCurryWith(prometheus.Labels{"handler": name}),
-				promhttp.InstrumentHandlerCounter(counter,
-					promhttp.InstrumentHandlerResponseSize(responseSize,
-						http.HandlerFunc(f),
-					),
-				),
-			),
-		)
+	srvRefreshInterval := defaultSRVRefreshInterval
+	mustMapEnvDuration(&srvRefreshInterval, "SRV_REFRESH_INTERVAL")
+	resolver.Register(&srvResolverBuilder{lookup: net.DefaultResolver, interval: srvRefreshInterval})
+	svc.mustConnGRPC(ctx, &svc.currencySvcConn, svc.currencySvcAddr)
+	svc.mustConnGRPC(ctx, &svc.productCatalogSvcConn, svc.productCatalogSvcAddr)
+	svc.mustConnGRPC(ctx, &svc.cartSvcConn, svc.cartSvcAddr)
+	svc.mustConnGRPCWithFallbacks(ctx, &svc.recommendationSvcConn, &svc.recommendationSvcFallbacks, svc.recommendationSvcAddr)
+	svc.mustConnGRPC(ctx, &svc.shippingSvcConn, svc.shippingSvcAddr)
+	svc.mustConnGRPC(ctx, &svc.checkoutSvcConn, svc.checkoutSvcAddr)
+	svc.mustConnGRPCWithFallbacks(ctx, &svc.adSvcConn, &svc.adSvcFallbacks, svc.adSvcAddr)
+	svc.dependencies = []dependency{
+		{name: "productcatalogservice", conn: svc.productCatalogSvcConn, critical: true},
+		{name: "currencyservice", conn: svc.currencySvcConn, critical: true},
+		{name: "cartservice", conn: svc.cartSvcConn, critical: true},
+		{name: "recommendationservice", conn: svc.recommendationSvcConn},
+		{name: "shippingservice", conn: svc.shippingSvcConn},
+		{name: "checkoutservice", conn: svc.checkoutSvcConn},
+		{name: "adservice", conn: svc.adSvcConn},
+	}
+	connCheckInterval := 30 * time.Second
+	mustMapEnvDuration(&connCheckInterval, "CONN_CHECK_INTERVAL")
+	if connCheckInterval > 0 {
+		go svc.watchConnections(ctx, log, connCheckInterval)
 	}
+	var currencyRefreshInterval time.Duration
+	mustMapEnvDuration(&currencyRefreshInterval, "CURRENCY_REFRESH_INTERVAL")
+	if currencyRefreshInterval > 0 {
+		svc.refreshCurrencies(ctx, log)
+		go svc.watchCurrencies(ctx, log, currencyRefreshInterval)
+	}
+
+	metrics := newHTTPMetrics()
+	metrics.mustRegister()
+	prometheus.MustRegister(templateRenderDuration, templateErrors, slowRequests, currencyResets, downstreamErrors,
+		emptyRecommendations, emptyAds, retriesDropped, downstreamCallsPerRequest, clientCancellations,
+		renderTimeouts, slowRenders, priceConversionFallbacks, orderIDFallbacks, bulkheadRejections)
 
 	r := mux.NewRouter()
-	r.Handle("/", chain("home", svc.homeHandler)).Methods(http.MethodGet, http.MethodHead)
-	r.Handle("/product/{id}", chain("product-by-id", svc.productHandler)).Methods(http.MethodGet, http.MethodHead)
-	r.Handle("/cart", chain("get-cart", svc.viewCartHandler)).Methods(http.MethodGet, http.MethodHead)
-	r.Handle("/cart", chain("post-cart", svc.addToCartHandler)).Methods(http.MethodPost)
-	r.Handle("/cart/empty", chain("empty-cart", svc.emptyCartHandler)).Methods(http.MethodPost)
-	r.Handle("/setCurrency", chain("set-currency", svc.setCurrencyHandler)).Methods(http.MethodPost)
-	r.Handle("/logout", chain("logout", svc.logoutHandler)).Methods(http.MethodGet)
-	r.Handle("/cart/checkout", chain("checkout", svc.placeOrderHandler)).Methods(http.MethodPost)
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
-	r.HandleFunc("/robots.txt", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "User-agent: *\nDisallow: /") })
+	// Pages are replaced by a degraded page while critical dependencies are
+	// down.
+	handle := func(path, name string, f func(http.ResponseWriter, *http.Request)) *mux.Route {
+		return metrics.handle(r, path, name, svc.degradeOnOutage(http.HandlerFunc(f)))
+	}
+	handle("/", "home", svc.homeHandler).Methods(http.MethodGet, http.MethodHead)
+	handle("/product/{id}", "product-by-id", svc.productHandler).Methods(http.MethodGet, http.MethodHead)
+	handle("/product/{id}/notify", "restock-signup", svc.readOnlyGuard(svc.notifyRestockHandler)).Methods(http.MethodPost)
+	handle("/cart", "get-cart", svc.viewCartHandler).Methods(http.MethodGet, http.MethodHead)
+	handle("/cart", "post-cart", svc.readOnlyGuard(svc.addToCartHandler)).Methods(http.MethodPost)
+	handle("/cart/empty", "empty-cart", svc.readOnlyGuard(svc.emptyCartHandler)).Methods(http.MethodPost)
+	handle("/setCurrency", "set-currency", svc.setCurrencyHandler).Methods(http.MethodPost)
+	handle("/logout", "logout", svc.logoutHandler).Methods(http.MethodGet)
+	handle("/cart/checkout", "checkout", svc.readOnlyGuard(svc.placeOrderHandler)).Methods(http.MethodPost)
+	handle("/cart/checkout/review", "checkout-review", svc.readOnlyGuard(svc.reviewOrderHandler)).Methods(http.MethodPost)
+	metrics.handle(r, "/api/product/{id}", "api-product", http.HandlerFunc(svc.apiProductHandler)).Methods(http.MethodGet)
+	metrics.handle(r, "/cart/export", "export-cart", http.HandlerFunc(svc.cartExportHandler)).Methods(http.MethodGet)
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", cacheImages(negotiateImageFormat(staticRoots, http.FileServer(staticRoots)))))
+	r.HandleFunc("/robots.txt", svc.robotsHandler)
+	metrics.handle(r, "/sitemap.xml", "sitemap", http.HandlerFunc(svc.sitemapHandler)).Methods(http.MethodGet, http.MethodHead)
 	r.HandleFunc("/_healthz", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
-	r.Path("/metrics").Handler(promhttp.Handler())
+	r.HandleFunc("/readyz", svc.readinessHandler)
+	// OpenMetrics is needed for the trace exemplars on the duration histogram.
+	r.Path("/metrics").Handler(promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+
+	slowRequestThreshold := 2 * time.Second
+	mustMapEnvDuration(&slowRequestThreshold, "SLOW_REQUEST_THRESHOLD")
+	accessLogSampleRate := 1.0
+	mustMapEnvFraction(&accessLogSampleRate, "ACCESS_LOG_SAMPLE_RATE")
+
+	maxConcurrentRequests := 0
+	mustMapEnvInt(&maxConcurrentRequests, "MAX_CONCURRENT_REQUESTS")
+
+	allowForceTrace := false
+	mustMapEnvBool(&allowForceTrace, "ALLOW_FORCE_TRACE")
+
+	timeouts := defaultServerTimeouts
+	mustMapEnvDuration(&timeouts.readHeader, "HTTP_READ_HEADER_TIMEOUT")
+	mustMapEnvDuration(&timeouts.read, "HTTP_READ_TIMEOUT")
+	mustMapEnvDuration(&timeouts.write, "HTTP_WRITE_TIMEOUT")
+	mustMapEnvDuration(&timeouts.idle, "HTTP_IDLE_TIMEOUT")
+	renderTimeout := defaultRenderTimeout(timeouts.write)
+	mustMapEnvDuration(&renderTimeout, "RENDER_TIMEOUT")
 
 	var handler http.Handler = r
-	handler = &logHandler{log: log, next: handler} // add logging
-	handler = ensureSessionID(handler)             // add session ID
-	handler = &ochttp.Handler{                     // add opencensus instrumentation
-		Handler:     handler,
-		Propagation: &b3.HTTPFormat{}}
+	handler = limitConcurrency(maxConcurrentRequests, handler)                                                             // add load shedding
+	handler = svc.overrideFeatureFlags(handler)                                                                            // add feature flag overrides
+	handler = honorNoCache(handler)                                                                                        // add cache bypass
+	handler = memoizeCart(handler)                                                                                         // add per-request cart memoization
+	handler = guardRender(renderTimeout, handler)                                                                          // add render timeout
+	handler = reportDegraded(debugDegradedHeader, handler)                                                                 // add degraded features header
+	handler = &logHandler{log: log, next: handler, slowThreshold: slowRequestThreshold, dropRate: 1 - accessLogSampleRate} // add logging
+	handler = svc.ensureCurrency(handler)                                                                                  // add currency
+	handler = svc.resolveUser(handler)                                                                                     // add user
+	handler = svc.ensureSessionID(handler)                                                                                 // add session ID
+	handler = svc.redirectToCanonicalHost(handler)                                                                         // add canonical host redirect
+	handler = svc.strictTransportSecurity(handler)                                                                         // add HSTS
+	handler = &ochttp.Handler{                                                                                             // add opencensus instrumentation
+		Handler:         handler,
+		Propagation:     &b3.HTTPFormat{},
+		GetStartOptions: traceStartOptions(allowForceTrace)}
 
+	srv := newHTTPServer(addr+":"+srvPort, handler, timeouts)
+	// The frontend serves HTTPS itself if given a certificate, rather than
+	// behind a TLS-terminating proxy.
+	tlsCert, tlsKey := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatal("TLS_CERT and TLS_KEY must be set together")
+	}
+	if tlsCert != "" {
+		minVersion, err := parseTLSVersion(os.Getenv("TLS_MIN_VERSION"))
+		if err != nil {
+			log.Fatalf("TLS_MIN_VERSION: %v", err)
+		}
+		srv.TLSConfig = newTLSConfig(minVersion)
+	}
+
+	waitForDependencies := false
+	mustMapEnvBool(&waitForDependencies, "WAIT_FOR_DEPENDENCIES")
+	if waitForDependencies {
+		dependencyWaitTimeout := time.Minute
+		mustMapEnvDuration(&dependencyWaitTimeout, "DEPENDENCY_WAIT_TIMEOUT")
+		log.Infof("waiting up to %v for critical dependencies", dependencyWaitTimeout)
+		if err := svc.waitForDependencies(ctx, log, dependencyWaitTimeout, time.Second); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	prefetchCatalog := false
+	mustMapEnvBool(&prefetchCatalog, "PREFETCH_CATALOG")
+	if prefetchCatalog {
+		svc.prefetchCatalog(ctx, log)
+	}
+
+	var readinessInitialDelay time.Duration
+	mustMapEnvDuration(&readinessInitialDelay, "READINESS_INITIAL_DELAY")
+	svc.readyAfter = time.Now().Add(readinessInitialDelay)
+
+	if tlsCert != "" {
+		log.Infof("starting HTTPS server on " + addr + ":" + srvPort)
+		log.Fatal(srv.ListenAndServeTLS(tlsCert, tlsKey))
+	}
 	log.Infof("starting server on " + addr + ":" + srvPort)
-	log.Fatal(http.ListenAndServe(addr+":"+srvPort, handler))
+	log.Fatal(srv.ListenAndServe())
+}
+
+// deploymentEnvironment returns the environment (e.g. "prod") the frontend
+// runs in, attached to every log entry and exported span.
+func deploymentEnvironment() string {
+	if v := os.Getenv("ENVIRONMENT"); v != "" {
+		return v
+	}
+	return "unknown"
+}
+
+// constantFields is a logrus hook adding the same fields to every entry,
+// unless the entry sets them itself.
+type constantFields logrus.Fields
+
+func (f constantFields) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (f constantFields) Fire(e *logrus.Entry) error {
+	for k, v := range f {
+		if _, ok := e.Data[k]; !ok {
+			e.Data[k] = v
+		}
+	}
+	return nil
+}
+
+// serverTimeouts bound how long the server waits on clients, guarding
+// against slow clients holding connections open. Zero disables a timeout.
+type serverTimeouts struct {
+	readHeader time.Duration
+	read       time.Duration
+	write      time.Duration
+	idle       time.Duration
+}
+
+// defaultServerTimeouts leave ample time for the write of a checkout, which
+// calls several services in sequence, while cutting off slow headers early.
+var defaultServerTimeouts = serverTimeouts{
+	readHeader: 5 * time.Second,
+	read:       15 * time.Second,
+	write:      60 * time.Second,
+	idle:       120 * time.Second,
+}
+
+func newHTTPServer(addr string, h http.Handler, t serverTimeouts) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: t.readHeader,
+		ReadTimeout:       t.read,
+		WriteTimeout:      t.write,
+		IdleTimeout:       t.idle,
+	}
 }
 
 func initJaegerTracing(log logrus.FieldLogger) {
@@ -225,6 +717,7 @@ func initJaegerTracing(log logrus.FieldLogger) {
 		Endpoint: fmt.Sprintf("http://%s", svcAddr),
 		Process: jaeger.Process{
 			ServiceName: "frontend_frontend",
+			Tags:        []jaeger.Tag{jaeger.StringTag("environment", deploymentEnvironment())},
 		},
 	})
 	if err != nil {
@@ -254,7 +747,9 @@ func initStackdriverTracing(log logrus.FieldLogger) {
 	// since they are not sharing packages.
 	for i := 1; i <= 3; i++ {
 		log = log.WithField("retry", i)
-		exporter, err := stackdriver.NewExporter(stackdriver.Options{})
+		exporter, err := stackdriver.NewExporter(stackdriver.Options{
+			DefaultTraceAttributes: map[string]interface{}{"environment": deploymentEnvironment()},
+		})
 		if err != nil {
 			// log.Warnf is used since there are multiple backends (stackdriver & jaeger)
 			// to store the traces. In production setup most likely you would use only one backend.
@@ -275,16 +770,50 @@ func initStackdriverTracing(log logrus.FieldLogger) {
 	log.Warn("could not initialize Stackdriver exporter after retrying, giving up")
 }
 
-func initTracing(log logrus.FieldLogger) {
+// checkTraceExporter rejects TRACE_EXPORTER values naming an exporter this
+// build cannot provide, rather than starting up without exporting traces.
+// OpenCensus has no OTLP exporter.
+func checkTraceExporter(name string) error {
+	if strings.EqualFold(name, "otlp") {
+		return errors.New("otlp is not supported by this build")
+	}
+	return nil
+}
+
+// selectTraceExporters returns the trace exporters enabled by a
+// TRACE_EXPORTER value. An empty value selects "all" for backward
+// compatibility; ok is false for unknown values, which select none.
+func selectTraceExporters(name string) (exporters []string, ok bool) {
+	switch strings.ToLower(name) {
+	case "", "all":
+		return []string{"jaeger", "stackdriver"}, true
+	case "jaeger", "stackdriver":
+		return []string{strings.ToLower(name)}, true
+	case "none":
+		return nil, true
+	}
+	return nil, false
+}
+
+func initTracing(log logrus.FieldLogger, exporter string) {
 	// This is a demo app with low QPS. trace.AlwaysSample() is used here
 	// to make sure traces are available for observation and analysis.
 	// In a production environment or high QPS setup please use
 	// trace.ProbabilitySampler set at the desired probability.
 	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
 
-	initJaegerTracing(log)
-	initStackdriverTracing(log)
-
+	exporters, ok := selectTraceExporters(exporter)
+	if !ok {
+		log.Warnf("unknown TRACE_EXPORTER %q, traces will not be exported", exporter)
+	}
+	for _, e := range exporters {
+		switch e {
+		case "jaeger":
+			initJaegerTracing(log)
+		case "stackdriver":
+			initStackdriverTracing(log)
+		}
+	}
 }
 
 func initProfiling(log logrus.FieldLogger, service, version string) {
@@ -313,18 +842,197 @@ func initProfiling(log logrus.FieldLogger, service, version string) {
 func mustMapEnv(target *string, envKey string) {
 	v := os.Getenv(envKey)
 	if v == "" {
-		panic(fmt.Sprintf("environment variable %q not set", envKey))
+		panic(fmt.Sprintf("environment variable %q not set (nor in CONFIG_FILE)", envKey))
 	}
 	*target = v
 }
 
-func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
+// mustMapEnvBool sets target from the boolean in envKey, leaving it unchanged
+// if the variable is not set.
+func mustMapEnvBool(target *bool, envKey string) {
+	v := os.Getenv(envKey)
+	if v == "" {
+		return
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		panic(fmt.Sprintf("environment variable %q must be a boolean, got %q", envKey, v))
+	}
+	*target = b
+}
+
+// mustMapEnvInt sets target from the positive integer in envKey, leaving it
+// unchanged if the variable is not set.
+func mustMapEnvInt(target *int, envKey string) {
+	v := os.Getenv(envKey)
+	if v == "" {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		panic(fmt.Sprintf("environment variable %q must be a positive integer, got %q", envKey, v))
+	}
+	*target = n
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// mustMapEnvIntInRange sets target from the integer in envKey, which must be
+// within [min, max], leaving it unchanged if the variable is not set.
+func mustMapEnvIntInRange(target *int, envKey string, min, max int) {
+	v := os.Getenv(envKey)
+	if v == "" {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		panic(fmt.Sprintf("environment variable %q must be an integer between %d and %d, got %q", envKey, min, max, v))
+	}
+	*target = n
+}
+
+// mustMapEnvDuration sets target from the duration (e.g. "1.5s") in envKey,
+// leaving it unchanged if the variable is not set.
+func mustMapEnvDuration(target *time.Duration, envKey string) {
+	v := os.Getenv(envKey)
+	if v == "" {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		panic(fmt.Sprintf("environment variable %q must be a non-negative duration, got %q", envKey, v))
+	}
+	*target = d
+}
+
+// mustMapEnvFraction sets target from the number within [0, 1] in envKey,
+// leaving it unchanged if the variable is not set.
+func mustMapEnvFraction(target *float64, envKey string) {
+	v := os.Getenv(envKey)
+	if v == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 {
+		panic(fmt.Sprintf("environment variable %q must be a number between 0 and 1, got %q", envKey, v))
+	}
+	*target = f
+}
+
+// mustMapRounding configures the currency rounding policy. granularity is a
+// decimal amount in the target currency (e.g. "0.05") and defaults to "0.01".
+func mustMapRounding(svc *frontendServer, mode, granularity string) {
+	m, err := money.ParseRoundingMode(mode)
+	if err != nil {
+		panic(fmt.Sprintf("CURRENCY_ROUNDING: %q: %v", mode, err))
+	}
+	if granularity == "" {
+		granularity = "0.01"
+	}
+	g, err := strconv.ParseFloat(granularity, 64)
+	if err != nil || g <= 0 {
+		panic(fmt.Sprintf("CURRENCY_ROUNDING_GRANULARITY: %q is not a positive amount", granularity))
+	}
+	svc.roundingMode = m
+	svc.roundingGranularity = int64(math.Round(g * 1e9))
+}
+
+func (fe *frontendServer) mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
 	var err error
-	*conn, err = grpc.DialContext(ctx, addr,
-		grpc.WithInsecure(),
-		grpc.WithTimeout(time.Second*3),
-		grpc.WithStatsHandler(&ocgrpc.ClientHandler{}))
+	*conn, err = grpc.DialContext(ctx, dialTarget(addr), fe.dialOptions()...)
 	if err != nil {
 		panic(errors.Wrapf(err, "grpc: failed to connect %s", addr))
 	}
 }
+
+// mustConnGRPCWithFallbacks dials each of the comma-separated addresses in
+// addrs, the first one as conn and the others as fallbacks.
+func (fe *frontendServer) mustConnGRPCWithFallbacks(ctx context.Context, conn **grpc.ClientConn, fallbacks *[]*grpc.ClientConn, addrs string) {
+	for i, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if i == 0 {
+			fe.mustConnGRPC(ctx, conn, addr)
+			continue
+		}
+		var fallback *grpc.ClientConn
+		fe.mustConnGRPC(ctx, &fallback, addr)
+		*fallbacks = append(*fallbacks, fallback)
+	}
+}
+
+// failCanceled fails calls whose context is already done without issuing
+// them, so that work for a request stops once its client has gone.
+func failCanceled(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return status.Error(codes.Canceled, ctx.Err().Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// timeDownstreamCall records the duration of a call in the timing of the
+// request it is made for.
+func timeDownstreamCall(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	requestTimingFrom(ctx).addDownstream(method, time.Since(start))
+	return err
+}
+
+// countDownstreamErrors counts failed calls by service and gRPC code.
+func countDownstreamErrors(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err != nil {
+		downstreamErrors.WithLabelValues(serviceLabel(method), status.Code(err).String()).Inc()
+	}
+	return err
+}
+
+// logDownstreamCall logs a call with its service, method, duration and gRPC
+// code on the logger of the request it is made for, which carries the
+// request ID. Calls made outside of a request, such as the readiness checks,
+// are not logged.
+func logDownstreamCall(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if log, ok := ctx.Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+		log.WithFields(logrus.Fields{
+			"grpc.service": serviceLabel(method),
+			"grpc.method":  method,
+			"grpc.code":    status.Code(err).String(),
+			"grpc.took_ms": int64(time.Since(start) / time.Millisecond),
+		}).Debug("downstream call")
+	}
+	return err
+}
+
+// dialOptions returns the options used for every downstream connection.
+func (fe *frontendServer) dialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithTimeout(time.Second * 3),
+		grpc.WithStatsHandler(&ocgrpc.ClientHandler{}),
+		grpc.WithChainUnaryInterceptor(fe.applyTimeout, failCanceled, fe.limitServiceConcurrency, timeDownstreamCall, countDownstreamErrors)}
+	if fe.maxRetries > 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(fe.retryUnavailable))
+	}
+	if fe.logDownstreamCalls {
+		// Installed after the retries, so that each attempt is logged.
+		opts = append(opts, grpc.WithChainUnaryInterceptor(logDownstreamCall))
+	}
+	if fe.grpcMaxRecvMsgBytes > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(fe.grpcMaxRecvMsgBytes)))
+	}
+	return opts
+}
@@ -0,0 +1,220 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// setenv sets an environment variable for the duration of the test.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	old, had := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestDialOptions_maxRecvMsgSize(t *testing.T) {
+	const limit = 64 << 10
+	tests := []struct {
+		name     string
+		descSize int
+		wantCode codes.Code
+	}{
+		{"under the limit", limit / 2, codes.OK},
+		{"over the limit", limit * 2, codes.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFakeBackends()
+			fb.products = []*pb.Product{{Id: "big", Description: strings.Repeat("x", tt.descSize)}}
+			fe := newTestFrontend(t, &frontendServer{grpcMaxRecvMsgBytes: limit}, fb)
+
+			_, err := fe.getProducts(context.Background())
+			if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("getProducts() error = %v, want code %v", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestDialOptions_logDownstreamCalls(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		var buf bytes.Buffer
+		fb := newFakeBackends()
+		fb.failing = map[string]error{"GetCart": status.Error(codes.Unavailable, "down")}
+		fe := newTestFrontend(t, &frontendServer{logDownstreamCalls: enabled}, fb)
+		log := newBufferLogger(&buf).WithField("http.req.id", "req-1")
+		ctx := context.WithValue(context.Background(), ctxKeyLog{}, logrus.FieldLogger(log))
+
+		if _, err := fe.getProducts(ctx); err != nil {
+			t.Fatal(err)
+		}
+		fe.getCart(ctx, testSessionID)
+
+		entries := logEntries(t, &buf)
+		if !enabled {
+			if len(entries) != 0 {
+				t.Errorf("logged %d calls when disabled, want 0", len(entries))
+			}
+			continue
+		}
+		if len(entries) != 2 {
+			t.Fatalf("logged %d calls, want 2: %v", len(entries), entries)
+		}
+		want := []map[string]string{
+			{"grpc.service": "productcatalogservice", "grpc.method": "/hipstershop.ProductCatalogService/ListProducts", "grpc.code": "OK"},
+			{"grpc.service": "cartservice", "grpc.method": "/hipstershop.CartService/GetCart", "grpc.code": "Unavailable"},
+		}
+		for i, e := range entries {
+			if e["msg"] != "downstream call" || e["level"] != "debug" || e["http.req.id"] != "req-1" {
+				t.Errorf("entry %d = %v, want a debug downstream call for req-1", i, e)
+			}
+			for k, v := range want[i] {
+				if e[k] != v {
+					t.Errorf("entry %d %s = %v, want %q", i, k, e[k], v)
+				}
+			}
+			if _, ok := e["grpc.took_ms"]; !ok {
+				t.Errorf("entry %d has no grpc.took_ms", i)
+			}
+		}
+	}
+}
+
+func TestMustMapEnvInt(t *testing.T) {
+	const key = "FRONTEND_TEST_INT"
+	n := 7
+	mustMapEnvInt(&n, key)
+	if n != 7 {
+		t.Errorf("unset variable changed value to %d", n)
+	}
+
+	setenv(t, key, "42")
+	mustMapEnvInt(&n, key)
+	if n != 42 {
+		t.Errorf("got %d, want 42", n)
+	}
+
+	for _, v := range []string{"0", "-1", "abc"} {
+		t.Run(v, func(t *testing.T) {
+			setenv(t, key, v)
+			defer func() {
+				if recover() == nil {
+					t.Errorf("mustMapEnvInt did not panic for %q", v)
+				}
+			}()
+			mustMapEnvInt(&n, key)
+		})
+	}
+}
+
+func TestSelectTraceExporters(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   []string
+		wantOK bool
+	}{
+		{"", []string{"jaeger", "stackdriver"}, true},
+		{"all", []string{"jaeger", "stackdriver"}, true},
+		{"jaeger", []string{"jaeger"}, true},
+		{"Stackdriver", []string{"stackdriver"}, true},
+		{"otlp", nil, false},
+		{"none", nil, true},
+		{"zipkin", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := selectTraceExporters(tt.in)
+			if !reflect.DeepEqual(got, tt.want) || ok != tt.wantOK {
+				t.Errorf("selectTraceExporters(%q) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCheckTraceExporter(t *testing.T) {
+	for _, name := range []string{"otlp", "OTLP"} {
+		if err := checkTraceExporter(name); err == nil {
+			t.Errorf("checkTraceExporter(%q) = nil, want an error", name)
+		}
+	}
+	for _, name := range []string{"", "all", "jaeger", "none", "zipkin"} {
+		if err := checkTraceExporter(name); err != nil {
+			t.Errorf("checkTraceExporter(%q) = %v, want nil", name, err)
+		}
+	}
+}
+
+func TestNewHTTPServer_cutsOffSlowHeaders(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeouts := defaultServerTimeouts
+	timeouts.readHeader = 50 * time.Millisecond
+	srv := newHTTPServer(lis.Addr().String(), noopHandler, timeouts)
+	go srv.Serve(lis)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Start a request but never finish its headers.
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	_, err = ioutil.ReadAll(conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("server kept the connection open past the read header timeout")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("connection closed after %v, want about %v", took, timeouts.readHeader)
+	}
+}
+
+func TestDefaultServerTimeouts(t *testing.T) {
+	d := defaultServerTimeouts
+	if d.readHeader <= 0 || d.read <= 0 || d.write <= 0 || d.idle <= 0 {
+		t.Errorf("defaultServerTimeouts = %+v, want every timeout set", d)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// maxMetaDescription is the length that search engines show of a page
+// description, in characters.
+const maxMetaDescription = 160
+
+// pageMeta is the metadata rendered in the head of a page: its title before
+// the store name, its description and its canonical URL.
+type pageMeta struct {
+	Title       string
+	Description string
+	Canonical   string
+}
+
+// pageMeta returns the metadata of the page at path, an absolute path
+// without query, whose canonical URL is on the canonical host if there is
+// one. An empty description falls back to the store description.
+func (fe *frontendServer) pageMeta(r *http.Request, path, title, description string) pageMeta {
+	description = strings.Join(strings.Fields(description), " ")
+	if description == "" {
+		description = fe.metaDescription
+	}
+	if description == "" {
+		description = "Shop the latest products at " + brand.storeName + "."
+	}
+	return pageMeta{Title: title, Description: truncateText(description, maxMetaDescription), Canonical: fe.siteURL(r, path)}
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+func TestProductHandler_meta(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{canonicalHost: "shop.example.com", canonicalHTTPS: true}, fb)
+
+	w := httptest.NewRecorder()
+	fe.productHandler(w, mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z?utm_source=ad", nil), map[string]string{"id": "OLJCESPC7Z"}))
+
+	body := w.Body.String()
+	for _, want := range []string{
+		"<title>Sunglasses | Online Boutique</title>",
+		`<link rel="canonical" href="https://shop.example.com/product/OLJCESPC7Z">`,
+		`<meta name="description" content="Shop the latest products at Online Boutique.">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("product page does not contain %q", want)
+		}
+	}
+}
+
+func TestPageMeta_description(t *testing.T) {
+	fe := &frontendServer{metaDescription: "Hipster goods."}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if got := fe.pageMeta(r, "/", "", "  ").Description; got != "Hipster goods." {
+		t.Errorf("description = %q, want the configured default", got)
+	}
+	if got := fe.pageMeta(r, "/", "", "Fits\n  well.").Description; got != "Fits well." {
+		t.Errorf("description = %q, want its whitespace collapsed", got)
+	}
+	long := strings.Repeat("é", 200)
+	if got := fe.pageMeta(r, "/", "", long).Description; utf8.RuneCountInString(got) != maxMetaDescription || !strings.HasSuffix(got, "…") {
+		t.Errorf("description of %d characters, want it truncated to %d", utf8.RuneCountInString(got), maxMetaDescription)
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opencensus.io/trace"
+)
+
+var (
+	templateRenderDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "frontend_template_render_seconds",
+			Help:    "A histogram of template execution latencies in the frontend.",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25},
+		},
+		[]string{"template"},
+	)
+
+	templateErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "frontend_template_errors_total",
+			Help: "A counter of template executions that failed, by template.",
+		},
+		[]string{"template"},
+	)
+
+	slowRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "frontend_slow_requests_total",
+			Help: "A counter of requests exceeding SLOW_REQUEST_THRESHOLD.",
+		},
+		[]string{"handler"},
+	)
+
+	currencyResets = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "frontend_currency_reset_total",
+			Help: "A counter of sessions reset to the default currency because theirs became unsupported.",
+		},
+	)
+
+	downstreamErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "frontend_downstream_errors_total",
+			Help: "A counter of failed downstream calls by service and gRPC code.",
+		},
+		[]string{"service", "code"},
+	)
+
+	emptyRecommendations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "frontend_empty_recommendations_total",
+			Help: "A counter of successful recommendation responses without any products.",
+		},
+	)
+
+	emptyAds = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "frontend_empty_ads_total",
+			Help: "A counter of successful ad responses without any ads.",
+		},
+	)
+
+	downstreamCallsPerRequest = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "frontend_downstream_calls_per_request",
+			Help:    "A histogram of the number of downstream calls made per request, by handler.",
+			Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100},
+		},
+		[]string{"handler"},
+	)
+
+	clientCancellations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "frontend_client_cancellations_total",
+			Help: "A counter of requests abandoned because the client went away.",
+		},
+	)
+
+	priceConversionFallbacks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "frontend_price_conversion_fallbacks_total",
+			Help: "A counter of product pages showing the base currency price because the conversion failed.",
+		},
+	)
+
+	orderIDFallbacks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "frontend_order_id_fallbacks_total",
+			Help: "A counter of orders placed without an ID from the checkout service, given a fallback ID.",
+		},
+	)
+
+	retriesDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "frontend_retries_dropped_total",
+			Help: "A counter of downstream retries skipped because the retry budget was exhausted.",
+		},
+		[]string{"service"},
+	)
+
+	bulkheadRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "frontend_bulkhead_rejections_total",
+			Help: "A counter of downstream calls failed for exceeding the service's concurrency limit.",
+		},
+		[]string{"service"},
+	)
+)
+
+// httpMetrics are the metrics recorded for every page handler.
+//
+// taken from https://pkg.go.dev/github.com/prometheus/client_golang/prometheus/promhttp#example-InstrumentHandlerDuration
+type httpMetrics struct {
+	// inFlight is partitioned by handler so that saturation can be traced
+	// to a route; the total is the sum over handlers.
+	inFlight     *prometheus.GaugeVec
+	counter      *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	ttfb         *prometheus.HistogramVec
+	responseSize *prometheus.HistogramVec
+
+	// routes maps the handler names registered through handle to their
+	// normalized route, bounding both labels to the registered set.
+	routes map[string]string
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		inFlight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "frontend_in_flight_requests",
+				Help: "A gauge of requests currently being served by the frontend.",
+			},
+			[]string{"handler"},
+		),
+
+		counter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "frontend_api_requests_total",
+				Help: "A counter for requests to the frontend.",
+			},
+			[]string{"code", "method", "route"},
+		),
+
+		// duration is partitioned by the HTTP method and handler. It uses custom
+		// buckets based on the expected request duration.
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "frontend_request_duration_seconds",
+				Help:    "A histogram of latencies for requests in the frontend.",
+				Buckets: []float64{.25, .5, 1, 2.5, 5, 10},
+			},
+			[]string{"handler", "method"},
+		),
+
+		// ttfb is the time until the first byte of the body is written or
+		// flushed, partitioned like duration. Against it, duration shows
+		// how much of a page is streamed after the user sees something.
+		ttfb: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "frontend_ttfb_seconds",
+				Help:    "A histogram of the time to the first byte of responses in the frontend.",
+				Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+			},
+			[]string{"handler", "method"},
+		),
+
+		// responseSize has no labels, making it a zero-dimensional
+		// ObserverVec.
+		responseSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "frontend_response_size_bytes",
+				Help:    "A histogram of response sizes for requests.",
+				Buckets: []float64{200, 500, 900, 1500},
+			},
+			[]string{},
+		),
+
+		routes: make(map[string]string),
+	}
+}
+
+func (m *httpMetrics) mustRegister() {
+	prometheus.MustRegister(m.inFlight, m.counter, m.duration, m.ttfb, m.responseSize)
+}
+
+// instrument wraps h with all the metrics, injecting the "handler" label by
+// currying.
+// The "route" label is the normalized path template the handler serves.
+func (m *httpMetrics) instrument(name, route string, h http.Handler) http.Handler {
+	next := h
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestTimingFrom(r.Context()).setHandler(name)
+		next.ServeHTTP(w, r)
+	})
+	return promhttp.InstrumentHandlerInFlight(
+		m.inFlight.WithLabelValues(name),
+		instrumentHandlerDuration(m.duration.MustCurryWith(prometheus.Labels{"handler": name}),
+			promhttp.InstrumentHandlerCounter(m.counter.MustCurryWith(prometheus.Labels{"route": route}),
+				promhttp.InstrumentHandlerResponseSize(m.responseSize,
+					instrumentTTFB(m.ttfb.MustCurryWith(prometheus.Labels{"handler": name}), h),
+				),
+			),
+		),
+	)
+}
+
+// labelValuePattern restricts handler names to short, static identifiers.
+var labelValuePattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,63}$`)
+
+// handle registers h on router for the path template, instrumented under
+// the handler name. Labels only ever take the registered names and routes,
+// whatever the request path: it panics if name is not a static identifier
+// or is already registered for another route.
+func (m *httpMetrics) handle(router *mux.Router, path, name string, h http.Handler) *mux.Route {
+	if !labelValuePattern.MatchString(name) {
+		panic(fmt.Sprintf("invalid handler name %q", name))
+	}
+	route := normalizeRoute(path)
+	if prev, ok := m.routes[name]; ok && prev != route {
+		panic(fmt.Sprintf("handler name %q registered for both %q and %q", name, prev, route))
+	}
+	m.routes[name] = route
+	return router.Handle(path, m.instrument(name, route, h))
+}
+
+// normalizeRoute returns the path template with the patterns of its
+// variables removed (e.g. "/product/{id:[0-9]+}" becomes "/product/{id}")
+// and without a trailing slash.
+func normalizeRoute(path string) string {
+	var b strings.Builder
+	depth, inPattern := 0, false
+	for _, c := range path {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				inPattern = false
+			}
+		case ':':
+			if depth == 1 {
+				inPattern = true
+			}
+		}
+		if !inPattern || c == '}' && depth == 0 {
+			b.WriteRune(c)
+		}
+	}
+	route := b.String()
+	if len(route) > 1 {
+		route = strings.TrimSuffix(route, "/")
+	}
+	return route
+}
+
+// serviceLabel returns the service of a full gRPC method name in the form
+// used for dependencies, e.g. "cartservice" for
+// "/hipstershop.CartService/GetCart". The label is bounded by the generated
+// clients the frontend calls.
+func serviceLabel(method string) string {
+	svc := strings.TrimPrefix(method, "/")
+	if i := strings.IndexByte(svc, '/'); i >= 0 {
+		svc = svc[:i]
+	}
+	if i := strings.LastIndexByte(svc, '.'); i >= 0 {
+		svc = svc[i+1:]
+	}
+	if svc == "" {
+		return "unknown"
+	}
+	return strings.ToLower(svc)
+}
+
+// templateLabel returns name if it is a defined template and "unknown"
+// otherwise, keeping the "template" label bounded to the known set.
+func templateLabel(name string) string {
+	if templates.Lookup(name) == nil {
+		return "unknown"
+	}
+	return name
+}
+
+// instrumentHandlerDuration works like promhttp.InstrumentHandlerDuration
+// (with a "method" label only) but attaches the trace ID of the request's
+// span as an exemplar, so that a latency spike can be followed to a trace.
+func instrumentHandlerDuration(obs prometheus.ObserverVec, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		o := obs.With(prometheus.Labels{"method": strings.ToLower(r.Method)})
+		observeWithTraceExemplar(r.Context(), o, time.Since(start).Seconds())
+	}
+}
+
+// instrumentTTFB observes the time until next first writes or flushes its
+// response, with a "method" label only. Responses without a body are
+// observed when next returns.
+func instrumentTTFB(obs prometheus.ObserverVec, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tw := &ttfbWriter{
+			ResponseWriter: w,
+			start:          time.Now(),
+			obs:            obs.With(prometheus.Labels{"method": strings.ToLower(r.Method)}),
+		}
+		next.ServeHTTP(tw, r)
+		tw.firstByte()
+	}
+}
+
+// ttfbWriter observes the time of the first write or flush of a response.
+type ttfbWriter struct {
+	http.ResponseWriter
+	start    time.Time
+	obs      prometheus.Observer
+	observed bool
+}
+
+func (w *ttfbWriter) firstByte() {
+	if !w.observed {
+		w.observed = true
+		w.obs.Observe(time.Since(w.start).Seconds())
+	}
+}
+
+func (w *ttfbWriter) Write(p []byte) (int, error) {
+	w.firstByte()
+	return w.ResponseWriter.Write(p)
+}
+
+// checkRender passes on render timeout checks.
+func (w *ttfbWriter) checkRender() error {
+	if c, ok := w.ResponseWriter.(renderChecker); ok {
+		return c.checkRender()
+	}
+	return nil
+}
+
+// Flush passes on flushes, for the pages streamed in chunks.
+func (w *ttfbWriter) Flush() {
+	w.firstByte()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// observeWithTraceExemplar records v on o, with a trace_id exemplar if ctx
+// carries a sampled span. Without one (e.g. tracing is disabled) it falls back
+// to a plain observation.
+func observeWithTraceExemplar(ctx context.Context, o prometheus.Observer, v float64) {
+	if span := trace.FromContext(ctx); span != nil {
+		if sc := span.SpanContext(); sc.IsSampled() {
+			if eo, ok := o.(prometheus.ExemplarObserver); ok {
+				eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": sc.TraceID.String()})
+				return
+			}
+		}
+	}
+	o.Observe(v)
+}
@@ -0,0 +1,261 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func newTestDurationVec() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "test_request_duration_seconds",
+		Buckets: []float64{.25, .5, 1},
+	}, []string{"method"})
+}
+
+// bucketExemplars returns the exemplars recorded on the histogram for the
+// "get" method.
+func bucketExemplars(t *testing.T, vec *prometheus.HistogramVec) []*dto.Exemplar {
+	t.Helper()
+	var m dto.Metric
+	if err := vec.WithLabelValues("get").(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 1 {
+		t.Fatalf("sample count = %d, want 1", got)
+	}
+	var out []*dto.Exemplar
+	for _, b := range m.GetHistogram().GetBucket() {
+		if e := b.GetExemplar(); e != nil {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func TestInstrumentHandlerDuration_exemplar(t *testing.T) {
+	vec := newTestDurationVec()
+	h := instrumentHandlerDuration(vec, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx, span := trace.StartSpan(r.Context(), "test", trace.WithSampler(trace.AlwaysSample()))
+	defer span.End()
+	h.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+
+	exemplars := bucketExemplars(t, vec)
+	if len(exemplars) != 1 {
+		t.Fatalf("got %d exemplars, want 1", len(exemplars))
+	}
+	labels := exemplars[0].GetLabel()
+	if len(labels) != 1 || labels[0].GetName() != "trace_id" || labels[0].GetValue() != span.SpanContext().TraceID.String() {
+		t.Errorf("exemplar labels = %v, want trace_id=%s", labels, span.SpanContext().TraceID)
+	}
+}
+
+func TestInstrumentHandlerDuration_noSpan(t *testing.T) {
+	vec := newTestDurationVec()
+	h := instrumentHandlerDuration(vec, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if exemplars := bucketExemplars(t, vec); len(exemplars) != 0 {
+		t.Errorf("got %d exemplars without a span, want 0", len(exemplars))
+	}
+}
+
+func TestHTTPMetrics_inFlightPerHandler(t *testing.T) {
+	m := newHTTPMetrics()
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := m.instrument("home", "/", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		close(entered)
+		<-release
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		close(done)
+	}()
+	<-entered
+	if got := testutil.ToFloat64(m.inFlight.WithLabelValues("home")); got != 1 {
+		t.Errorf("in-flight for home = %v during the request, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.inFlight.WithLabelValues("get-cart")); got != 0 {
+		t.Errorf("in-flight for get-cart = %v, want 0", got)
+	}
+	close(release)
+	<-done
+	if got := testutil.ToFloat64(m.inFlight.WithLabelValues("home")); got != 0 {
+		t.Errorf("in-flight for home = %v after the request, want 0", got)
+	}
+}
+
+func TestDownstreamErrors_countedByServiceAndCode(t *testing.T) {
+	fb := newFakeBackends()
+	fb.convert = func(*pb.CurrencyConversionRequest) (*pb.Money, error) {
+		return nil, status.Error(codes.InvalidArgument, "unsupported currency")
+	}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	counter := downstreamErrors.WithLabelValues("currencyservice", "InvalidArgument")
+	before := testutil.ToFloat64(counter)
+
+	if _, err := fe.convertCurrency(context.Background(), &pb.Money{CurrencyCode: "USD", Units: 1}, "XXX"); err == nil {
+		t.Fatal("convertCurrency() = nil error")
+	}
+	if _, err := fe.getCurrencies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(counter); got != before+1 {
+		t.Errorf("frontend_downstream_errors_total{service=\"currencyservice\",code=\"InvalidArgument\"} = %v, want %v", got, before+1)
+	}
+}
+
+func TestServiceLabel(t *testing.T) {
+	tests := map[string]string{
+		"/hipstershop.CartService/GetCart": "cartservice",
+		"/hipstershop.AdService/GetAds":    "adservice",
+		"/grpc.health.v1.Health/Check":     "health",
+		"":                                 "unknown",
+	}
+	for method, want := range tests {
+		if got := serviceLabel(method); got != want {
+			t.Errorf("serviceLabel(%q) = %q, want %q", method, got, want)
+		}
+	}
+}
+
+func TestHTTPMetrics_boundedLabels(t *testing.T) {
+	m := newHTTPMetrics()
+	r := mux.NewRouter()
+	m.handle(r, "/product/{id}", "product-by-id", noopHandler).Methods(http.MethodGet)
+	m.handle(r, "/cart", "get-cart", noopHandler).Methods(http.MethodGet)
+
+	for i := 0; i < 500; i++ {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, fmt.Sprintf("/product/ID%04d", i), nil))
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/cart", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/no/such/page", nil))
+
+	if n := testutil.CollectAndCount(m.counter); n != 2 {
+		t.Errorf("request counter has %d series, want 2 (one per route)", n)
+	}
+	if n := testutil.CollectAndCount(m.duration); n != 2 {
+		t.Errorf("duration histogram has %d series, want 2 (one per handler)", n)
+	}
+	if got := testutil.ToFloat64(m.counter.WithLabelValues("200", "get", "/product/{id}")); got != 500 {
+		t.Errorf("requests for /product/{id} = %v, want 500", got)
+	}
+}
+
+func TestHTTPMetrics_handleRejectsUnboundedNames(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"/product/OLJCESPC7Z", "/product/{id}"},
+		{"", "/"},
+		{"get-cart", "/basket"}, // already registered for /cart
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newHTTPMetrics()
+			r := mux.NewRouter()
+			m.handle(r, "/cart", "get-cart", noopHandler)
+			defer func() {
+				if recover() == nil {
+					t.Errorf("handle(%q, %q) did not panic", tt.path, tt.name)
+				}
+			}()
+			m.handle(r, tt.path, tt.name, noopHandler)
+		})
+	}
+}
+
+func TestNormalizeRoute(t *testing.T) {
+	tests := map[string]string{
+		"/":                         "/",
+		"/cart/":                    "/cart",
+		"/product/{id}":             "/product/{id}",
+		"/product/{id:[A-Z0-9]+}":   "/product/{id}",
+		"/order/{id:[0-9]{3}}/item": "/order/{id}/item",
+	}
+	for path, want := range tests {
+		if got := normalizeRoute(path); got != want {
+			t.Errorf("normalizeRoute(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+// histogramSum returns the sum of the observations of a histogram.
+func histogramSum(t *testing.T, o prometheus.Observer) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 1 {
+		t.Fatalf("sample count = %d, want 1", got)
+	}
+	return m.GetHistogram().GetSampleSum()
+}
+
+func TestHTTPMetrics_ttfbBeforeDuration(t *testing.T) {
+	m := newHTTPMetrics()
+	h := m.instrument("home", "/", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("<html>"))
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("</html>"))
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !w.Flushed {
+		t.Error("flush not passed on")
+	}
+	ttfb := histogramSum(t, m.ttfb.WithLabelValues("home", "get"))
+	duration := histogramSum(t, m.duration.WithLabelValues("home", "get"))
+	if ttfb >= duration || duration-ttfb < 0.05 {
+		t.Errorf("ttfb = %vs, duration = %vs, want the first byte 50ms before the end", ttfb, duration)
+	}
+}
+
+func TestHTTPMetrics_ttfbWithoutBody(t *testing.T) {
+	m := newHTTPMetrics()
+	h := m.instrument("home", "/", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	histogramSum(t, m.ttfb.WithLabelValues("home", "get"))
+}
@@ -16,19 +16,107 @@ package main
 
 import (
 	"context"
+	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
 )
 
 type ctxKeyLog struct{}
 type ctxKeyRequestID struct{}
+type ctxKeyCurrency struct{}
+type ctxKeyRequestTiming struct{}
 
 type logHandler struct {
 	log  *logrus.Logger
 	next http.Handler
+
+	// slowThreshold is the duration above which a request is logged as a
+	// warning and counted as slow. Zero disables the check.
+	slowThreshold time.Duration
+
+	// dropRate is the fraction of successful requests that are not logged,
+	// to sample the access log. Failed and slow requests are always logged.
+	dropRate float64
+}
+
+// requestTiming collects the name of the handler serving a request and the
+// downstream calls it made, for the access log and the slow request log.
+type requestTiming struct {
+	mu         sync.Mutex
+	handler    string
+	downstream map[string]time.Duration
+	calls      int
+}
+
+// requestTimingFrom returns the timing of the request ctx belongs to, or nil
+// if it is not being collected. The methods of requestTiming accept nil.
+func requestTimingFrom(ctx context.Context) *requestTiming {
+	t, _ := ctx.Value(ctxKeyRequestTiming{}).(*requestTiming)
+	return t
+}
+
+func (t *requestTiming) setHandler(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.handler = name
+	t.mu.Unlock()
+}
+
+// addDownstream records a call to the gRPC method that took d.
+func (t *requestTiming) addDownstream(method string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.downstream == nil {
+		t.downstream = make(map[string]time.Duration)
+	}
+	t.downstream[method] += d
+	t.calls++
+	t.mu.Unlock()
+}
+
+// downstreamCalls returns the number of downstream calls made.
+func (t *requestTiming) downstreamCalls() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.calls
+}
+
+// handlerName returns the name of the handler, or "unknown" for requests
+// not served by an instrumented handler.
+func (t *requestTiming) handlerName() string {
+	if t == nil {
+		return "unknown"
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.handler == "" {
+		return "unknown"
+	}
+	return t.handler
+}
+
+// downstreamMillis returns the time spent per downstream method, in
+// milliseconds.
+func (t *requestTiming) downstreamMillis() map[string]int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]int64, len(t.downstream))
+	for m, d := range t.downstream {
+		out[m] = int64(d / time.Millisecond)
+	}
+	return out
 }
 
 type responseRecorder struct {
@@ -53,6 +141,13 @@ func (r *responseRecorder) WriteHeader(statusCode int) {
 	r.w.WriteHeader(statusCode)
 }
 
+// Flush passes on flushes, for the pages streamed in chunks.
+func (r *responseRecorder) Flush() {
+	if f, ok := r.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	requestID, _ := uuid.NewRandom()
@@ -68,29 +163,61 @@ func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if v, ok := r.Context().Value(ctxKeySessionID{}).(string); ok {
 		log = log.WithField("session", v)
 	}
-	log.Debug("request started")
+	if v, ok := r.Context().Value(ctxKeyUserID{}).(string); ok {
+		log = log.WithField("user", v)
+	}
+	if v, ok := r.Context().Value(ctxKeyCurrency{}).(string); ok {
+		log = log.WithField("currency", v)
+	}
+	// Whether a request fails is only known once it completes, so its start
+	// is logged only if sampled.
+	sampled := rand.Float64() >= lh.dropRate
+	if sampled {
+		log.Debug("request started")
+	}
+	if c, ok := r.Context().Value(ctxKeyCurrencyReset{}).(*currencyReset); ok && c.invalid != "" {
+		log.WithField("curr.invalid", c.invalid).Debug("invalid currency cookie, reset to " + defaultCurrency)
+	}
+	timing := &requestTiming{}
 	defer func() {
-		log.WithFields(logrus.Fields{
-			"http.resp.took_ms": int64(time.Since(start) / time.Millisecond),
-			"http.resp.status":  rr.status,
-			"http.resp.bytes":   rr.b}).Debugf("request complete")
+		took := time.Since(start)
+		handler, calls := timing.handlerName(), timing.downstreamCalls()
+		downstreamCallsPerRequest.WithLabelValues(handler).Observe(float64(calls))
+		log := log.WithFields(logrus.Fields{
+			"http.resp.took_ms":          int64(took / time.Millisecond),
+			"http.resp.status":           rr.status,
+			"http.resp.bytes":            rr.b,
+			"http.resp.downstream_calls": calls})
+		if lh.slowThreshold > 0 && took > lh.slowThreshold {
+			slowRequests.WithLabelValues(handler).Inc()
+			log.WithFields(logrus.Fields{
+				"handler":                 handler,
+				"http.resp.downstream_ms": timing.downstreamMillis()}).Warn("slow request")
+			return
+		}
+		if sampled || rr.status >= http.StatusBadRequest {
+			log.Debugf("request complete")
+		}
 	}()
 
+	ctx = context.WithValue(ctx, ctxKeyRequestTiming{}, timing)
 	ctx = context.WithValue(ctx, ctxKeyLog{}, log)
 	r = r.WithContext(ctx)
 	lh.next.ServeHTTP(rr, r)
 }
 
-func ensureSessionID(next http.Handler) http.HandlerFunc {
+func (fe *frontendServer) ensureSessionID(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var sessionID string
 		c, err := r.Cookie(cookieSessionID)
-		if err == http.ErrNoCookie {
-			u, _ := uuid.NewRandom()
-			sessionID = u.String()
+		// Session IDs in the namespace of users are replaced, so that a
+		// cookie cannot claim the cart of a signed-in user.
+		if err == http.ErrNoCookie || err == nil && strings.HasPrefix(c.Value, userIDPrefix) {
+			sessionID = fe.newSessionID()
 			http.SetCookie(w, &http.Cookie{
 				Name:   cookieSessionID,
 				Value:  sessionID,
+				Domain: fe.cookieDomainFor(r),
 				MaxAge: cookieMaxAge,
 			})
 		} else if err != nil {
@@ -103,3 +230,97 @@ func ensureSessionID(next http.Handler) http.HandlerFunc {
 		next.ServeHTTP(w, r)
 	}
 }
+
+// cookieDomainFor returns the configured cookie domain if it is the request
+// host or one of its parents, so browsers will accept it. Otherwise it returns
+// "" and cookies stay host-only.
+func (fe *frontendServer) cookieDomainFor(r *http.Request) string {
+	if fe.cookieDomain == "" {
+		return ""
+	}
+	host := fe.externalHost(r)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if host == fe.cookieDomain || strings.HasSuffix(host, "."+fe.cookieDomain) {
+		return fe.cookieDomain
+	}
+	return ""
+}
+
+// ensureCurrency resolves the session currency from its cookie once per
+// request, storing it in the context and on the request's span. If the
+// cookie holds a currency outside of the supported set, or the currency
+// turns out to be unsupported while handling the request, the cookie is
+// reset to the default currency.
+func (fe *frontendServer) ensureCurrency(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currency := defaultCurrency
+		reset := &currencyReset{}
+		if c, _ := r.Cookie(cookieCurrency); c != nil {
+			if whitelistedCurrencies[c.Value] {
+				currency = c.Value
+			} else {
+				reset.done, reset.invalid = true, c.Value
+			}
+		}
+		if span := trace.FromContext(r.Context()); span != nil {
+			span.AddAttributes(trace.StringAttribute("currency", currency))
+		}
+		ctx := context.WithValue(r.Context(), ctxKeyCurrency{}, currency)
+		ctx = context.WithValue(ctx, ctxKeyCurrencyReset{}, reset)
+		next.ServeHTTP(&currencyResetWriter{ResponseWriter: w, reset: reset, domain: fe.cookieDomainFor(r)}, r.WithContext(ctx))
+	}
+}
+
+// forceTraceHeader requests that the trace of a request be sampled, for
+// debugging. It is only honored when ALLOW_FORCE_TRACE is set.
+const forceTraceHeader = "X-Force-Trace"
+
+// traceStartOptions returns the span options of a request for
+// ochttp.Handler. If allowForce is set, requests with a true X-Force-Trace
+// header are sampled regardless of the configured sampler.
+func traceStartOptions(allowForce bool) func(*http.Request) trace.StartOptions {
+	return func(r *http.Request) trace.StartOptions {
+		if allowForce {
+			if force, _ := strconv.ParseBool(r.Header.Get(forceTraceHeader)); force {
+				return trace.StartOptions{Sampler: trace.AlwaysSample()}
+			}
+		}
+		return trace.StartOptions{}
+	}
+}
+
+// unlimitedPaths serve probes and scrapes. They are exempt from the
+// concurrency limit and the canonical host redirect, so that they keep
+// working under overload and whatever host they are addressed by.
+var unlimitedPaths = map[string]bool{
+	"/_healthz": true,
+	"/readyz":   true,
+	"/metrics":  true,
+}
+
+// limitConcurrency sheds requests with 503 once max requests are in flight,
+// rather than queueing unbounded work. A non-positive max disables the
+// limit.
+func limitConcurrency(max int, next http.Handler) http.Handler {
+	if max <= 0 {
+		return next
+	}
+	sem := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimitedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server overloaded, please retry", http.StatusServiceUnavailable)
+		}
+	})
+}
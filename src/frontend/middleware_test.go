@@ -0,0 +1,363 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+)
+
+// newBufferLogger returns a JSON logger at debug level writing to buf.
+func newBufferLogger(buf *bytes.Buffer) *logrus.Logger {
+	log := logrus.New()
+	log.Level = logrus.DebugLevel
+	log.Formatter = &logrus.JSONFormatter{}
+	log.Out = buf
+	return log
+}
+
+// logEntries decodes the JSON log lines written to buf.
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var out []map[string]interface{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var e map[string]interface{}
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+var noopHandler = http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+
+func TestEnsureSessionID_cookieDomain(t *testing.T) {
+	tests := []struct {
+		name       string
+		domain     string
+		host       string
+		wantDomain string
+	}{
+		{"unset", "", "www.example.com", ""},
+		{"subdomain", "example.com", "www.example.com:8080", "example.com"},
+		{"apex", "example.com", "example.com", "example.com"},
+		{"not a parent", "example.com", "www.example.org", ""},
+		{"suffix but not a parent", "example.com", "badexample.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe := &frontendServer{cookieDomain: tt.domain}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			fe.ensureSessionID(noopHandler).ServeHTTP(w, r)
+
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != cookieSessionID {
+				t.Fatalf("got cookies %v, want a single %s cookie", cookies, cookieSessionID)
+			}
+			if got := cookies[0].Domain; got != tt.wantDomain {
+				t.Errorf("cookie domain = %q, want %q", got, tt.wantDomain)
+			}
+			if hasDomain := strings.Contains(w.Header().Get("Set-Cookie"), "Domain="); hasDomain != (tt.wantDomain != "") {
+				t.Errorf("Set-Cookie = %q, want Domain attribute: %v", w.Header().Get("Set-Cookie"), tt.wantDomain != "")
+			}
+		})
+	}
+}
+
+func TestEnsureCurrency(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie string
+		want   string
+	}{
+		{"default", "", defaultCurrency},
+		{"from cookie", "EUR", "EUR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			var handlerCurrency string
+			h := (&frontendServer{}).ensureCurrency(&logHandler{log: newBufferLogger(&buf), next: http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				handlerCurrency = currentCurrency(r)
+			})})
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: tt.cookie})
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if handlerCurrency != tt.want {
+				t.Errorf("currentCurrency() = %q, want %q", handlerCurrency, tt.want)
+			}
+			entries := logEntries(t, &buf)
+			if len(entries) == 0 {
+				t.Fatal("nothing was logged")
+			}
+			for _, e := range entries {
+				if e["currency"] != tt.want {
+					t.Errorf("log entry %q has currency %v, want %q", e["msg"], e["currency"], tt.want)
+				}
+			}
+		})
+	}
+}
+
+type recordingExporter struct{ spans []*trace.SpanData }
+
+func (e *recordingExporter) ExportSpan(s *trace.SpanData) { e.spans = append(e.spans, s) }
+
+func TestEnsureCurrency_spanAttribute(t *testing.T) {
+	exp := &recordingExporter{}
+	trace.RegisterExporter(exp)
+	defer trace.UnregisterExporter(exp)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx, span := trace.StartSpan(r.Context(), "test", trace.WithSampler(trace.AlwaysSample()))
+	(&frontendServer{}).ensureCurrency(noopHandler).ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+	span.End()
+
+	if len(exp.spans) != 1 {
+		t.Fatalf("exported %d spans, want 1", len(exp.spans))
+	}
+	if got := exp.spans[0].Attributes["currency"]; got != defaultCurrency {
+		t.Errorf("span currency attribute = %v, want %q", got, defaultCurrency)
+	}
+}
+
+func TestTraceStartOptions_forceTrace(t *testing.T) {
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.NeverSample()})
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+
+	tests := []struct {
+		name   string
+		allow  bool
+		header string
+		want   bool
+	}{
+		{"forced", true, "true", true},
+		{"not allowed", false, "true", false},
+		{"no header", true, "", false},
+		{"false header", true, "false", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sampled bool
+			h := &ochttp.Handler{
+				Handler: http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+					sampled = trace.FromContext(r.Context()).SpanContext().IsSampled()
+				}),
+				GetStartOptions: traceStartOptions(tt.allow),
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set(forceTraceHeader, tt.header)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			if sampled != tt.want {
+				t.Errorf("sampled = %v, want %v", sampled, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogHandler_countsDownstreamCalls(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	var buf bytes.Buffer
+	h := &logHandler{log: newBufferLogger(&buf), next: newHTTPMetrics().instrument("home-fanout", "/", http.HandlerFunc(fe.homeHandler))}
+	h.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/", nil))
+
+	fb.mu.Lock()
+	calls := 0
+	for _, n := range fb.calls {
+		calls += n
+	}
+	fb.mu.Unlock()
+	if calls == 0 {
+		t.Fatal("home page made no downstream calls")
+	}
+	entries := logEntries(t, &buf)
+	if got := entries[len(entries)-1]["http.resp.downstream_calls"]; got != float64(calls) {
+		t.Errorf("logged downstream_calls = %v, want %d", got, calls)
+	}
+	var m dto.Metric
+	if err := downstreamCallsPerRequest.WithLabelValues("home-fanout").(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetHistogram().GetSampleSum(); got != float64(calls) {
+		t.Errorf("frontend_downstream_calls_per_request sum = %v, want %d", got, calls)
+	}
+}
+
+func TestLogHandler_slowRequest(t *testing.T) {
+	slow := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		requestTimingFrom(r.Context()).addDownstream("/hipstershop.CartService/GetCart", 15*time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+	})
+	before := testutil.ToFloat64(slowRequests.WithLabelValues("slow-handler"))
+
+	var buf bytes.Buffer
+	h := &logHandler{log: newBufferLogger(&buf), next: newHTTPMetrics().instrument("slow-handler", "/", slow), slowThreshold: 10 * time.Millisecond}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	entries := logEntries(t, &buf)
+	last := entries[len(entries)-1]
+	if last["level"] != "warning" || last["msg"] != "slow request" {
+		t.Fatalf("last log entry = %v, want a \"slow request\" warning", last)
+	}
+	if last["handler"] != "slow-handler" {
+		t.Errorf("handler = %v, want slow-handler", last["handler"])
+	}
+	downstream, _ := last["http.resp.downstream_ms"].(map[string]interface{})
+	if downstream["/hipstershop.CartService/GetCart"] != float64(15) {
+		t.Errorf("downstream_ms = %v, want 15ms for GetCart", last["http.resp.downstream_ms"])
+	}
+	if got := testutil.ToFloat64(slowRequests.WithLabelValues("slow-handler")); got != before+1 {
+		t.Errorf("frontend_slow_requests_total = %v, want %v", got, before+1)
+	}
+}
+
+func TestLogHandler_fastRequest(t *testing.T) {
+	var buf bytes.Buffer
+	h := &logHandler{log: newBufferLogger(&buf), next: noopHandler, slowThreshold: time.Minute}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	for _, e := range logEntries(t, &buf) {
+		if e["level"] != "debug" {
+			t.Errorf("unexpected %v log entry for a fast request: %v", e["level"], e)
+		}
+	}
+}
+
+func TestLogHandler_sampling(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   bool
+	}{
+		{"success", http.StatusOK, false},
+		{"client error", http.StatusNotFound, true},
+		{"server error", http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			h := &logHandler{log: newBufferLogger(&buf), dropRate: 1, next: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tt.status)
+			})}
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+			var logged bool
+			for _, e := range logEntries(t, &buf) {
+				logged = logged || e["msg"] == "request complete" && e["http.resp.status"] == float64(tt.status)
+			}
+			if logged != tt.want {
+				t.Errorf("request with status %d logged = %v when sampling none, want %v", tt.status, logged, tt.want)
+			}
+		})
+	}
+}
+
+func TestConstantFields(t *testing.T) {
+	setenv(t, "ENVIRONMENT", "staging")
+	var buf bytes.Buffer
+	log := newBufferLogger(&buf)
+	log.AddHook(constantFields{"environment": deploymentEnvironment()})
+
+	h := &logHandler{log: log, next: http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger).Info("from a handler")
+	})}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	log.Warn("at startup")
+
+	entries := logEntries(t, &buf)
+	if len(entries) == 0 {
+		t.Fatal("no log entries")
+	}
+	for _, e := range entries {
+		if e["environment"] != "staging" {
+			t.Errorf("entry %q has environment %v, want staging", e["msg"], e["environment"])
+		}
+	}
+}
+
+func TestDeploymentEnvironment_default(t *testing.T) {
+	unsetenv(t, "ENVIRONMENT")
+	if got := deploymentEnvironment(); got != "unknown" {
+		t.Errorf("deploymentEnvironment() = %q, want \"unknown\"", got)
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	entered, release := make(chan struct{}, 2), make(chan struct{})
+	h := limitConcurrency(2, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+		<-entered
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("request over the limit = %d (Retry-After %q), want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Probes are exempt; this one is let through and blocks like the others.
+	probe := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		probe <- w.Code
+	}()
+	<-entered
+
+	close(release)
+	wg.Wait()
+	if code := <-probe; code != http.StatusOK {
+		t.Errorf("/readyz over the limit = %d, want 200", code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("request after the load dropped = %d, want 200", w.Code)
+	}
+}
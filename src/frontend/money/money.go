@@ -16,6 +16,7 @@ package money
 
 import (
 	"errors"
+	"math/big"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
 )
@@ -29,6 +30,23 @@ const (
 var (
 	ErrInvalidValue        = errors.New("one of the specified money values is invalid")
 	ErrMismatchingCurrency = errors.New("mismatching currency codes")
+	ErrInvalidRoundingMode = errors.New("invalid rounding mode")
+)
+
+// RoundingMode specifies how Round adjusts a value to a multiple of a
+// granularity.
+type RoundingMode int
+
+const (
+	// RoundNone leaves values unchanged.
+	RoundNone RoundingMode = iota
+	// RoundNearest rounds to the nearest multiple, with halves rounded away
+	// from zero.
+	RoundNearest
+	// RoundUp rounds towards positive infinity.
+	RoundUp
+	// RoundDown rounds towards negative infinity.
+	RoundDown
 )
 
 // IsValid checks if specified value has a valid units/nanos signs and ranges.
@@ -130,3 +148,73 @@ func MultiplySlow(m pb.Money, n uint32) pb.Money {
 	}
 	return out
 }
+
+// ParseRoundingMode parses one of "none", "nearest", "up" or "down". An empty
+// string is treated as "none".
+func ParseRoundingMode(s string) (RoundingMode, error) {
+	switch s {
+	case "", "none":
+		return RoundNone, nil
+	case "nearest":
+		return RoundNearest, nil
+	case "up":
+		return RoundUp, nil
+	case "down":
+		return RoundDown, nil
+	}
+	return RoundNone, ErrInvalidRoundingMode
+}
+
+// Round rounds m to a multiple of granularity, expressed in nanos (e.g.
+// 10000000 for a cent), using the given mode. The value is returned unchanged
+// for RoundNone or a non-positive granularity.
+func Round(m pb.Money, mode RoundingMode, granularity int64) pb.Money {
+	if mode == RoundNone || granularity <= 0 {
+		return m
+	}
+	total := totalNanos(m)
+
+	g := big.NewInt(granularity)
+	q, r := new(big.Int).QuoRem(total, g, new(big.Int)) // truncates towards zero
+	switch mode {
+	case RoundUp:
+		if r.Sign() > 0 {
+			q.Add(q, big.NewInt(1))
+		}
+	case RoundDown:
+		if r.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		}
+	case RoundNearest:
+		if new(big.Int).Mul(new(big.Int).Abs(r), big.NewInt(2)).Cmp(g) >= 0 {
+			q.Add(q, big.NewInt(int64(r.Sign())))
+		}
+	}
+	return fromTotalNanos(total.Mul(q, g), m.GetCurrencyCode())
+}
+
+// MultiplyRat multiplies m by the rational factor f (e.g. a tax rate of
+// 0.0825), rounding to the nearest nano with halves rounded away from zero.
+func MultiplyRat(m pb.Money, f *big.Rat) pb.Money {
+	p := new(big.Rat).Mul(new(big.Rat).SetInt(totalNanos(m)), f)
+	q, r := new(big.Int).QuoRem(p.Num(), p.Denom(), new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(r), big.NewInt(2)).Cmp(p.Denom()) >= 0 {
+		q.Add(q, big.NewInt(int64(r.Sign())))
+	}
+	return fromTotalNanos(q, m.GetCurrencyCode())
+}
+
+// totalNanos returns the value of m in nanos.
+func totalNanos(m pb.Money) *big.Int {
+	total := new(big.Int).Mul(big.NewInt(m.GetUnits()), big.NewInt(nanosMod))
+	return total.Add(total, big.NewInt(int64(m.GetNanos())))
+}
+
+// fromTotalNanos is the inverse of totalNanos.
+func fromTotalNanos(total *big.Int, currencyCode string) pb.Money {
+	units, nanos := new(big.Int).QuoRem(total, big.NewInt(nanosMod), new(big.Int))
+	return pb.Money{
+		Units:        units.Int64(),
+		Nanos:        int32(nanos.Int64()),
+		CurrencyCode: currencyCode}
+}
@@ -16,6 +16,7 @@ package money
 
 import (
 	"fmt"
+	"math/big"
 	"reflect"
 	"testing"
 
@@ -243,3 +244,103 @@ func TestSum(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRoundingMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    RoundingMode
+		wantErr error
+	}{
+		{"", RoundNone, nil},
+		{"none", RoundNone, nil},
+		{"nearest", RoundNearest, nil},
+		{"up", RoundUp, nil},
+		{"down", RoundDown, nil},
+		{"sideways", RoundNone, ErrInvalidRoundingMode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRoundingMode(tt.in)
+			if err != tt.wantErr {
+				t.Errorf("ParseRoundingMode(%q): expected err=\"%v\" got=\"%v\"", tt.in, tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseRoundingMode(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRound(t *testing.T) {
+	const (
+		cent   = 10000000
+		nickel = 50000000
+	)
+	type args struct {
+		m           pb.Money
+		mode        RoundingMode
+		granularity int64
+	}
+	tests := []struct {
+		name string
+		args args
+		want pb.Money
+	}{
+		{"none", args{mmc(1, 123456789, "EUR"), RoundNone, cent}, mmc(1, 123456789, "EUR")},
+		{"zero granularity", args{mm(1, 123456789), RoundNearest, 0}, mm(1, 123456789)},
+		{"nearest (down)", args{mm(1, 123456789), RoundNearest, cent}, mm(1, 120000000)},
+		{"nearest (up)", args{mm(1, 125000001), RoundNearest, cent}, mm(1, 130000000)},
+		{"nearest (half)", args{mm(1, 125000000), RoundNearest, cent}, mm(1, 130000000)},
+		{"nearest (carry)", args{mm(1, 996000000), RoundNearest, cent}, mm(2, 0)},
+		{"nearest (negative half)", args{mm(-1, -125000000), RoundNearest, cent}, mm(-1, -130000000)},
+		{"nearest (nickel)", args{mm(3, 420000000), RoundNearest, nickel}, mm(3, 400000000)},
+		{"up", args{mm(1, 120000001), RoundUp, cent}, mm(1, 130000000)},
+		{"up (exact)", args{mm(1, 120000000), RoundUp, cent}, mm(1, 120000000)},
+		{"up (negative)", args{mm(-1, -129999999), RoundUp, cent}, mm(-1, -120000000)},
+		{"up (whole units)", args{mm(101, 0), RoundUp, 10 * nanosMod}, mm(110, 0)},
+		{"down", args{mm(1, 129999999), RoundDown, cent}, mm(1, 120000000)},
+		{"down (exact)", args{mm(1, 120000000), RoundDown, cent}, mm(1, 120000000)},
+		{"down (negative)", args{mm(-1, -120000001), RoundDown, cent}, mm(-1, -130000000)},
+		{"down (to zero)", args{mm(0, 9999999), RoundDown, cent}, mm(0, 0)},
+		{"carries currency code", args{mmc(0, 1, "JPY"), RoundUp, nanosMod}, mmc(1, 0, "JPY")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Round(tt.args.m, tt.args.mode, tt.args.granularity)
+			if !AreEquals(got, tt.want) {
+				t.Errorf("Round([%v],%v,%d) = %v, want %v", tt.args.m, tt.args.mode, tt.args.granularity, got, tt.want)
+			}
+			if !IsValid(got) {
+				t.Errorf("Round([%v],%v,%d) = %v is not a valid value", tt.args.m, tt.args.mode, tt.args.granularity, got)
+			}
+		})
+	}
+}
+
+func TestMultiplyRat(t *testing.T) {
+	rat := func(s string) *big.Rat {
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			t.Fatalf("invalid rational %q", s)
+		}
+		return r
+	}
+	tests := []struct {
+		m    pb.Money
+		f    string
+		want pb.Money
+	}{
+		{mmc(100, 0, "USD"), "0.0825", mmc(8, 250000000, "USD")},
+		{mm(19, 990000000), "0.1", mm(1, 999000000)},
+		{mm(0, 3), "0.5", mm(0, 2)},   // half rounds away from zero
+		{mm(0, -3), "0.5", mm(0, -2)}, // likewise for negative values
+		{mm(1, 0), "1/3", mm(0, 333333333)},
+		{mm(12, 340000000), "0", mm(0, 0)},
+	}
+	for _, tt := range tests {
+		got := MultiplyRat(tt.m, rat(tt.f))
+		if !AreEquals(got, tt.want) || !IsValid(got) {
+			t.Errorf("MultiplyRat([%v],%s) = %v, want %v", tt.m, tt.f, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "github.com/sirupsen/logrus"
+
+// defaultMaxPageSize caps the page size of paginated views when
+// MAX_PAGE_SIZE is not set.
+const defaultMaxPageSize = 100
+
+// clampPageSize returns the page size a paginated view renders: the
+// requested size, or def if none was requested, capped at MAX_PAGE_SIZE
+// whatever the default, so that clients cannot make the frontend render
+// pages of any size. Requests above the cap are logged.
+func (fe *frontendServer) clampPageSize(log logrus.FieldLogger, requested, def int) int {
+	max := fe.maxPageSize
+	if max <= 0 {
+		max = defaultMaxPageSize
+	}
+	size := requested
+	if size <= 0 {
+		size = def
+	}
+	if size <= max {
+		return size
+	}
+	if requested > max {
+		log.WithFields(logrus.Fields{
+			"page_size":     requested,
+			"max_page_size": max}).Info("requested page size clamped")
+	}
+	return max
+}
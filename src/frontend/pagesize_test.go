@@ -0,0 +1,54 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestClampPageSize(t *testing.T) {
+	fe := &frontendServer{maxPageSize: 50}
+	tests := []struct {
+		name           string
+		requested, def int
+		want           int
+	}{
+		{"requested", 20, 10, 20},
+		{"default", 0, 10, 10},
+		{"oversized", 1000, 10, 50},
+		{"oversized default", 0, 80, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fe.clampPageSize(newBufferLogger(new(bytes.Buffer)), tt.requested, tt.def); got != tt.want {
+				t.Errorf("clampPageSize(%d, %d) = %d, want %d", tt.requested, tt.def, got, tt.want)
+			}
+		})
+	}
+	if got := (&frontendServer{}).clampPageSize(newBufferLogger(new(bytes.Buffer)), 1000, 10); got != defaultMaxPageSize {
+		t.Errorf("clampPageSize() without MAX_PAGE_SIZE = %d, want %d", got, defaultMaxPageSize)
+	}
+}
+
+func TestClampPageSize_logsClamping(t *testing.T) {
+	var buf bytes.Buffer
+	(&frontendServer{maxPageSize: 50}).clampPageSize(newBufferLogger(&buf), 1000, 10)
+
+	e := lastEntry(t, &buf, "requested page size clamped")
+	if e["page_size"] != float64(1000) || e["max_page_size"] != float64(50) {
+		t.Errorf("logged %v, want the requested and maximum page sizes", e)
+	}
+}
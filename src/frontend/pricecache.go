@@ -0,0 +1,142 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// priceCache keeps converted product prices by product and currency for a
+// short while, so that pages listing the catalog in a popular currency do
+// not convert every price on every load. There is no catalog cache to
+// invalidate it on refresh; instead entries remember the USD prices they
+// were converted from and are dropped once the catalog reports others.
+type priceCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu sync.Mutex
+	m  map[priceCacheKey]cachedPrice
+}
+
+type priceCacheKey struct {
+	productID, currency string
+}
+
+type cachedPrice struct {
+	source   string // USD prices converted, see priceSource
+	min, max *pb.Money
+	expires  time.Time
+}
+
+func newPriceCache(ttl time.Duration) *priceCache {
+	return &priceCache{ttl: ttl, now: time.Now, m: make(map[priceCacheKey]cachedPrice)}
+}
+
+// priceSource identifies the USD prices a cached price was converted from.
+func priceSource(prices []*pb.Money) string {
+	s := ""
+	for _, p := range prices {
+		s += fmt.Sprintf("%s %d.%09d;", p.GetCurrencyCode(), p.GetUnits(), p.GetNanos())
+	}
+	return s
+}
+
+func (c *priceCache) get(productID, currency, source string) (min, max *pb.Money, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[priceCacheKey{productID, currency}]
+	if !ok || e.source != source || !c.now().Before(e.expires) {
+		return nil, nil, false
+	}
+	return e.min, e.max, true
+}
+
+func (c *priceCache) put(productID, currency, source string, min, max *pb.Money) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[priceCacheKey{productID, currency}] = cachedPrice{source: source, min: min, max: max, expires: c.now().Add(c.ttl)}
+}
+
+type ctxKeyNoCache struct{}
+
+// honorNoCache lets clients bypass the price cache by requesting a page with
+// "Cache-Control: no-cache" (or "Pragma: no-cache"), as browsers do on a hard
+// reload. The prices are converted afresh and cached again. Such requests
+// are bounded like the others by the concurrency limit.
+func honorNoCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if noCacheRequested(r.Header) {
+			r = r.WithContext(context.WithValue(r.Context(), ctxKeyNoCache{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// noCacheRequested reports whether the request headers h carry the no-cache
+// directive.
+func noCacheRequested(h http.Header) bool {
+	directives := h.Values("Cache-Control")
+	if len(directives) == 0 {
+		directives = h.Values("Pragma")
+	}
+	for _, v := range directives {
+		for _, d := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(d), "no-cache") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cacheBypassed reports whether the request ctx belongs to asked not to be
+// served from the cache.
+func cacheBypassed(ctx context.Context) bool {
+	v, _ := ctx.Value(ctxKeyNoCache{}).(bool)
+	return v
+}
+
+// productPriceRange returns the price range of p in currency like
+// convertPriceRange, from the price cache when enabled and not bypassed by
+// the request.
+func (fe *frontendServer) productPriceRange(ctx context.Context, p *pb.Product, currency string) (min, max *pb.Money, err error) {
+	prices := fe.variantPrices(p)
+	if fe.priceCache == nil {
+		return fe.convertPriceRange(ctx, prices, currency)
+	}
+	source := priceSource(prices)
+	if !cacheBypassed(ctx) {
+		if min, max, ok := fe.priceCache.get(p.GetId(), currency, source); ok {
+			return min, max, nil
+		}
+	}
+	if min, max, err = fe.convertPriceRange(ctx, prices, currency); err != nil {
+		return nil, nil, err
+	}
+	// Prices fall back to the default currency if currency turns out to be
+	// unsupported, and those are not the prices in currency.
+	if min.GetCurrencyCode() == currency {
+		fe.priceCache.put(p.GetId(), currency, source, min, max)
+	}
+	return min, max, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestPriceCache(t *testing.T) {
+	fb := newFakeBackends()
+	now := time.Now()
+	cache := newPriceCache(time.Minute)
+	cache.now = func() time.Time { return now }
+	fe := newTestFrontend(t, &frontendServer{priceCache: cache}, fb)
+	ctx := context.Background()
+
+	// conversions returns the number of Convert calls made to list the
+	// catalog in currency.
+	conversions := func(currency string) int {
+		t.Helper()
+		before := fb.callCount("Convert")
+		views, err := fe.productViews(ctx, fb.products, currency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := views[0].Price.GetCurrencyCode(); got != currency {
+			t.Fatalf("price in %s, want %s", got, currency)
+		}
+		return fb.callCount("Convert") - before
+	}
+
+	if n := conversions("EUR"); n != 3 {
+		t.Errorf("first listing made %d conversions, want 3", n)
+	}
+	if n := conversions("EUR"); n != 0 {
+		t.Errorf("cached listing made %d conversions, want 0", n)
+	}
+	if n := conversions("JPY"); n != 3 {
+		t.Errorf("listing in another currency made %d conversions, want 3", n)
+	}
+
+	fb.products[0].PriceUsd = &pb.Money{CurrencyCode: "USD", Units: 24, Nanos: 990000000}
+	if n := conversions("EUR"); n != 1 {
+		t.Errorf("listing after a catalog price change made %d conversions, want 1", n)
+	}
+
+	now = now.Add(time.Minute)
+	if n := conversions("EUR"); n != 3 {
+		t.Errorf("listing after the TTL made %d conversions, want 3", n)
+	}
+}
+
+func TestPriceCache_disabled(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	for i := 0; i < 2; i++ {
+		if _, err := fe.productViews(context.Background(), fb.products, "EUR"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fb.callCount("Convert"); n != 6 {
+		t.Errorf("made %d conversions without a cache, want 6", n)
+	}
+}
+
+func TestPriceCache_noCache(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{priceCache: newPriceCache(time.Minute)}, fb)
+	h := honorNoCache(fe.ensureCurrency(http.HandlerFunc(fe.homeHandler)))
+
+	// home returns the body of the home page in EUR and the number of Convert
+	// calls made to render it.
+	home := func(header http.Header) (string, int) {
+		t.Helper()
+		before := fb.callCount("Convert")
+		r := newTestRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: cookieCurrency, Value: "EUR"})
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		return w.Body.String(), fb.callCount("Convert") - before
+	}
+
+	home(nil)
+	if _, n := home(nil); n != 0 {
+		t.Errorf("cached page made %d conversions, want 0", n)
+	}
+
+	fb.convert = func(req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+		return &pb.Money{CurrencyCode: req.GetToCode(), Units: 2 * req.GetFrom().GetUnits()}, nil
+	}
+	if body, n := home(http.Header{"Cache-Control": {"max-age=0, no-cache"}}); n != 3 || !strings.Contains(body, "EUR 38.00") {
+		t.Errorf("page requested with no-cache made %d conversions, want 3 with the fresh prices", n)
+	}
+	if body, n := home(nil); n != 0 || !strings.Contains(body, "EUR 38.00") {
+		t.Errorf("page after the bypass made %d conversions, want 0 with the fresh prices cached", n)
+	}
+}
+
+func TestNoCacheRequested(t *testing.T) {
+	for _, tt := range []struct {
+		header http.Header
+		want   bool
+	}{
+		{http.Header{}, false},
+		{http.Header{"Cache-Control": {"max-age=0"}}, false},
+		{http.Header{"Cache-Control": {"max-age=0, No-Cache"}}, true},
+		{http.Header{"Pragma": {"no-cache"}}, true},
+		{http.Header{"Cache-Control": {"max-age=0"}, "Pragma": {"no-cache"}}, false},
+	} {
+		if got := noCacheRequested(tt.header); got != tt.want {
+			t.Errorf("noCacheRequested(%v) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
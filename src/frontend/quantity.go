@@ -0,0 +1,82 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// standardQuantities are the quantities offered on the product page, along
+// with the default.
+var standardQuantities = []int{1, 2, 3, 4, 5, 10}
+
+// parseMinQuantities parses comma-separated "productID=quantity" pairs,
+// e.g. "OLJCESPC7Z=2,66VCHSJNUP=5". The catalog has no metadata for order
+// minimums, so they are configured alongside it.
+func parseMinQuantities(s string) (map[string]int, error) {
+	mins := make(map[string]int)
+	for _, kv := range splitList(s) {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid minimum quantity entry %q, want productID=quantity", kv)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[i+1:]))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid minimum quantity %q for product %q", kv[i+1:], kv[:i])
+		}
+		mins[strings.TrimSpace(kv[:i])] = n
+	}
+	return mins, nil
+}
+
+// minQuantity returns the smallest quantity of the product that can be added
+// to the cart.
+func (fe *frontendServer) minQuantity(productID string) int {
+	if n, ok := fe.minQuantities[productID]; ok {
+		return n
+	}
+	return 1
+}
+
+// defaultQuantity returns the quantity added to the cart when none is given,
+// DEFAULT_ADD_QUANTITY raised to the product minimum if needed.
+func (fe *frontendServer) defaultQuantity(productID string) int {
+	n := fe.defaultAddQuantity
+	if n <= 0 {
+		n = 1
+	}
+	if min := fe.minQuantity(productID); n < min {
+		n = min
+	}
+	return n
+}
+
+// quantityOptions returns the quantities offered for the product, in
+// increasing order: the standard ones allowed by its minimum and the
+// default.
+func (fe *frontendServer) quantityOptions(productID string) []int {
+	min, def := fe.minQuantity(productID), fe.defaultQuantity(productID)
+	out := []int{def}
+	for _, n := range standardQuantities {
+		if n >= min && n != def {
+			out = append(out, n)
+		}
+	}
+	sort.Ints(out)
+	return out
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMinQuantities(t *testing.T) {
+	got, err := parseMinQuantities("OLJCESPC7Z=2, 66VCHSJNUP = 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"OLJCESPC7Z": 2, "66VCHSJNUP": 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMinQuantities() = %v, want %v", got, want)
+	}
+	for _, s := range []string{"OLJCESPC7Z", "OLJCESPC7Z=0", "OLJCESPC7Z=two"} {
+		if _, err := parseMinQuantities(s); err == nil {
+			t.Errorf("parseMinQuantities(%q) = nil error", s)
+		}
+	}
+}
+
+func TestQuantityOptions(t *testing.T) {
+	fe := &frontendServer{defaultAddQuantity: 2, minQuantities: map[string]int{"66VCHSJNUP": 3, "1YMWWN1N4O": 6}}
+	tests := map[string][]int{
+		"OLJCESPC7Z": {1, 2, 3, 4, 5, 10},
+		"66VCHSJNUP": {3, 4, 5, 10},
+		"1YMWWN1N4O": {6, 10},
+	}
+	for id, want := range tests {
+		if got := fe.quantityOptions(id); !reflect.DeepEqual(got, want) {
+			t.Errorf("quantityOptions(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestAddToCartHandler_quantities(t *testing.T) {
+	tests := []struct {
+		name     string
+		form     string
+		wantCode int
+		wantQty  int32
+	}{
+		{"default applied", "product_id=OLJCESPC7Z", http.StatusFound, 2},
+		{"default raised to minimum", "product_id=66VCHSJNUP", http.StatusFound, 3},
+		{"explicit quantity", "product_id=OLJCESPC7Z&quantity=1", http.StatusFound, 1},
+		{"at minimum", "product_id=66VCHSJNUP&quantity=3", http.StatusFound, 3},
+		{"below minimum", "product_id=66VCHSJNUP&quantity=2", http.StatusBadRequest, 0},
+		{"zero", "product_id=OLJCESPC7Z&quantity=0", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFakeBackends()
+			fe := newTestFrontend(t, &frontendServer{defaultAddQuantity: 2, minQuantities: map[string]int{"66VCHSJNUP": 3}}, fb)
+
+			w := httptest.NewRecorder()
+			fe.addToCartHandler(w, newTestRequest(http.MethodPost, "/cart", strings.NewReader(tt.form)))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			var got int32
+			for _, item := range fb.carts[testSessionID] {
+				got += item.GetQuantity()
+			}
+			if got != tt.wantQty {
+				t.Errorf("quantity in cart = %d, want %d", got, tt.wantQty)
+			}
+		})
+	}
+}
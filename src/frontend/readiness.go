@@ -0,0 +1,178 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/connectivity"
+)
+
+// connStateReporter is implemented by *grpc.ClientConn.
+type connStateReporter interface {
+	GetState() connectivity.State
+}
+
+// reconnector is implemented by *grpc.ClientConn. This version of grpc-go
+// has no ClientConn.Connect; resetting the backoff makes failing
+// subchannels retry immediately instead.
+type reconnector interface {
+	connStateReporter
+	ResetConnectBackoff()
+}
+
+// dependency is a downstream service considered by the readiness check.
+// Critical dependencies are the ones no page can be rendered without.
+type dependency struct {
+	name     string
+	conn     connStateReporter
+	critical bool
+}
+
+// isDown reports whether the connection is failing. Idle and connecting
+// connections are not considered down since they connect lazily.
+func (d dependency) isDown() bool {
+	s := d.conn.GetState()
+	return s == connectivity.TransientFailure || s == connectivity.Shutdown
+}
+
+// criticalDependenciesDown returns the names of the critical dependencies
+// that are currently down.
+func (fe *frontendServer) criticalDependenciesDown() []string {
+	var out []string
+	for _, d := range fe.dependencies {
+		if d.critical && d.isDown() {
+			out = append(out, d.name)
+		}
+	}
+	return out
+}
+
+// readinessHandler reports 503 during the grace period at startup, which
+// gives lazily connecting dependencies time to connect, then while any
+// critical dependency is down.
+func (fe *frontendServer) readinessHandler(w http.ResponseWriter, _ *http.Request) {
+	if time.Now().Before(fe.readyAfter) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "starting")
+		return
+	}
+	if down := fe.criticalDependenciesDown(); len(down) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "unavailable: %s", strings.Join(down, ","))
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// degradeOnOutage serves a static "store temporarily unavailable" page
+// instead of attempting a full render while the readiness check reports
+// critical dependencies down.
+func (fe *frontendServer) degradeOnOutage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		down := fe.criticalDependenciesDown()
+		if len(down) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+		log.WithField("dependencies", down).Warn("critical dependencies down, serving degraded page")
+
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if err := renderTemplate(w, "unavailable", map[string]interface{}{
+			"session_id": sessionID(r),
+			"request_id": r.Context().Value(ctxKeyRequestID{}),
+		}); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// watchConnections checks the state of every dependency each interval until
+// ctx is done, keeping connections warm for bursts after quiet periods.
+func (fe *frontendServer) watchConnections(ctx context.Context, log logrus.FieldLogger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := make(map[string]connectivity.State)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fe.checkConnections(log, last)
+		}
+	}
+}
+
+// checkConnections logs the state transitions since the states recorded in
+// last, which it updates, and asks idle or failing connections to
+// reconnect.
+func (fe *frontendServer) checkConnections(log logrus.FieldLogger, last map[string]connectivity.State) {
+	for _, d := range fe.dependencies {
+		s := d.conn.GetState()
+		if prev, ok := last[d.name]; ok && prev != s {
+			log.WithFields(logrus.Fields{
+				"dependency": d.name,
+				"from":       prev.String(),
+				"to":         s.String()}).Info("connection state changed")
+		}
+		last[d.name] = s
+		if s != connectivity.TransientFailure && s != connectivity.Idle {
+			continue
+		}
+		if r, ok := d.conn.(reconnector); ok {
+			log.WithField("dependency", d.name).WithField("state", s.String()).Debug("reconnecting")
+			r.ResetConnectBackoff()
+		}
+	}
+}
+
+// waitForDependencies polls the critical dependencies each interval until
+// they are all ready, asking failing ones to reconnect in between. It returns
+// an error naming those still not ready once timeout has elapsed. Other
+// dependencies do not hold up startup.
+func (fe *frontendServer) waitForDependencies(ctx context.Context, log logrus.FieldLogger, timeout, interval time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var pending []string
+		for _, d := range fe.dependencies {
+			if !d.critical || d.conn.GetState() == connectivity.Ready {
+				continue
+			}
+			pending = append(pending, d.name)
+			if r, ok := d.conn.(reconnector); ok {
+				r.ResetConnectBackoff()
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("dependencies not ready after %v: %s", timeout, strings.Join(pending, ","))
+		case <-ticker.C:
+			log.WithField("dependencies", pending).Debug("waiting for dependencies")
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+type fakeConnState connectivity.State
+
+func (s fakeConnState) GetState() connectivity.State { return connectivity.State(s) }
+
+func TestDegradeOnOutage(t *testing.T) {
+	tests := []struct {
+		name         string
+		deps         []dependency
+		wantDegraded bool
+	}{
+		{"all ready", []dependency{
+			{name: "productcatalogservice", conn: fakeConnState(connectivity.Ready), critical: true},
+			{name: "adservice", conn: fakeConnState(connectivity.Ready)},
+		}, false},
+		{"idle is not down", []dependency{
+			{name: "productcatalogservice", conn: fakeConnState(connectivity.Idle), critical: true},
+		}, false},
+		{"non-critical down", []dependency{
+			{name: "productcatalogservice", conn: fakeConnState(connectivity.Ready), critical: true},
+			{name: "adservice", conn: fakeConnState(connectivity.TransientFailure)},
+		}, false},
+		{"critical down", []dependency{
+			{name: "productcatalogservice", conn: fakeConnState(connectivity.TransientFailure), critical: true},
+			{name: "adservice", conn: fakeConnState(connectivity.Ready)},
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe := &frontendServer{dependencies: tt.deps}
+			called := false
+			h := fe.degradeOnOutage(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true }))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newTestRequest(http.MethodGet, "/", nil))
+
+			if called == tt.wantDegraded {
+				t.Errorf("next handler called = %v, want %v", called, !tt.wantDegraded)
+			}
+			if !tt.wantDegraded {
+				return
+			}
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+			}
+			if !strings.Contains(w.Body.String(), "Store temporarily unavailable") {
+				t.Errorf("body does not contain the degraded page: %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	fe := &frontendServer{dependencies: []dependency{
+		{name: "cartservice", conn: fakeConnState(connectivity.Shutdown), critical: true},
+	}}
+	w := httptest.NewRecorder()
+	fe.readinessHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "cartservice") {
+		t.Errorf("got %d %q, want 503 naming cartservice", w.Code, w.Body.String())
+	}
+}
+
+func TestReadinessHandler_initialDelay(t *testing.T) {
+	fe := &frontendServer{
+		dependencies: []dependency{{name: "cartservice", conn: fakeConnState(connectivity.Ready), critical: true}},
+		readyAfter:   time.Now().Add(time.Hour),
+	}
+	w := httptest.NewRecorder()
+	fe.readinessHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "starting" {
+		t.Errorf("during the grace period got %d %q, want 503 \"starting\"", w.Code, w.Body.String())
+	}
+
+	fe.readyAfter = time.Now().Add(-time.Second)
+	w = httptest.NewRecorder()
+	fe.readinessHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("after the grace period got %d %q, want 200 with the dependencies ready", w.Code, w.Body.String())
+	}
+
+	fe.dependencies[0].conn = fakeConnState(connectivity.TransientFailure)
+	w = httptest.NewRecorder()
+	fe.readinessHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "cartservice") {
+		t.Errorf("after the grace period got %d %q, want 503 naming cartservice", w.Code, w.Body.String())
+	}
+}
+
+// fakeConn is a connection whose state can be changed and that records
+// reconnect attempts.
+type fakeConn struct {
+	state      connectivity.State
+	reconnects int
+}
+
+func (c *fakeConn) GetState() connectivity.State { return c.state }
+
+func (c *fakeConn) ResetConnectBackoff() { c.reconnects++ }
+
+func TestCheckConnections(t *testing.T) {
+	cart := &fakeConn{state: connectivity.Ready}
+	ads := &fakeConn{state: connectivity.Idle}
+	fe := &frontendServer{dependencies: []dependency{
+		{name: "cartservice", conn: cart, critical: true},
+		{name: "adservice", conn: ads},
+	}}
+	var buf bytes.Buffer
+	log := newBufferLogger(&buf)
+	last := make(map[string]connectivity.State)
+
+	fe.checkConnections(log, last)
+	if cart.reconnects != 0 || ads.reconnects != 1 {
+		t.Errorf("reconnects = cart %d, ads %d, want 0, 1", cart.reconnects, ads.reconnects)
+	}
+
+	cart.state = connectivity.TransientFailure
+	ads.state = connectivity.Ready
+	fe.checkConnections(log, last)
+	if cart.reconnects != 1 || ads.reconnects != 1 {
+		t.Errorf("reconnects = cart %d, ads %d, want 1, 1", cart.reconnects, ads.reconnects)
+	}
+
+	var transitions []string
+	for _, e := range logEntries(t, &buf) {
+		if e["msg"] == "connection state changed" {
+			transitions = append(transitions, fmt.Sprintf("%v:%v->%v", e["dependency"], e["from"], e["to"]))
+		}
+	}
+	want := []string{"cartservice:READY->TRANSIENT_FAILURE", "adservice:IDLE->READY"}
+	if !reflect.DeepEqual(transitions, want) {
+		t.Errorf("logged transitions %v, want %v", transitions, want)
+	}
+}
+
+// recoveringConn is a connection that becomes ready after a number of state
+// checks.
+type recoveringConn struct {
+	fakeConn
+	checks, readyAfter int
+}
+
+func (c *recoveringConn) GetState() connectivity.State {
+	c.checks++
+	if c.checks > c.readyAfter {
+		return connectivity.Ready
+	}
+	return connectivity.TransientFailure
+}
+
+func TestWaitForDependencies(t *testing.T) {
+	cart := &recoveringConn{readyAfter: 2}
+	ads := &fakeConn{state: connectivity.TransientFailure}
+	fe := &frontendServer{dependencies: []dependency{
+		{name: "cartservice", conn: cart, critical: true},
+		{name: "adservice", conn: ads},
+	}}
+
+	if err := fe.waitForDependencies(context.Background(), newBufferLogger(&bytes.Buffer{}), time.Second, time.Millisecond); err != nil {
+		t.Fatalf("waitForDependencies() = %v", err)
+	}
+	if cart.checks != 3 {
+		t.Errorf("cartservice checked %d times, want 3 (until ready)", cart.checks)
+	}
+	if cart.reconnects != 2 {
+		t.Errorf("cartservice reconnects = %d, want 2", cart.reconnects)
+	}
+	if ads.reconnects != 0 {
+		t.Errorf("non-critical adservice reconnects = %d, want 0", ads.reconnects)
+	}
+}
+
+func TestWaitForDependencies_timeout(t *testing.T) {
+	fe := &frontendServer{dependencies: []dependency{
+		{name: "cartservice", conn: &fakeConn{state: connectivity.Ready}, critical: true},
+		{name: "currencyservice", conn: &fakeConn{state: connectivity.Connecting}, critical: true},
+	}}
+
+	err := fe.waitForDependencies(context.Background(), newBufferLogger(&bytes.Buffer{}), 20*time.Millisecond, time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "currencyservice") || strings.Contains(err.Error(), "cartservice") {
+		t.Errorf("waitForDependencies() = %v, want an error naming only currencyservice", err)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// readOnlyGuard responds 403 with an explanation instead of calling next
+// when the store is in read-only mode, for the handlers that change carts
+// or place orders.
+func (fe *frontendServer) readOnlyGuard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !fe.readOnly {
+			next(w, r)
+			return
+		}
+		log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+		log.Info("rejected a change in read-only mode")
+		w.WriteHeader(http.StatusForbidden)
+		if err := renderTemplate(w, "read_only", map[string]interface{}{
+			"session_id": sessionID(r),
+			"request_id": r.Context().Value(ctxKeyRequestID{}),
+		}); err != nil {
+			log.Println(err)
+		}
+	}
+}
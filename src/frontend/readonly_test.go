@@ -0,0 +1,92 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestReadOnlyGuard_blocksMutations(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{readOnly: true, stock: map[string]int{"OLJCESPC7Z": 0}, restockSignups: &memoryRestockSignups{}}, fb)
+
+	tests := []struct {
+		target  string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"/cart", fe.addToCartHandler, "product_id=OLJCESPC7Z&quantity=1"},
+		{"/cart/empty", fe.emptyCartHandler, ""},
+		{"/cart/checkout", fe.placeOrderHandler, testCheckoutForm},
+		{"/cart/checkout/review", fe.reviewOrderHandler, testCheckoutForm},
+		{"/product/OLJCESPC7Z/notify", fe.notifyRestockHandler, "email=someone@example.com"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		fe.readOnlyGuard(tt.handler)(w, newTestRequest(http.MethodPost, tt.target, strings.NewReader(tt.body)))
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Browsing only") {
+			t.Errorf("POST %s: status = %d, want %d with the read-only page", tt.target, w.Code, http.StatusForbidden)
+		}
+	}
+	for _, m := range []string{"AddItem", "EmptyCart", "PlaceOrder"} {
+		if n := fb.callCount(m); n != 0 {
+			t.Errorf("%s called %d times in read-only mode, want 0", m, n)
+		}
+	}
+	if signups := fe.restockSignups.(*memoryRestockSignups); len(signups.m) != 0 {
+		t.Errorf("recorded restock signups %v in read-only mode, want none", signups.m)
+	}
+}
+
+func TestReadOnlyGuard_allowsMutationsWhenOff(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	w := httptest.NewRecorder()
+	fe.readOnlyGuard(fe.addToCartHandler)(w, newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity=1")))
+
+	if w.Code != http.StatusFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusFound)
+	}
+	if n := fb.callCount("AddItem"); n != 1 {
+		t.Errorf("AddItem called %d times, want 1", n)
+	}
+}
+
+func TestReadOnlyMode_hidesButtons(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 1}}
+	fe := newTestFrontend(t, &frontendServer{readOnly: true}, fb)
+
+	w := httptest.NewRecorder()
+	fe.productHandler(w, mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"}))
+	if body := w.Body.String(); w.Code != http.StatusOK || strings.Contains(body, "Add to Cart") {
+		t.Errorf("product page: status = %d, want %d without the add to cart button", w.Code, http.StatusOK)
+	}
+
+	w = httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+	if body := w.Body.String(); w.Code != http.StatusOK || strings.Contains(body, "Place order") || strings.Contains(body, "Empty cart") {
+		t.Errorf("cart page: status = %d, want %d without the checkout and empty cart buttons", w.Code, http.StatusOK)
+	}
+}
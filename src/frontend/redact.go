@@ -0,0 +1,91 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultRedactedFields are the log fields masked unless LOG_REDACT_FIELDS
+// says otherwise: the payment details and email of checkout forms.
+var defaultRedactedFields = []string{"credit_card_number", "credit_card_cvv", "email"}
+
+// redactedMask replaces the values of redacted fields.
+const redactedMask = "[REDACTED]"
+
+// redactFields is a logrus hook masking the fields it holds, keyed by
+// lowercase name, wherever they are logged. Card numbers keep their last
+// four digits, for debugging.
+type redactFields map[string]bool
+
+// newRedactFields returns the hook for the given field names.
+func newRedactFields(names []string) redactFields {
+	f := make(redactFields, len(names))
+	for _, n := range names {
+		f[strings.ToLower(n)] = true
+	}
+	return f
+}
+
+func (f redactFields) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (f redactFields) Fire(e *logrus.Entry) error {
+	var data logrus.Fields
+	for k, v := range e.Data {
+		if !f[strings.ToLower(k)] {
+			continue
+		}
+		if data == nil {
+			// The fields may be shared with the logger the entry came from,
+			// so they are copied rather than masked in place.
+			data = make(logrus.Fields, len(e.Data))
+			for k, v := range e.Data {
+				data[k] = v
+			}
+		}
+		data[k] = redact(k, v)
+	}
+	if data != nil {
+		e.Data = data
+	}
+	return nil
+}
+
+// redact returns the masked value of the field named k.
+func redact(k string, v interface{}) string {
+	if strings.Contains(strings.ToLower(k), "card_number") {
+		if last4 := lastDigits(fmt.Sprint(v), 4); last4 != "" {
+			return "************" + last4
+		}
+	}
+	return redactedMask
+}
+
+// lastDigits returns the last n digits of s, ignoring any other character.
+func lastDigits(s string, n int) string {
+	d := strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, s)
+	if len(d) > n {
+		d = d[len(d)-n:]
+	}
+	return d
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedactFields(t *testing.T) {
+	var buf bytes.Buffer
+	log := newBufferLogger(&buf)
+	log.AddHook(newRedactFields(defaultRedactedFields))
+
+	clog := log.WithFields(logrus.Fields{
+		"credit_card_number": "4432-8015-6152-0454",
+		"Credit_Card_CVV":    672,
+		"email":              "someone@example.com",
+		"session":            "abc",
+	})
+	clog.Error("checkout failed")
+	clog.Info("again")
+
+	entries := logEntries(t, &buf)
+	if len(entries) != 2 {
+		t.Fatalf("got %d log entries, want 2", len(entries))
+	}
+	for _, e := range entries {
+		want := map[string]interface{}{
+			"credit_card_number": "************0454",
+			"Credit_Card_CVV":    redactedMask,
+			"email":              redactedMask,
+			"session":            "abc",
+		}
+		for k, v := range want {
+			if e[k] != v {
+				t.Errorf("%q logged %s = %v, want %v", e["msg"], k, e[k], v)
+			}
+		}
+	}
+}
+
+func TestRedactFields_configured(t *testing.T) {
+	var buf bytes.Buffer
+	log := newBufferLogger(&buf)
+	log.AddHook(newRedactFields([]string{"zip_code"}))
+
+	log.WithFields(logrus.Fields{"zip_code": "94043", "email": "someone@example.com"}).Info("order")
+
+	e := logEntries(t, &buf)[0]
+	if e["zip_code"] != redactedMask || e["email"] != "someone@example.com" {
+		t.Errorf("logged zip_code = %v, email = %v, want only zip_code masked", e["zip_code"], e["email"])
+	}
+}
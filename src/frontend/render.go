@@ -0,0 +1,202 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	renderTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "frontend_render_timeouts_total",
+			Help: "A counter of responses cut short for exceeding RENDER_TIMEOUT while rendering.",
+		},
+		[]string{"handler"},
+	)
+
+	slowRenders = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "frontend_slow_renders_total",
+			Help: "A counter of responses taking most of RENDER_TIMEOUT to render.",
+		},
+		[]string{"handler"},
+	)
+)
+
+// slowRenderFraction is the fraction of the render timeout above which a
+// render is logged and counted as approaching it.
+const slowRenderFraction = 0.8
+
+// errRenderTimeout fails the writes of a response once its render timeout
+// is exceeded, which aborts the template writing it.
+var errRenderTimeout = errors.New("render timeout exceeded")
+
+// defaultRenderTimeout derives the render timeout from the server's write
+// timeout, leaving part of it to the calls made before rendering. It is zero,
+// disabling the guard, without a write timeout.
+func defaultRenderTimeout(writeTimeout time.Duration) time.Duration {
+	return writeTimeout / 2
+}
+
+// guardRender bounds the render and write phase of responses, from their
+// first write, by timeout: later writes fail, cutting the response short,
+// and renders approaching the timeout are logged and counted. Writes already
+// blocked on a slow client are left to the server's write timeout. A
+// non-positive timeout disables the guard.
+func guardRender(timeout time.Duration, next http.Handler) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &renderGuardWriter{ResponseWriter: w, timeout: timeout}
+		next.ServeHTTP(rw, r)
+
+		took, exceeded := rw.took()
+		if !exceeded && took < time.Duration(float64(timeout)*slowRenderFraction) {
+			return
+		}
+		handler := requestTimingFrom(r.Context()).handlerName()
+		fields := logrus.Fields{
+			"handler":         handler,
+			"render.took_ms":  int64(took / time.Millisecond),
+			"render.limit_ms": int64(timeout / time.Millisecond)}
+		log, _ := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+		if exceeded {
+			renderTimeouts.WithLabelValues(handler).Inc()
+			if log != nil {
+				log.WithFields(fields).Error("render timeout exceeded, response cut short")
+			}
+			return
+		}
+		slowRenders.WithLabelValues(handler).Inc()
+		if log != nil {
+			log.WithFields(fields).Warn("render approaching its timeout")
+		}
+	})
+}
+
+// renderGuardWriter fails writes once the timeout has passed since the
+// first one.
+type renderGuardWriter struct {
+	http.ResponseWriter
+	timeout time.Duration
+
+	mu       sync.Mutex
+	start    time.Time
+	last     time.Time
+	exceeded bool
+}
+
+func (w *renderGuardWriter) Write(p []byte) (int, error) {
+	if err := w.checkRender(); err != nil {
+		return 0, err
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.mu.Lock()
+	w.last = time.Now()
+	w.mu.Unlock()
+	return n, err
+}
+
+// checkRender starts the clock on the first call, like a write, and returns
+// errRenderTimeout once the timeout has passed.
+func (w *renderGuardWriter) checkRender() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	if w.start.IsZero() {
+		w.start = now
+	}
+	if w.exceeded || now.Sub(w.start) > w.timeout {
+		w.exceeded, w.last = true, now
+		return errRenderTimeout
+	}
+	return nil
+}
+
+// Flush passes on flushes, for the pages streamed in chunks.
+func (w *renderGuardWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// took returns the time from the first write to the end of the last, and
+// whether the timeout was exceeded.
+func (w *renderGuardWriter) took() (time.Duration, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.start.IsZero() {
+		return 0, false
+	}
+	return w.last.Sub(w.start), w.exceeded
+}
+
+// renderChecker is implemented by the response writers of guarded responses,
+// and by the writers wrapping them, to check the render timeout before
+// anything is written.
+type renderChecker interface {
+	checkRender() error
+}
+
+// renderBuffer holds a template rendered for w. Every write of the template
+// checks the render timeout of w, if guarded, so that buffering does not
+// hide slow renders, and the writes are replayed to w one by one, so that a
+// slow client is cut short as it would be unbuffered.
+type renderBuffer struct {
+	buf    bytes.Buffer
+	chunks []int
+	check  func() error
+}
+
+func newRenderBuffer(w http.ResponseWriter) *renderBuffer {
+	b := &renderBuffer{}
+	if c, ok := w.(renderChecker); ok {
+		b.check = c.checkRender
+	}
+	return b
+}
+
+func (b *renderBuffer) Write(p []byte) (int, error) {
+	if b.check != nil {
+		if err := b.check(); err != nil {
+			return 0, err
+		}
+	}
+	n, _ := b.buf.Write(p)
+	b.chunks = append(b.chunks, b.buf.Len())
+	return n, nil
+}
+
+// writeTo writes the buffered template to w, in the chunks it was written
+// in.
+func (b *renderBuffer) writeTo(w http.ResponseWriter) error {
+	out, start := b.buf.Bytes(), 0
+	for _, end := range b.chunks {
+		if _, err := w.Write(out[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
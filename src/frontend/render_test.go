@@ -0,0 +1,132 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// slowWriter delays every write, like a client reading slowly.
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestGuardRender_cutsSlowRenders(t *testing.T) {
+	var renderErr error
+	h := guardRender(50*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestTimingFrom(r.Context()).setHandler("home")
+		renderErr = renderTemplate(w, "error", map[string]interface{}{
+			"error":       "test",
+			"status_code": http.StatusInternalServerError,
+		})
+	}))
+	var buf bytes.Buffer
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx := context.WithValue(r.Context(), ctxKeyLog{}, logrus.FieldLogger(newBufferLogger(&buf)))
+	ctx = context.WithValue(ctx, ctxKeyRequestTiming{}, &requestTiming{})
+	counter := renderTimeouts.WithLabelValues("home")
+	before := testutil.ToFloat64(counter)
+
+	w := &slowWriter{httptest.NewRecorder(), 10 * time.Millisecond}
+	h.ServeHTTP(w, r.WithContext(ctx))
+
+	if errors.Cause(renderErr) != errRenderTimeout {
+		t.Errorf("renderTemplate() error = %v, want %v", renderErr, errRenderTimeout)
+	}
+	if got := testutil.ToFloat64(counter); got != before+1 {
+		t.Errorf("frontend_render_timeouts_total{handler=\"home\"} = %v, want %v", got, before+1)
+	}
+	if e := lastEntry(t, &buf, "render timeout exceeded, response cut short"); e["handler"] != "home" {
+		t.Errorf("logged handler %v, want home", e["handler"])
+	}
+}
+
+// slowData takes delay to produce each value a template asks for, like a
+// template calling out to slow helpers.
+type slowData struct{ delay time.Duration }
+
+func (d slowData) Value() string {
+	time.Sleep(d.delay)
+	return "value"
+}
+
+func TestGuardRender_cutsSlowTemplates(t *testing.T) {
+	defer func(t *template.Template) { templates = t }(templates)
+	templates = template.Must(template.New("").Parse(`
+		{{ define "slow" }}{{ range . }}<p>{{ .Value }}</p>{{ end }}{{ end }}`))
+	data := make([]slowData, 10)
+	for i := range data {
+		data[i].delay = 10 * time.Millisecond
+	}
+
+	var renderErr error
+	h := guardRender(50*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renderErr = renderTemplate(w, "slow", data)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if renderErr != errRenderTimeout {
+		t.Errorf("renderTemplate() error = %v, want %v", renderErr, errRenderTimeout)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("body = %q, want nothing written for the template cut short", w.Body.String())
+	}
+}
+
+func TestGuardRender_fastRender(t *testing.T) {
+	var renderErr error
+	h := guardRender(time.Second, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renderErr = renderTemplate(w, "error", map[string]interface{}{
+			"error":       "test",
+			"status_code": http.StatusInternalServerError,
+		})
+	}))
+	before := testutil.ToFloat64(renderTimeouts.WithLabelValues("unknown")) + testutil.ToFloat64(slowRenders.WithLabelValues("unknown"))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if renderErr != nil {
+		t.Errorf("renderTemplate() error = %v", renderErr)
+	}
+	if got := testutil.ToFloat64(renderTimeouts.WithLabelValues("unknown")) + testutil.ToFloat64(slowRenders.WithLabelValues("unknown")); got != before {
+		t.Error("fast render counted as slow")
+	}
+}
+
+func TestDefaultRenderTimeout(t *testing.T) {
+	if got := defaultRenderTimeout(60 * time.Second); got != 30*time.Second {
+		t.Errorf("defaultRenderTimeout(60s) = %v, want 30s", got)
+	}
+	if got := defaultRenderTimeout(0); got != 0 {
+		t.Errorf("defaultRenderTimeout(0) = %v, want 0", got)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RestockSignups stores the email addresses to notify once out of stock
+// products are back. Notifying them is left to whatever reads the store,
+// outside of the request path.
+type RestockSignups interface {
+	// Add records email for the product on behalf of the session. It returns
+	// false, recording nothing, if the session already signed up for it.
+	Add(ctx context.Context, productID, sessionID, email string) (bool, error)
+}
+
+// memoryRestockSignups keeps signups in memory. It is the default, and
+// loses them on restart. The email addresses are personal data keyed by a
+// session cookie, so they are dropped along with the session by bound
+// rather than kept until the product is back.
+type memoryRestockSignups struct {
+	mu    sync.Mutex
+	m     map[string]map[string]string // session ID -> product ID -> email
+	bound sessionBound
+}
+
+func (s *memoryRestockSignups) Add(_ context.Context, productID, sessionID, email string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]map[string]string)
+	}
+	if s.bound.expired(sessionID) {
+		delete(s.m, sessionID)
+	}
+	for _, id := range s.bound.touch(sessionID) {
+		delete(s.m, id)
+	}
+	if _, ok := s.m[sessionID][productID]; ok {
+		return false, nil
+	}
+	if s.m[sessionID] == nil {
+		s.m[sessionID] = make(map[string]string)
+	}
+	s.m[sessionID][productID] = email
+	return true, nil
+}
+
+// validEmail reports whether s is a bare email address, without a display
+// name or angle brackets.
+func validEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s
+}
+
+// notifyRestockHandler signs the session up to be emailed when the product
+// is back in stock, and sends it back to the product page with a
+// confirmation.
+func (fe *frontendServer) notifyRestockHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	if fe.restockSignups == nil {
+		renderHTTPError(log, r, w, errors.New("restock signups are disabled"), http.StatusNotFound)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	p, err := fe.getProduct(r.Context(), id)
+	if isProductUnavailable(err) {
+		fe.productNotFound(w, r, id, err)
+		return
+	}
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve product"), http.StatusInternalServerError)
+		return
+	}
+	if !fe.outOfStock(p) {
+		renderHTTPError(log, r, w, errors.New("product is in stock"), http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(r.FormValue("email"))
+	if !validEmail(email) {
+		renderHTTPError(log, r, w, errors.New("invalid email address"), http.StatusBadRequest)
+		return
+	}
+
+	added, err := fe.restockSignups.Add(r.Context(), p.GetId(), sessionID(r), email)
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "failed to sign up for restock notification"), http.StatusInternalServerError)
+		return
+	}
+	if added {
+		log.WithField("product", p.GetId()).Info("signed up for restock notification")
+		fe.setFlash(w, r, "success", fmt.Sprintf("We will email you when %s is back in stock.", p.GetName()))
+	} else {
+		fe.setFlash(w, r, "info", fmt.Sprintf("You already signed up to hear when %s is back in stock.", p.GetName()))
+	}
+	w.Header().Set("location", "/product/"+url.PathEscape(p.GetId()))
+	w.WriteHeader(http.StatusFound)
+}
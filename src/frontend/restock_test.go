@@ -0,0 +1,145 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// soldOut has the sunglasses out of stock, for restock signups.
+var soldOut = map[string]int{"OLJCESPC7Z": 0}
+
+// signUpForRestock posts the restock signup form for the product.
+func signUpForRestock(fe *frontendServer, id, email string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := newTestRequest(http.MethodPost, "/product/"+id+"/notify", strings.NewReader("email="+email))
+	fe.notifyRestockHandler(w, mux.SetURLVars(r, map[string]string{"id": id}))
+	return w
+}
+
+func TestNotifyRestockHandler(t *testing.T) {
+	signups := &memoryRestockSignups{}
+	fe := newTestFrontend(t, &frontendServer{stock: soldOut, restockSignups: signups}, newFakeBackends())
+
+	w := signUpForRestock(fe, "OLJCESPC7Z", "someone@example.com")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/product/OLJCESPC7Z" {
+		t.Fatalf("status = %d, Location = %q, want a redirect to the product page", w.Code, w.Header().Get("Location"))
+	}
+	if got := signups.m[testSessionID]["OLJCESPC7Z"]; got != "someone@example.com" {
+		t.Errorf("recorded email = %q, want someone@example.com", got)
+	}
+
+	page := httptest.NewRecorder()
+	r := mux.SetURLVars(withCookies(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), w), map[string]string{"id": "OLJCESPC7Z"})
+	fe.productHandler(page, r)
+	if !strings.Contains(page.Body.String(), "We will email you when Sunglasses is back in stock.") {
+		t.Error("product page does not confirm the signup")
+	}
+}
+
+func TestNotifyRestockHandler_duplicate(t *testing.T) {
+	signups := &memoryRestockSignups{}
+	fe := newTestFrontend(t, &frontendServer{stock: soldOut, restockSignups: signups}, newFakeBackends())
+
+	signUpForRestock(fe, "OLJCESPC7Z", "someone@example.com")
+	w := signUpForRestock(fe, "OLJCESPC7Z", "other@example.com")
+	if w.Code != http.StatusFound {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusFound)
+	}
+	if got := signups.m[testSessionID]["OLJCESPC7Z"]; got != "someone@example.com" {
+		t.Errorf("recorded email = %q, want the first signup kept", got)
+	}
+	page := httptest.NewRecorder()
+	r := mux.SetURLVars(withCookies(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), w), map[string]string{"id": "OLJCESPC7Z"})
+	fe.productHandler(page, r)
+	if !strings.Contains(page.Body.String(), "You already signed up to hear when Sunglasses is back in stock.") {
+		t.Error("product page does not report the duplicate signup")
+	}
+
+	// Signups are per product.
+	if added, _ := signups.Add(context.Background(), "66VCHSJNUP", testSessionID, "someone@example.com"); !added {
+		t.Error("Add() for another product = false, want true")
+	}
+}
+
+func TestNotifyRestockHandler_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		fe   *frontendServer
+		id   string
+		mail string
+		want int
+	}{
+		{"invalid email", &frontendServer{stock: soldOut, restockSignups: &memoryRestockSignups{}}, "OLJCESPC7Z", "not-an-email", http.StatusBadRequest},
+		{"display name", &frontendServer{stock: soldOut, restockSignups: &memoryRestockSignups{}}, "OLJCESPC7Z", "Someone+%3Csomeone@example.com%3E", http.StatusBadRequest},
+		{"unknown product", &frontendServer{stock: soldOut, restockSignups: &memoryRestockSignups{}}, "GONE", "someone@example.com", http.StatusNotFound},
+		{"in stock", &frontendServer{stock: map[string]int{"OLJCESPC7Z": 3}, restockSignups: &memoryRestockSignups{}}, "OLJCESPC7Z", "someone@example.com", http.StatusBadRequest},
+		{"no stock data", &frontendServer{restockSignups: &memoryRestockSignups{}}, "OLJCESPC7Z", "someone@example.com", http.StatusBadRequest},
+		{"disabled", &frontendServer{stock: soldOut}, "OLJCESPC7Z", "someone@example.com", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe := newTestFrontend(t, tt.fe, newFakeBackends())
+			if w := signUpForRestock(fe, tt.id, tt.mail); w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if signups, ok := tt.fe.restockSignups.(*memoryRestockSignups); ok && len(signups.m) != 0 {
+				t.Errorf("recorded signups %v, want none", signups.m)
+			}
+		})
+	}
+}
+
+func TestMemoryRestockSignups_evictsSessions(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := &memoryRestockSignups{bound: sessionBound{ttl: time.Hour, max: 2, now: func() time.Time { return now }}}
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b", "c"} {
+		s.Add(ctx, "OLJCESPC7Z", id, id+"@example.com")
+		now = now.Add(time.Second)
+	}
+	if _, ok := s.m["a"]; ok || len(s.m) != 2 {
+		t.Errorf("signups kept for %v, want the least recently used session evicted", s.m)
+	}
+
+	now = now.Add(time.Hour)
+	if added, _ := s.Add(ctx, "OLJCESPC7Z", "c", "c@example.com"); !added {
+		t.Error("Add() after the session expired = false, want true")
+	}
+}
+
+func TestProductHandler_restockSignupForm(t *testing.T) {
+	fe := newTestFrontend(t, &frontendServer{stock: soldOut, restockSignups: &memoryRestockSignups{}}, newFakeBackends())
+
+	w := httptest.NewRecorder()
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	fe.productHandler(w, r)
+
+	body := w.Body.String()
+	if !strings.Contains(body, `action="/product/OLJCESPC7Z/notify"`) {
+		t.Error("out of stock product page has no restock signup form")
+	}
+	if strings.Contains(body, "Add to Cart") {
+		t.Error("out of stock product page offers to add it to the cart")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRetryBudget = 10
+
+	// retryCost is the number of tokens a retry takes. Each successful call
+	// earns one, so that retries stay within a tenth of the successful
+	// traffic once the initial budget is spent.
+	retryCost = 10
+)
+
+// nonRetryableMethods change state on the backend, so a call that looks
+// unavailable may still have been applied.
+var nonRetryableMethods = map[string]bool{
+	"/hipstershop.CartService/AddItem":        true,
+	"/hipstershop.CartService/EmptyCart":      true,
+	"/hipstershop.CheckoutService/PlaceOrder": true,
+}
+
+// retryBudget is a token bucket shared by the retries of all downstream
+// calls. Each retry takes a token and each successful call gives back a
+// fraction of one, so retries stop during an outage instead of multiplying
+// the load on a struggling backend.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens int
+	max    int
+}
+
+// newRetryBudget returns a full budget allowing max retries.
+func newRetryBudget(max int) *retryBudget {
+	return &retryBudget{tokens: max * retryCost, max: max * retryCost}
+}
+
+// withdraw takes a token for a retry, reporting false if none is left.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < retryCost {
+		return false
+	}
+	b.tokens -= retryCost
+	return true
+}
+
+// deposit credits a successful call.
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < b.max {
+		b.tokens++
+	}
+}
+
+// retryUnavailable retries calls failing with Unavailable up to
+// fe.maxRetries times, as long as the retry budget allows it. Retries denied
+// by the budget are logged and counted.
+func (fe *frontendServer) retryUnavailable(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if nonRetryableMethods[method] {
+		return err
+	}
+	for i := 0; i < fe.maxRetries && status.Code(err) == codes.Unavailable && ctx.Err() == nil; i++ {
+		if !fe.retries.withdraw() {
+			retriesDropped.WithLabelValues(serviceLabel(method)).Inc()
+			if log, ok := ctx.Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+				log.WithField("method", method).Warn("retry budget exhausted, not retrying")
+			}
+			return err
+		}
+		err = invoker(ctx, method, req, reply, cc, opts...)
+	}
+	if err == nil {
+		fe.retries.deposit()
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryUnavailable_stopsWhenBudgetSpent(t *testing.T) {
+	fb := newFakeBackends()
+	fb.failing = map[string]error{"ListProducts": status.Error(codes.Unavailable, "down")}
+	fe := newTestFrontend(t, &frontendServer{maxRetries: 3, retries: newRetryBudget(2)}, fb)
+	dropped := retriesDropped.WithLabelValues("productcatalogservice")
+	before := testutil.ToFloat64(dropped)
+
+	// The first call spends the budget on two of its three retries.
+	if _, err := fe.getProducts(context.Background()); status.Code(err) != codes.Unavailable {
+		t.Fatalf("getProducts() error = %v, want Unavailable", err)
+	}
+	if n := fb.callCount("ListProducts"); n != 3 {
+		t.Errorf("ListProducts called %d times, want 3", n)
+	}
+	if _, err := fe.getProducts(context.Background()); status.Code(err) != codes.Unavailable {
+		t.Fatalf("getProducts() error = %v, want Unavailable", err)
+	}
+	if n := fb.callCount("ListProducts"); n != 4 {
+		t.Errorf("ListProducts called %d times after the budget was spent, want 4", n)
+	}
+	if got := testutil.ToFloat64(dropped); got != before+2 {
+		t.Errorf("frontend_retries_dropped_total = %v, want %v", got, before+2)
+	}
+}
+
+func TestRetryUnavailable_skipsNonRetryableMethods(t *testing.T) {
+	fb := newFakeBackends()
+	fb.failing = map[string]error{"EmptyCart": status.Error(codes.Unavailable, "down")}
+	fe := newTestFrontend(t, &frontendServer{maxRetries: 3, retries: newRetryBudget(10)}, fb)
+
+	if err := fe.emptyCart(context.Background(), testSessionID); status.Code(err) != codes.Unavailable {
+		t.Fatalf("emptyCart() error = %v, want Unavailable", err)
+	}
+	if n := fb.callCount("EmptyCart"); n != 1 {
+		t.Errorf("EmptyCart called %d times, want 1", n)
+	}
+}
+
+func TestRetryBudget_depositsUpToMax(t *testing.T) {
+	b := newRetryBudget(1)
+	if !b.withdraw() || b.withdraw() {
+		t.Fatal("budget of 1 did not allow exactly one retry")
+	}
+	for i := 0; i < 9; i++ {
+		b.deposit()
+	}
+	if b.withdraw() {
+		t.Error("retry allowed after 9 successes, want 10")
+	}
+	b.deposit()
+	if !b.withdraw() {
+		t.Error("retry not allowed after 10 successes")
+	}
+	for i := 0; i < 100; i++ {
+		b.deposit()
+	}
+	if !b.withdraw() || b.withdraw() {
+		t.Error("deposits exceeded the budget's maximum")
+	}
+}
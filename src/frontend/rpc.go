@@ -16,18 +16,35 @@ package main
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	avoidNoopCurrencyConversionRPC = false
+
+	defaultImagePlaceholder = "/static/img/placeholder.svg"
 )
 
+// getCurrencies returns the supported currencies, from the list refreshed
+// in the background if there is one.
 func (fe *frontendServer) getCurrencies(ctx context.Context) ([]string, error) {
+	if currs, ok := fe.currencies.Load().([]string); ok {
+		return currs, nil
+	}
+	return fe.fetchCurrencies(ctx)
+}
+
+func (fe *frontendServer) fetchCurrencies(ctx context.Context) ([]string, error) {
 	currs, err := pb.NewCurrencyServiceClient(fe.currencySvcConn).
 		GetSupportedCurrencies(ctx, &pb.Empty{})
 	if err != nil {
@@ -45,26 +62,110 @@ func (fe *frontendServer) getCurrencies(ctx context.Context) ([]string, error) {
 func (fe *frontendServer) getProducts(ctx context.Context) ([]*pb.Product, error) {
 	resp, err := pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
 		ListProducts(ctx, &pb.Empty{})
-	return resp.GetProducts(), err
+	products := fe.withoutBlocked(resp.GetProducts())
+	fe.fillMissingImages(products...)
+	return products, err
 }
 
+// getProduct returns the product with the given ID. Blocked products are not
+// found, without asking the catalog.
 func (fe *frontendServer) getProduct(ctx context.Context, id string) (*pb.Product, error) {
+	if fe.blockedProductIDs[id] {
+		return nil, status.Errorf(codes.NotFound, "product %s is blocked", id)
+	}
 	resp, err := pb.NewProductCatalogServiceClient(fe.productCatalogSvcConn).
 		GetProduct(ctx, &pb.GetProductRequest{Id: id})
+	if resp != nil {
+		fe.fillMissingImages(resp)
+	}
 	return resp, err
 }
 
+// prefetchCatalog lists the catalog once at startup, so that the first
+// request does not pay for connecting to the catalog and currency services.
+// The frontend has no catalog cache; the prices of the products in the
+// default currency seed the price cache when it is enabled. Failures are
+// only logged.
+func (fe *frontendServer) prefetchCatalog(ctx context.Context, log logrus.FieldLogger) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	products, err := fe.getProducts(ctx)
+	if err != nil {
+		log.WithField("error", err).Warn("failed to prefetch the catalog")
+		return
+	}
+	if _, err := fe.productViews(ctx, products, defaultCurrency); err != nil {
+		log.WithField("error", err).Warn("failed to prefetch catalog prices")
+		return
+	}
+	log.WithField("products", len(products)).Info("prefetched the catalog")
+}
+
+// withoutBlocked returns ps without the blocked products.
+func (fe *frontendServer) withoutBlocked(ps []*pb.Product) []*pb.Product {
+	if len(fe.blockedProductIDs) == 0 {
+		return ps
+	}
+	out := make([]*pb.Product, 0, len(ps))
+	for _, p := range ps {
+		if !fe.blockedProductIDs[p.GetId()] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// fillMissingImages gives the products without a picture the placeholder
+// image, so that they do not render as broken images.
+func (fe *frontendServer) fillMissingImages(ps ...*pb.Product) {
+	for _, p := range ps {
+		if strings.TrimSpace(p.GetPicture()) == "" {
+			p.Picture = fe.imagePlaceholder()
+		}
+	}
+}
+
+// imagePlaceholder returns the path of the placeholder product image.
+func (fe *frontendServer) imagePlaceholder() string {
+	if fe.imagePlaceholderPath != "" {
+		return fe.imagePlaceholderPath
+	}
+	return defaultImagePlaceholder
+}
+
+// getCart returns the items in the cart of userID. Within requests passing
+// through memoizeCart, the cart is fetched once and shared.
 func (fe *frontendServer) getCart(ctx context.Context, userID string) ([]*pb.CartItem, error) {
+	m, ok := ctx.Value(ctxKeyCartMemo{}).(*cartMemo)
+	if !ok {
+		return fe.fetchCart(ctx, userID)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ok && m.userID == userID {
+		return m.items, nil
+	}
+	items, err := fe.fetchCart(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	m.userID, m.items, m.ok = userID, items, true
+	return items, nil
+}
+
+func (fe *frontendServer) fetchCart(ctx context.Context, userID string) ([]*pb.CartItem, error) {
 	resp, err := pb.NewCartServiceClient(fe.cartSvcConn).GetCart(ctx, &pb.GetCartRequest{UserId: userID})
 	return resp.GetItems(), err
 }
 
 func (fe *frontendServer) emptyCart(ctx context.Context, userID string) error {
+	defer forgetCart(ctx)
 	_, err := pb.NewCartServiceClient(fe.cartSvcConn).EmptyCart(ctx, &pb.EmptyCartRequest{UserId: userID})
 	return err
 }
 
 func (fe *frontendServer) insertCart(ctx context.Context, userID, productID string, quantity int32) error {
+	defer forgetCart(ctx)
 	_, err := pb.NewCartServiceClient(fe.cartSvcConn).AddItem(ctx, &pb.AddItemRequest{
 		UserId: userID,
 		Item: &pb.CartItem{
@@ -74,14 +175,29 @@ func (fe *frontendServer) insertCart(ctx context.Context, userID, productID stri
 	return err
 }
 
-func (fe *frontendServer) convertCurrency(ctx context.Context, money *pb.Money, currency string) (*pb.Money, error) {
-	if avoidNoopCurrencyConversionRPC && money.GetCurrencyCode() == currency {
-		return money, nil
+// convertCurrency converts m to the given currency and applies the
+// configured rounding policy to the result.
+func (fe *frontendServer) convertCurrency(ctx context.Context, m *pb.Money, currency string) (*pb.Money, error) {
+	if avoidNoopCurrencyConversionRPC && m.GetCurrencyCode() == currency {
+		return m, nil
 	}
-	return pb.NewCurrencyServiceClient(fe.currencySvcConn).
+	converted, err := pb.NewCurrencyServiceClient(fe.currencySvcConn).
 		Convert(ctx, &pb.CurrencyConversionRequest{
-			From:   money,
+			From:   m,
 			ToCode: currency})
+	if err != nil && currency != defaultCurrency && isUnsupportedCurrency(err) && resetCurrency(ctx, currency) {
+		return fe.convertCurrency(ctx, m, defaultCurrency)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rounded := fe.round(*converted)
+	return &rounded, nil
+}
+
+// round applies the configured rounding policy to m.
+func (fe *frontendServer) round(m pb.Money) pb.Money {
+	return money.Round(m, fe.roundingMode, fe.roundingGranularity)
 }
 
 func (fe *frontendServer) getShippingQuote(ctx context.Context, items []*pb.CartItem, currency string) (*pb.Money, error) {
@@ -97,31 +213,124 @@ func (fe *frontendServer) getShippingQuote(ctx context.Context, items []*pb.Cart
 }
 
 func (fe *frontendServer) getRecommendations(ctx context.Context, userID string, productIDs []string) ([]*pb.Product, error) {
-	resp, err := pb.NewRecommendationServiceClient(fe.recommendationSvcConn).ListRecommendations(ctx,
-		&pb.ListRecommendationsRequest{UserId: userID, ProductIds: productIDs})
+	if !featureEnabled(ctx, flagRecommendations) {
+		return nil, nil
+	}
+	var resp *pb.ListRecommendationsResponse
+	err := withFailover(ctx, fe.recommendationSvcConn, fe.recommendationSvcFallbacks, func(conn *grpc.ClientConn) (err error) {
+		resp, err = pb.NewRecommendationServiceClient(conn).ListRecommendations(ctx,
+			&pb.ListRecommendationsRequest{UserId: userID, ProductIds: productIDs})
+		return err
+	})
+	ids := resp.GetProductIds()
 	if err != nil {
-		return nil, err
+		markDegraded(ctx, flagRecommendations)
+		if len(fe.fallbackRecommendationIDs) == 0 {
+			return nil, err
+		}
+		if log, ok := ctx.Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+			log.WithField("error", err).Warn("failed to get recommendations, showing the fallback")
+		}
+	} else if len(ids) == 0 {
+		emptyRecommendations.Inc()
+		logEmptyResponse(ctx, "recommendationservice")
 	}
-	out := make([]*pb.Product, len(resp.GetProductIds()))
-	for i, v := range resp.GetProductIds() {
-		p, err := fe.getProduct(ctx, v)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to get recommended product info (#%s)", v)
+	// The products recommended for, such as the one viewed or those in the
+	// cart, would be redundant in the strip. The fallback only stands in
+	// when none of the recommendations is left.
+	exclude := func(ids []string) []string {
+		var candidates []string
+		for _, id := range ids {
+			if !contains(productIDs, id) {
+				candidates = append(candidates, id)
+			}
 		}
-		out[i] = p
+		return candidates
 	}
-	if len(out) > 4 {
-		out = out[:4] // take only first four to fit the UI
+	ids = exclude(ids)
+	if len(ids) == 0 {
+		ids = exclude(fe.fallbackRecommendationIDs)
+	}
+	// Hydrate all recommendations with a single catalog call rather than one
+	// GetProduct per ID, skipping IDs that no longer resolve.
+	products, err := fe.getProducts(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get recommended product info")
 	}
-	return out, err
+	byID := make(map[string]*pb.Product, len(products))
+	for _, p := range products {
+		byID[p.GetId()] = p
+	}
+	// The recommendation service has no limit parameter, so trim here, to
+	// the products that resolve.
+	limit := fe.recommendationLimit()
+	if n := fe.maxRenderedRecommendations; n > 0 && n < limit {
+		limit = n
+	}
+	var out []*pb.Product
+	for _, v := range ids {
+		if len(out) == limit {
+			break
+		}
+		if p, ok := byID[v]; ok {
+			out = append(out, p)
+		}
+	}
+	return out, nil
 }
 
-func (fe *frontendServer) getAd(ctx context.Context, ctxKeys []string) ([]*pb.Ad, error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
-	defer cancel()
+// recommendationLimit returns the maximum number of recommendations shown.
+func (fe *frontendServer) recommendationLimit() int {
+	if fe.recommendationCount > 0 {
+		return fe.recommendationCount
+	}
+	return defaultRecommendationCount
+}
+
+// adLimit returns the maximum number of ads shown.
+func (fe *frontendServer) adLimit() int {
+	if fe.adCount > 0 {
+		return fe.adCount
+	}
+	return defaultAdCount
+}
 
-	resp, err := pb.NewAdServiceClient(fe.adSvcConn).GetAds(ctx, &pb.AdRequest{
-		ContextKeys: ctxKeys,
+func (fe *frontendServer) getAd(ctx context.Context, ctxKeys []string) ([]*pb.Ad, error) {
+	var resp *pb.AdResponse
+	err := withFailover(ctx, fe.adSvcConn, fe.adSvcFallbacks, func(conn *grpc.ClientConn) (err error) {
+		resp, err = pb.NewAdServiceClient(conn).GetAds(ctx, &pb.AdRequest{
+			ContextKeys: ctxKeys,
+		})
+		return err
 	})
-	return resp.GetAds(), errors.Wrap(err, "failed to get ads")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get ads")
+	}
+	if len(resp.GetAds()) == 0 {
+		emptyAds.Inc()
+		logEmptyResponse(ctx, "adservice")
+	}
+	return resp.GetAds(), nil
+}
+
+// logEmptyResponse logs at debug level that service answered successfully
+// but with nothing to show, which is otherwise indistinguishable on the page
+// from the service being down.
+func logEmptyResponse(ctx context.Context, service string) {
+	if log, ok := ctx.Value(ctxKeyLog{}).(logrus.FieldLogger); ok {
+		log.WithField("service", service).Debug("empty response")
+	}
+}
+
+// withFailover calls f with conn, then with each of the fallbacks in turn
+// until a call succeeds or ctx is done. It returns the last error.
+func withFailover(ctx context.Context, conn *grpc.ClientConn, fallbacks []*grpc.ClientConn, f func(*grpc.ClientConn) error) error {
+	err := f(conn)
+	for _, fallback := range fallbacks {
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		err = f(fallback)
+	}
+	return err
 }
@@ -0,0 +1,339 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func productIDs(products []*pb.Product) []string {
+	out := make([]string, len(products))
+	for i, p := range products {
+		out[i] = p.GetId()
+	}
+	return out
+}
+
+func TestGetRecommendations_singleHydrationCall(t *testing.T) {
+	fb := newFakeBackends()
+	fb.recommendations = []string{"1YMWWN1N4O", "GONE", "OLJCESPC7Z", "66VCHSJNUP"}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	got, err := fe.getRecommendations(context.Background(), testSessionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1YMWWN1N4O", "OLJCESPC7Z", "66VCHSJNUP"}
+	if ids := productIDs(got); !reflect.DeepEqual(ids, want) {
+		t.Errorf("getRecommendations() = %v, want %v", ids, want)
+	}
+	if n := fb.callCount("ListProducts"); n != 1 {
+		t.Errorf("ListProducts called %d times, want 1", n)
+	}
+	if n := fb.callCount("GetProduct"); n != 0 {
+		t.Errorf("GetProduct called %d times, want 0", n)
+	}
+}
+
+func TestGetRecommendations_maxRendered(t *testing.T) {
+	fb := newFakeBackends()
+	fb.recommendations = []string{"GONE", "1YMWWN1N4O", "OLJCESPC7Z", "66VCHSJNUP"}
+	fe := newTestFrontend(t, &frontendServer{
+		maxRenderedRecommendations: 2,
+		blockedProductIDs:          map[string]bool{"1YMWWN1N4O": true},
+	}, fb)
+
+	got, err := fe.getRecommendations(context.Background(), testSessionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unknown and blocked IDs do not count towards the cap.
+	want := []string{"OLJCESPC7Z", "66VCHSJNUP"}
+	if ids := productIDs(got); !reflect.DeepEqual(ids, want) {
+		t.Errorf("getRecommendations() = %v, want %v", ids, want)
+	}
+	if n := fb.callCount("ListProducts"); n != 1 {
+		t.Errorf("ListProducts called %d times, want 1", n)
+	}
+	if n := fb.callCount("GetProduct"); n != 0 {
+		t.Errorf("GetProduct called %d times, want 0", n)
+	}
+}
+
+func TestGetRecommendations_excludesRequestedProducts(t *testing.T) {
+	fb := newFakeBackends()
+	fb.recommendations = []string{"OLJCESPC7Z", "1YMWWN1N4O", "66VCHSJNUP"}
+	fe := newTestFrontend(t, &frontendServer{maxRenderedRecommendations: 1}, fb)
+
+	got, err := fe.getRecommendations(context.Background(), testSessionID, []string{"OLJCESPC7Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The excluded product does not take up a slot of the cap.
+	if ids, want := productIDs(got), []string{"1YMWWN1N4O"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("getRecommendations() = %v, want %v", ids, want)
+	}
+}
+
+func TestProductHandler_excludesViewedProductFromRecommendations(t *testing.T) {
+	fb := newFakeBackends()
+	fb.recommendations = []string{"OLJCESPC7Z", "66VCHSJNUP"}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	w := httptest.NewRecorder()
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	fe.productHandler(w, r)
+
+	body := w.Body.String()
+	start := strings.Index(body, `<section class="recommendations">`)
+	if start < 0 {
+		t.Fatalf("product page has no recommendations:\n%s", body)
+	}
+	recommended := body[start:]
+	if strings.Contains(recommended, "/product/OLJCESPC7Z") {
+		t.Error("product page recommends the product being viewed")
+	}
+	if !strings.Contains(recommended, "/product/66VCHSJNUP") {
+		t.Error("product page does not recommend the other product")
+	}
+}
+
+func TestGetRecommendations_fallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing map[string]error
+	}{
+		{"empty response", nil},
+		{"failed", map[string]error{"ListRecommendations": status.Error(codes.Unavailable, "down")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFakeBackends()
+			fb.failing = tt.failing
+			fe := newTestFrontend(t, &frontendServer{fallbackRecommendationIDs: []string{"1YMWWN1N4O", "GONE"}}, fb)
+
+			got, err := fe.getRecommendations(context.Background(), testSessionID, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids, want := productIDs(got), []string{"1YMWWN1N4O"}; !reflect.DeepEqual(ids, want) {
+				t.Errorf("getRecommendations() = %v, want %v", ids, want)
+			}
+		})
+	}
+}
+
+func TestGetRecommendations_fallbackAfterExcluding(t *testing.T) {
+	tests := []struct {
+		name            string
+		recommendations []string
+		want            []string
+	}{
+		{"only the viewed product", []string{"OLJCESPC7Z"}, []string{"1YMWWN1N4O"}},
+		{"others left", []string{"OLJCESPC7Z", "66VCHSJNUP"}, []string{"66VCHSJNUP"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFakeBackends()
+			fb.recommendations = tt.recommendations
+			fe := newTestFrontend(t, &frontendServer{fallbackRecommendationIDs: []string{"OLJCESPC7Z", "1YMWWN1N4O"}}, fb)
+
+			got, err := fe.getRecommendations(context.Background(), testSessionID, []string{"OLJCESPC7Z"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := productIDs(got); !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("getRecommendations() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRecommendations_fallbackRendered(t *testing.T) {
+	fe := newTestFrontend(t, &frontendServer{fallbackRecommendationIDs: []string{"1YMWWN1N4O"}}, newFakeBackends())
+
+	w := httptest.NewRecorder()
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	fe.productHandler(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "/product/1YMWWN1N4O") {
+		t.Errorf("product page does not recommend the fallback product:\n%s", body)
+	}
+}
+
+func TestFailover_secondaryServes(t *testing.T) {
+	primary := newFakeBackends()
+	primary.failing = map[string]error{
+		"ListRecommendations": status.Error(codes.Unavailable, "primary is down"),
+		"GetAds":              status.Error(codes.Unavailable, "primary is down"),
+	}
+	secondary := newFakeBackends()
+	secondary.recommendations = []string{"1YMWWN1N4O"}
+	secondary.ads = []*pb.Ad{{RedirectUrl: "/product/66VCHSJNUP", Text: "Tank tops from the secondary"}}
+
+	fe := newTestFrontend(t, &frontendServer{}, primary)
+	backup := newTestFrontend(t, &frontendServer{}, secondary)
+	fe.recommendationSvcFallbacks = []*grpc.ClientConn{backup.recommendationSvcConn}
+	fe.adSvcFallbacks = []*grpc.ClientConn{backup.adSvcConn}
+
+	recs, err := fe.getRecommendations(context.Background(), testSessionID, nil)
+	if err != nil {
+		t.Fatalf("getRecommendations() failed despite a healthy secondary: %v", err)
+	}
+	if got := productIDs(recs); !reflect.DeepEqual(got, []string{"1YMWWN1N4O"}) {
+		t.Errorf("recommendations = %v, want those of the secondary", got)
+	}
+	ads, err := fe.getAd(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("getAd() failed despite a healthy secondary: %v", err)
+	}
+	if len(ads) != 1 || ads[0].GetText() != "Tank tops from the secondary" {
+		t.Errorf("ads = %v, want those of the secondary", ads)
+	}
+	if primary.callCount("ListRecommendations") != 1 || primary.callCount("GetAds") != 1 {
+		t.Errorf("primary calls = %v, want one attempt per service", primary.calls)
+	}
+}
+
+func TestFailover_singleAddress(t *testing.T) {
+	fb := newFakeBackends()
+	fb.failing = map[string]error{"ListRecommendations": status.Error(codes.Unavailable, "down")}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	if _, err := fe.getRecommendations(context.Background(), testSessionID, nil); status.Code(err) != codes.Unavailable {
+		t.Errorf("getRecommendations() error = %v, want Unavailable", err)
+	}
+}
+
+func TestEmptyResponses_counted(t *testing.T) {
+	fb := newFakeBackends()
+	fb.ads = nil
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	recsBefore, adsBefore := testutil.ToFloat64(emptyRecommendations), testutil.ToFloat64(emptyAds)
+
+	if _, err := fe.getRecommendations(context.Background(), testSessionID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fe.getAd(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.ToFloat64(emptyRecommendations); got != recsBefore+1 {
+		t.Errorf("frontend_empty_recommendations_total = %v, want %v", got, recsBefore+1)
+	}
+	if got := testutil.ToFloat64(emptyAds); got != adsBefore+1 {
+		t.Errorf("frontend_empty_ads_total = %v, want %v", got, adsBefore+1)
+	}
+}
+
+func TestEmptyResponses_notCountedOnError(t *testing.T) {
+	fb := newFakeBackends()
+	fb.failing = map[string]error{
+		"ListRecommendations": status.Error(codes.Unavailable, "down"),
+		"GetAds":              status.Error(codes.Unavailable, "down"),
+	}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	recsBefore, adsBefore := testutil.ToFloat64(emptyRecommendations), testutil.ToFloat64(emptyAds)
+
+	fe.getRecommendations(context.Background(), testSessionID, nil)
+	fe.getAd(context.Background(), nil)
+
+	if got := testutil.ToFloat64(emptyRecommendations); got != recsBefore {
+		t.Errorf("frontend_empty_recommendations_total = %v after an error, want %v", got, recsBefore)
+	}
+	if got := testutil.ToFloat64(emptyAds); got != adsBefore {
+		t.Errorf("frontend_empty_ads_total = %v after an error, want %v", got, adsBefore)
+	}
+}
+
+func TestFillMissingImages(t *testing.T) {
+	fb := newFakeBackends()
+	fb.products[0].Picture = ""
+	fb.products[1].Picture = " "
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	ps, err := fe.getProducts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{defaultImagePlaceholder, defaultImagePlaceholder, "/static/img/products/watch.jpg"}
+	for i, p := range ps {
+		if p.GetPicture() != want[i] {
+			t.Errorf("picture of %s = %q, want %q", p.GetId(), p.GetPicture(), want[i])
+		}
+	}
+
+	fe.imagePlaceholderPath = "/static/img/custom.png"
+	p, err := fe.getProduct(context.Background(), "OLJCESPC7Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.GetPicture() != "/static/img/custom.png" {
+		t.Errorf("picture = %q, want the configured placeholder", p.GetPicture())
+	}
+}
+
+func TestPrefetchCatalog_seedsPriceCache(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{priceCache: newPriceCache(time.Minute)}, fb)
+	var buf bytes.Buffer
+
+	fe.prefetchCatalog(context.Background(), newBufferLogger(&buf))
+
+	if n := fb.callCount("ListProducts"); n != 1 {
+		t.Errorf("ListProducts called %d times, want 1", n)
+	}
+	for _, p := range fb.products {
+		if _, _, ok := fe.priceCache.get(p.GetId(), defaultCurrency, priceSource(fe.variantPrices(p))); !ok {
+			t.Errorf("price of %s in %s not cached after prefetch", p.GetId(), defaultCurrency)
+		}
+	}
+	entries := logEntries(t, &buf)
+	if len(entries) != 1 || entries[0]["msg"] != "prefetched the catalog" || entries[0]["products"] != float64(3) {
+		t.Errorf("logged %v, want the number of products prefetched", entries)
+	}
+}
+
+func TestPrefetchCatalog_failureIsLogged(t *testing.T) {
+	fb := newFakeBackends()
+	fb.failing = map[string]error{"ListProducts": status.Error(codes.Unavailable, "down")}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	var buf bytes.Buffer
+
+	fe.prefetchCatalog(context.Background(), newBufferLogger(&buf))
+
+	entries := logEntries(t, &buf)
+	if len(entries) != 1 || entries[0]["msg"] != "failed to prefetch the catalog" {
+		t.Errorf("logged %v, want the failure", entries)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "time"
+
+const (
+	// defaultSessionStateTTL keeps the state of a session as long as its
+	// cookies last.
+	defaultSessionStateTTL = cookieMaxAge * time.Second
+
+	// defaultMaxSessionStates caps the sessions with state kept in memory.
+	defaultMaxSessionStates = 10000
+)
+
+// sessionBound bounds state kept in memory by session ID. Session IDs come
+// from a cookie the client controls, so such state must not grow with the
+// sessions seen: a session's state expires once unused for ttl, and the
+// least recently used sessions are evicted beyond max. The zero value uses
+// the defaults. It is not safe for concurrent use; the stores using it
+// guard it with their own lock.
+type sessionBound struct {
+	ttl time.Duration
+	max int
+	now func() time.Time
+
+	used map[string]time.Time
+}
+
+func (b *sessionBound) clock() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+	return b.now()
+}
+
+func (b *sessionBound) limits() (time.Duration, int) {
+	ttl, max := b.ttl, b.max
+	if ttl <= 0 {
+		ttl = defaultSessionStateTTL
+	}
+	if max <= 0 {
+		max = defaultMaxSessionStates
+	}
+	return ttl, max
+}
+
+// touch records a use of the session and returns the sessions evicted to
+// stay within max, whose state the caller must drop.
+func (b *sessionBound) touch(sessionID string) (evicted []string) {
+	if b.used == nil {
+		b.used = make(map[string]time.Time)
+	}
+	now := b.clock()
+	b.used[sessionID] = now
+	ttl, max := b.limits()
+	if len(b.used) <= max {
+		return nil
+	}
+	for id, t := range b.used {
+		if now.Sub(t) > ttl {
+			delete(b.used, id)
+			evicted = append(evicted, id)
+		}
+	}
+	for len(b.used) > max {
+		oldest, first := "", true
+		for id, t := range b.used {
+			if id != sessionID && (first || t.Before(b.used[oldest])) {
+				oldest, first = id, false
+			}
+		}
+		delete(b.used, oldest)
+		evicted = append(evicted, oldest)
+	}
+	return evicted
+}
+
+// expired reports whether the session has no state, or has not used it
+// within ttl. Expired state is dropped at the latest when max is exceeded.
+func (b *sessionBound) expired(sessionID string) bool {
+	t, ok := b.used[sessionID]
+	ttl, _ := b.limits()
+	return !ok || b.clock().Sub(t) > ttl
+}
+
+// remove forgets the session, once its state was dropped.
+func (b *sessionBound) remove(sessionID string) {
+	delete(b.used, sessionID)
+}
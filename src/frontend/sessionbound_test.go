@@ -0,0 +1,64 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionBound_evictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := &sessionBound{max: 2, now: func() time.Time { return now }}
+
+	for _, id := range []string{"a", "b"} {
+		if evicted := b.touch(id); evicted != nil {
+			t.Errorf("touch(%q) evicted %v within max", id, evicted)
+		}
+		now = now.Add(time.Second)
+	}
+	b.touch("a")
+	now = now.Add(time.Second)
+	if evicted := b.touch("c"); !reflect.DeepEqual(evicted, []string{"b"}) {
+		t.Errorf("touch(\"c\") evicted %v, want the least recently used [b]", evicted)
+	}
+	if b.expired("a") || !b.expired("b") || b.expired("c") {
+		t.Error("evicted the wrong session")
+	}
+}
+
+func TestSessionBound_expires(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := &sessionBound{ttl: time.Hour, max: 2, now: func() time.Time { return now }}
+	b.touch("a")
+	b.touch("b")
+
+	now = now.Add(time.Hour + time.Second)
+	if !b.expired("a") {
+		t.Error("session unused for longer than the TTL has not expired")
+	}
+	b.touch("b")
+	if evicted := b.touch("c"); !reflect.DeepEqual(evicted, []string{"a"}) {
+		t.Errorf("touch(\"c\") evicted %v, want the expired [a]", evicted)
+	}
+}
+
+func TestSessionBound_defaults(t *testing.T) {
+	var b sessionBound
+	if ttl, max := b.limits(); ttl != 48*time.Hour || max != defaultMaxSessionStates {
+		t.Errorf("limits() = %v, %d, want the cookie lifetime and %d", ttl, max, defaultMaxSessionStates)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sessionIDGenerator generates the IDs of new sessions.
+type sessionIDGenerator interface {
+	newSessionID() string
+}
+
+// parseSessionIDScheme returns the generator for SESSION_ID_SCHEME, which is
+// "uuid" (the default) or "ulid".
+func parseSessionIDScheme(s string) (sessionIDGenerator, error) {
+	switch s {
+	case "", "uuid":
+		return uuidSessionIDs{}, nil
+	case "ulid":
+		return ulidSessionIDs{now: time.Now}, nil
+	default:
+		return nil, fmt.Errorf("unknown session ID scheme %q, want uuid or ulid", s)
+	}
+}
+
+// newSessionID returns a new session ID in the configured scheme.
+func (fe *frontendServer) newSessionID() string {
+	if fe.sessionIDs == nil {
+		return uuidSessionIDs{}.newSessionID()
+	}
+	return fe.sessionIDs.newSessionID()
+}
+
+// uuidSessionIDs generates random (version 4) UUIDs.
+type uuidSessionIDs struct{}
+
+func (uuidSessionIDs) newSessionID() string {
+	u, _ := uuid.NewRandom()
+	return u.String()
+}
+
+// ulidSessionIDs generates ULIDs (https://github.com/ulid/spec), which sort
+// by creation time: a 48-bit millisecond timestamp followed by 80 random
+// bits, in 26 characters of Crockford's base32.
+type ulidSessionIDs struct {
+	now func() time.Time
+}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g ulidSessionIDs) newSessionID() string {
+	var b [16]byte
+	ms := uint64(g.now().UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint64(b[:8], ms<<16)
+	rand.Read(b[6:])
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+
+	// The 128 bits are encoded from the most significant end, 5 at a time,
+	// the first character holding the 3 leading ones.
+	var out [26]byte
+	for i := range out {
+		shift := uint(5 * (25 - i))
+		var v uint64
+		switch {
+		case shift >= 64:
+			v = hi >> (shift - 64)
+		case shift > 59:
+			v = lo>>shift | hi<<(64-shift)
+		default:
+			v = lo >> shift
+		}
+		out[i] = crockfordBase32[v&31]
+	}
+	return string(out[:])
+}
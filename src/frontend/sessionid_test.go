@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+var (
+	uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ulidPattern = regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+)
+
+func TestParseSessionIDScheme(t *testing.T) {
+	tests := []struct {
+		scheme  string
+		pattern *regexp.Regexp
+	}{
+		{"", uuidPattern},
+		{"uuid", uuidPattern},
+		{"ulid", ulidPattern},
+	}
+	for _, tt := range tests {
+		g, err := parseSessionIDScheme(tt.scheme)
+		if err != nil {
+			t.Fatalf("parseSessionIDScheme(%q): %v", tt.scheme, err)
+		}
+		seen := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			id := g.newSessionID()
+			if !tt.pattern.MatchString(id) {
+				t.Fatalf("scheme %q generated %q, want a match for %s", tt.scheme, id, tt.pattern)
+			}
+			if seen[id] {
+				t.Fatalf("scheme %q generated %q twice", tt.scheme, id)
+			}
+			seen[id] = true
+		}
+	}
+	if _, err := parseSessionIDScheme("sequential"); err == nil {
+		t.Error("parseSessionIDScheme(\"sequential\") = nil error")
+	}
+}
+
+func TestULIDSessionIDs_timestamp(t *testing.T) {
+	// The example of the ULID spec.
+	at := time.Unix(0, 1469918176385*int64(time.Millisecond))
+	id := ulidSessionIDs{now: func() time.Time { return at }}.newSessionID()
+	if got := id[:10]; got != "01ARYZ6S41" {
+		t.Errorf("timestamp part = %q, want \"01ARYZ6S41\"", got)
+	}
+
+	later := ulidSessionIDs{now: func() time.Time { return at.Add(time.Millisecond) }}.newSessionID()
+	if later <= id {
+		t.Errorf("ID generated later (%q) does not sort after %q", later, id)
+	}
+}
+
+func TestNewSessionID_defaultsToUUID(t *testing.T) {
+	if id := (&frontendServer{}).newSessionID(); !uuidPattern.MatchString(id) {
+		t.Errorf("newSessionID() = %q, want a UUID", id)
+	}
+}
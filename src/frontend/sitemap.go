@@ -0,0 +1,97 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultRobotsTxt keeps crawlers away from demo deployments.
+const defaultRobotsTxt = "User-agent: *\nDisallow: /"
+
+// loadRobotsTxt returns the robots.txt content, given inline or read from
+// path, but not both. Without either, crawlers are kept away.
+func loadRobotsTxt(content, path string) (string, error) {
+	switch {
+	case content != "" && path != "":
+		return "", errors.New("set either the content or the file of robots.txt, not both")
+	case content != "":
+		return content, nil
+	case path != "":
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	return defaultRobotsTxt, nil
+}
+
+func (fe *frontendServer) robotsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, fe.robotsTxt)
+}
+
+// sitemapURLSet is the root element of the sitemap protocol.
+type sitemapURLSet struct {
+	XMLName xml.Name `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []string `xml:"url>loc"`
+}
+
+// sitemapMaxAge is how long clients may cache the sitemap. The catalog is
+// not cached by the frontend, so this keeps crawlers from listing it on
+// every fetch.
+const sitemapMaxAge = 3600
+
+// sitemapHandler lists the home page and the page of every product in the
+// catalog. There are no category pages to list.
+func (fe *frontendServer) sitemapHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	products, err := fe.getProducts(r.Context())
+	if err != nil {
+		renderHTTPError(log, r, w, errors.Wrap(err, "could not retrieve products"), http.StatusInternalServerError)
+		return
+	}
+	set := sitemapURLSet{URLs: []string{fe.siteURL(r, "/")}}
+	for _, p := range products {
+		set.URLs = append(set.URLs, fe.siteURL(r, "/product/"+url.PathEscape(p.GetId())))
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", sitemapMaxAge))
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(set); err != nil {
+		log.Println(err)
+	}
+}
+
+// siteURL returns the URL of path on the canonical origin if there is one,
+// or on the origin of r otherwise.
+func (fe *frontendServer) siteURL(r *http.Request, path string) string {
+	if fe.canonicalHost == "" {
+		return fe.absoluteURL(r, path)
+	}
+	scheme, _ := fe.externalOrigin(r)
+	if fe.canonicalHTTPS {
+		scheme = "https"
+	}
+	return scheme + "://" + fe.canonicalHost + path
+}
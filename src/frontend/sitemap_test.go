@@ -0,0 +1,91 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSitemapHandler(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{canonicalHost: "shop.example.com", canonicalHTTPS: true}, fb)
+
+	w := httptest.NewRecorder()
+	fe.sitemapHandler(w, newTestRequest(http.MethodGet, "/sitemap.xml", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var got sitemapURLSet
+	if err := xml.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid sitemap: %v\n%s", err, w.Body.String())
+	}
+	want := []string{
+		"https://shop.example.com/",
+		"https://shop.example.com/product/OLJCESPC7Z",
+		"https://shop.example.com/product/66VCHSJNUP",
+		"https://shop.example.com/product/1YMWWN1N4O",
+	}
+	if !reflect.DeepEqual(got.URLs, want) {
+		t.Errorf("sitemap URLs = %v, want %v", got.URLs, want)
+	}
+}
+
+func TestSitemapHandler_requestOrigin(t *testing.T) {
+	fe := newTestFrontend(t, &frontendServer{blockedProductIDs: map[string]bool{"66VCHSJNUP": true}}, newFakeBackends())
+
+	w := httptest.NewRecorder()
+	fe.sitemapHandler(w, newTestRequest(http.MethodGet, "/sitemap.xml", nil))
+
+	var got sitemapURLSet
+	if err := xml.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://example.com/", "http://example.com/product/OLJCESPC7Z", "http://example.com/product/1YMWWN1N4O"}
+	if !reflect.DeepEqual(got.URLs, want) {
+		t.Errorf("sitemap URLs = %v, want %v", got.URLs, want)
+	}
+}
+
+func TestLoadRobotsTxt(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"robots.txt": "User-agent: *\nAllow: /"})
+	file := filepath.Join(dir, "robots.txt")
+
+	tests := []struct {
+		content, path string
+		want          string
+	}{
+		{"", "", defaultRobotsTxt},
+		{"User-agent: *\nDisallow: /cart", "", "User-agent: *\nDisallow: /cart"},
+		{"", file, "User-agent: *\nAllow: /"},
+	}
+	for _, tt := range tests {
+		got, err := loadRobotsTxt(tt.content, tt.path)
+		if err != nil || got != tt.want {
+			t.Errorf("loadRobotsTxt(%q, %q) = %q, %v, want %q", tt.content, tt.path, got, err, tt.want)
+		}
+	}
+	if _, err := loadRobotsTxt("User-agent: *", file); err == nil {
+		t.Error("loadRobotsTxt() with both content and file = nil error")
+	}
+	if _, err := loadRobotsTxt("", filepath.Join(dir, "missing.txt")); err == nil {
+		t.Error("loadRobotsTxt() of a missing file = nil error")
+	}
+}
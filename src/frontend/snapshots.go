@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+// priceSnapshots remembers the catalog price of each product when it was
+// added to a session's cart. The cart service has no room for item
+// metadata, so they are kept in memory: they are lost on restart and not
+// shared between replicas, in which case no change is reported. Sessions
+// that leave without checking out are evicted by bound.
+type priceSnapshots struct {
+	mu    sync.Mutex
+	m     map[string]map[string]pb.Money // session ID -> product ID -> USD price
+	bound sessionBound
+}
+
+// record snapshots price for the product unless the session already has
+// one, so that the price the user first saw is kept.
+func (s *priceSnapshots) record(sessionID, productID string, price pb.Money) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]map[string]pb.Money)
+	}
+	if s.bound.expired(sessionID) {
+		delete(s.m, sessionID)
+	}
+	for _, id := range s.bound.touch(sessionID) {
+		delete(s.m, id)
+	}
+	if s.m[sessionID] == nil {
+		s.m[sessionID] = make(map[string]pb.Money)
+	}
+	if _, ok := s.m[sessionID][productID]; !ok {
+		s.m[sessionID][productID] = price
+	}
+}
+
+func (s *priceSnapshots) get(sessionID, productID string) (pb.Money, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bound.expired(sessionID) {
+		return pb.Money{}, false
+	}
+	p, ok := s.m[sessionID][productID]
+	return p, ok
+}
+
+// forget drops the snapshots of a session, e.g. once its cart is emptied.
+func (s *priceSnapshots) forget(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, sessionID)
+	s.bound.remove(sessionID)
+}
+
+// priceIncreased reports whether p costs more than when it was added to the
+// session's cart, and returns the snapshotted price.
+func (fe *frontendServer) priceIncreased(sessionID string, p *pb.Product) (pb.Money, bool) {
+	old, ok := fe.prices.get(sessionID, p.GetId())
+	if !ok || !money.AreSameCurrency(old, *p.GetPriceUsd()) {
+		return pb.Money{}, false
+	}
+	diff, err := money.Sum(*p.GetPriceUsd(), money.Negate(old))
+	return old, err == nil && money.IsPositive(diff)
+}
+
+// priceIncreases returns the IDs of the items in cart whose price went up
+// since they were added.
+func (fe *frontendServer) priceIncreases(ctx context.Context, sessionID string, cart []*pb.CartItem) ([]string, error) {
+	var out []string
+	for _, item := range cart {
+		p, err := fe.getProduct(ctx, item.GetProductId())
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fe.priceIncreased(sessionID, p); ok {
+			out = append(out, p.GetId())
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// addSunglasses adds a pair of sunglasses to the test session's cart
+// through the handler, snapshotting their price.
+func addSunglasses(t *testing.T, fe *frontendServer) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	fe.addToCartHandler(w, newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity=1")))
+	if w.Code != http.StatusFound {
+		t.Fatalf("add to cart status = %d, want %d", w.Code, http.StatusFound)
+	}
+}
+
+func checkout(fe *frontendServer, form string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader("email=a@example.com&"+form)))
+	return w
+}
+
+func TestPriceSnapshot_unchanged(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	addSunglasses(t, fe)
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+	if strings.Contains(w.Body.String(), "Price changed") {
+		t.Error("cart page reports a price change for an unchanged price")
+	}
+	if w := checkout(fe, ""); w.Code != http.StatusOK {
+		t.Errorf("checkout status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if n := fb.callCount("PlaceOrder"); n != 1 {
+		t.Errorf("PlaceOrder called %d times, want 1", n)
+	}
+}
+
+func TestPriceSnapshot_increased(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	addSunglasses(t, fe)
+	fb.products[0].PriceUsd = &pb.Money{CurrencyCode: "USD", Units: 24, Nanos: 990000000}
+
+	w := checkout(fe, "")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/cart" {
+		t.Errorf("checkout = %d to %q, want a redirect to /cart for confirmation", w.Code, w.Header().Get("Location"))
+	}
+	if n := fb.callCount("PlaceOrder"); n != 0 {
+		t.Fatalf("PlaceOrder called %d times before the new price was accepted", n)
+	}
+
+	w = httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "Price changed: was USD 19.99 each") || !strings.Contains(body, `name="accept_price_changes"`) {
+		t.Errorf("cart page does not show the price change and ask for confirmation:\n%s", body)
+	}
+
+	if w := checkout(fe, "accept_price_changes=true"); w.Code != http.StatusOK {
+		t.Errorf("confirmed checkout status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if n := fb.callCount("PlaceOrder"); n != 1 {
+		t.Errorf("PlaceOrder called %d times, want 1", n)
+	}
+	if _, ok := fe.prices.get(testSessionID, "OLJCESPC7Z"); ok {
+		t.Error("snapshots were not cleared after the order")
+	}
+}
+
+func TestPriceSnapshot_decreasedIsNotReported(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	addSunglasses(t, fe)
+	fb.products[0].PriceUsd = &pb.Money{CurrencyCode: "USD", Units: 9, Nanos: 990000000}
+
+	if w := checkout(fe, ""); w.Code != http.StatusOK {
+		t.Errorf("checkout status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestPriceSnapshots_evictsSessions(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := &priceSnapshots{bound: sessionBound{ttl: time.Hour, max: 2, now: func() time.Time { return now }}}
+	price := pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000}
+
+	for _, id := range []string{"a", "b", "c"} {
+		s.record(id, "OLJCESPC7Z", price)
+		now = now.Add(time.Second)
+	}
+	if _, ok := s.get("a", "OLJCESPC7Z"); ok {
+		t.Error("snapshot of the least recently used session kept beyond the maximum")
+	}
+	if len(s.m) != 2 {
+		t.Errorf("snapshots kept for %d sessions, want 2", len(s.m))
+	}
+
+	now = now.Add(time.Hour)
+	if _, ok := s.get("c", "OLJCESPC7Z"); ok {
+		t.Error("snapshot kept beyond the TTL")
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	_ "google.golang.org/grpc/balancer/roundrobin" // spreads calls over the SRV targets
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// srvPrefix marks service addresses, e.g.
+	// "srv+_grpc._tcp.cartservice.service.consul", whose endpoints are the
+	// targets of the SRV records of the rest of the address.
+	srvPrefix = "srv+"
+	// srvScheme is the gRPC resolver scheme they are dialed with.
+	srvScheme = "srv"
+
+	defaultSRVRefreshInterval = 30 * time.Second
+)
+
+// dialTarget returns the gRPC target to dial for a service address. Plain
+// host:port addresses are dialed as is.
+func dialTarget(addr string) string {
+	if strings.HasPrefix(addr, srvPrefix) {
+		return srvScheme + ":///" + strings.TrimPrefix(addr, srvPrefix)
+	}
+	return addr
+}
+
+// srvLookuper looks up SRV records, like net.Resolver.
+type srvLookuper interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// srvResolverBuilder builds the resolvers of srv targets, which look the
+// records up again every interval.
+type srvResolverBuilder struct {
+	lookup   srvLookuper
+	interval time.Duration
+}
+
+func (b *srvResolverBuilder) Scheme() string { return srvScheme }
+
+func (b *srvResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	if target.Endpoint == "" {
+		return nil, errors.New("srv: missing record name")
+	}
+	interval := b.interval
+	if interval <= 0 {
+		interval = defaultSRVRefreshInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &srvResolver{
+		name:     target.Endpoint,
+		cc:       cc,
+		lookup:   b.lookup,
+		interval: interval,
+		ctx:      ctx,
+		cancel:   cancel,
+		now:      make(chan struct{}, 1),
+	}
+	r.wg.Add(1)
+	go r.watch()
+	return r, nil
+}
+
+// srvResolver keeps the addresses of a connection up to date with the SRV
+// records of name.
+type srvResolver struct {
+	name     string
+	cc       resolver.ClientConn
+	lookup   srvLookuper
+	interval time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	now    chan struct{} // requests to resolve before the interval is up
+	wg     sync.WaitGroup
+}
+
+func (r *srvResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.now <- struct{}{}:
+	default:
+	}
+}
+
+func (r *srvResolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+func (r *srvResolver) watch() {
+	defer r.wg.Done()
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		r.resolve()
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-t.C:
+		case <-r.now:
+		}
+	}
+}
+
+// resolve looks the records up and updates the connection. Failures are
+// reported to the connection, which keeps the last addresses.
+func (r *srvResolver) resolve() {
+	addrs, err := lookupSRVAddrs(r.ctx, r.lookup, r.name)
+	if err != nil {
+		if r.ctx.Err() == nil {
+			r.cc.ReportError(err)
+		}
+		return
+	}
+	r.cc.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.cc.ParseServiceConfig(`{"loadBalancingPolicy":"round_robin"}`),
+	})
+}
+
+// lookupSRVAddrs returns the host:port of the targets of the SRV records of
+// name, in the order of their priority.
+func lookupSRVAddrs(ctx context.Context, l srvLookuper, name string) ([]resolver.Address, error) {
+	_, srvs, err := l.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "srv: could not look up %s", name)
+	}
+	if len(srvs) == 0 {
+		return nil, errors.Errorf("srv: no records for %s", name)
+	}
+	addrs := make([]resolver.Address, len(srvs))
+	for i, s := range srvs {
+		host := strings.TrimSuffix(s.Target, ".")
+		addrs[i] = resolver.Address{Addr: net.JoinHostPort(host, strconv.Itoa(int(s.Port)))}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// stubSRV answers SRV lookups with records.
+type stubSRV struct {
+	mu      sync.Mutex
+	records []*net.SRV
+}
+
+func (s *stubSRV) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return name, s.records, nil
+}
+
+func (s *stubSRV) set(records ...*net.SRV) {
+	s.mu.Lock()
+	s.records = records
+	s.mu.Unlock()
+}
+
+// fakeClientConn records the states a resolver updates it with, dropping
+// those not received in time.
+type fakeClientConn struct {
+	resolver.ClientConn
+	states chan resolver.State
+}
+
+func (c *fakeClientConn) UpdateState(s resolver.State) {
+	select {
+	case c.states <- s:
+	default:
+	}
+}
+
+func (c *fakeClientConn) ParseServiceConfig(string) *serviceconfig.ParseResult { return nil }
+
+func addrsOf(s resolver.State) []string {
+	var out []string
+	for _, a := range s.Addresses {
+		out = append(out, a.Addr)
+	}
+	return out
+}
+
+func TestSRVResolver(t *testing.T) {
+	lookup := &stubSRV{}
+	lookup.set(
+		&net.SRV{Target: "cart-1.service.consul.", Port: 7070, Priority: 1},
+		&net.SRV{Target: "cart-2.service.consul.", Port: 7071, Priority: 2})
+	cc := &fakeClientConn{states: make(chan resolver.State, 10)}
+	b := &srvResolverBuilder{lookup: lookup, interval: 10 * time.Millisecond}
+
+	r, err := b.Build(resolver.Target{Scheme: srvScheme, Endpoint: "_grpc._tcp.cartservice.service.consul"}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	want := []string{"cart-1.service.consul:7070", "cart-2.service.consul:7071"}
+	if got := addrsOf(<-cc.states); !reflect.DeepEqual(got, want) {
+		t.Errorf("addresses = %v, want %v", got, want)
+	}
+
+	// The records are looked up again periodically.
+	lookup.set(&net.SRV{Target: "cart-3.service.consul.", Port: 7070})
+	want = []string{"cart-3.service.consul:7070"}
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case s := <-cc.states:
+			if reflect.DeepEqual(addrsOf(s), want) {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("addresses not refreshed to %v", want)
+		}
+	}
+}
+
+func TestDialTarget(t *testing.T) {
+	for addr, want := range map[string]string{
+		"cartservice:7070":                      "cartservice:7070",
+		"srv+_grpc._tcp.cartservice.service.dc": "srv:///_grpc._tcp.cartservice.service.dc",
+	} {
+		if got := dialTarget(addr); got != want {
+			t.Errorf("dialTarget(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultStaticDir holds the static assets when STATIC_DIRS is not set.
+const defaultStaticDir = "./static/"
+
+// staticDirs is a file system layering directories over each other: each
+// file is served from the first directory that has it, so that a theme can
+// override some of the default assets without copying the others.
+type staticDirs []string
+
+// parseStaticDirs parses a colon-separated STATIC_DIRS list, in order of
+// precedence, e.g. "./theme/:./static/", checking that each is a directory.
+func parseStaticDirs(s string) (staticDirs, error) {
+	var dirs staticDirs
+	for _, dir := range strings.Split(s, ":") {
+		if dir = strings.TrimSpace(dir); dir == "" {
+			continue
+		}
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		dirs = append(dirs, dir)
+	}
+	if len(dirs) == 0 {
+		return staticDirs{defaultStaticDir}, nil
+	}
+	return dirs, nil
+}
+
+// Open opens name from the first directory that has it.
+func (d staticDirs) Open(name string) (http.File, error) {
+	for _, dir := range d {
+		f, err := http.Dir(dir).Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// lookup returns the directory the file name is served from.
+func (d staticDirs) lookup(name string) (string, bool) {
+	for _, dir := range d {
+		if fileExists(dir, name) {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// imageVariants lists the alternative image formats that can be served in
+// place of the original, in order of preference.
+var imageVariants = []struct {
+	mimeType string
+	ext      string
+}{
+	{"image/avif", ".avif"},
+	{"image/webp", ".webp"},
+}
+
+// negotiateImageFormat serves a same-named AVIF or WebP variant of a JPEG or
+// PNG image from dirs when the client advertises support for it and the
+// variant exists alongside the original, so that an overridden image is not
+// replaced by a variant of the one it overrides. Otherwise the original is
+// served.
+func negotiateImageFormat(dirs staticDirs, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ext := strings.ToLower(path.Ext(r.URL.Path))
+		if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+		root, ok := dirs.lookup(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		accept := r.Header.Get("Accept")
+		for _, v := range imageVariants {
+			if !acceptsMIMEType(accept, v.mimeType) {
+				continue
+			}
+			variant := strings.TrimSuffix(r.URL.Path, path.Ext(r.URL.Path)) + v.ext
+			if !fileExists(root, variant) {
+				continue
+			}
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = variant
+			next.ServeHTTP(w, r2)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// imageMaxAge is how long browsers may cache static images, which only
+// change with a new release.
+const imageMaxAge = 24 * time.Hour
+
+// cacheImages lets browsers cache the images under img/ (product images and
+// the placeholder) for imageMaxAge.
+func cacheImages(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "img/") {
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(imageMaxAge/time.Second)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// imageCDNBase is the origin, and optionally a path prefix, that product
+// images are served from instead of the frontend, as configured by
+// IMAGE_CDN_BASE. Images are served locally when it is empty.
+var imageCDNBase string
+
+// parseImageCDNBase validates an IMAGE_CDN_BASE value, which must be an
+// absolute http or https URL.
+func parseImageCDNBase(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute http or https URL", s)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%q has a query or fragment", s)
+	}
+	return strings.TrimSuffix(s, "/"), nil
+}
+
+// imageURL returns the URL of the image at src on the image CDN, keeping its
+// path. Absolute and protocol-relative URLs, and every URL while no CDN is
+// configured, are returned unchanged.
+func imageURL(src string) string {
+	if imageCDNBase == "" || src == "" {
+		return src
+	}
+	if u, err := url.Parse(src); err != nil || u.Scheme != "" || u.Host != "" {
+		return src
+	}
+	return imageCDNBase + "/" + strings.TrimPrefix(src, "/")
+}
+
+// acceptsMIMEType reports whether the Accept header explicitly lists
+// mimeType with a non-zero quality.
+func acceptsMIMEType(accept, mimeType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), mimeType) {
+			continue
+		}
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// fileExists reports whether the slash-separated name refers to a regular
+// file under root.
+func fileExists(root, name string) bool {
+	fi, err := os.Stat(filepath.Join(root, filepath.FromSlash(path.Clean("/"+name))))
+	return err == nil && fi.Mode().IsRegular()
+}
@@ -0,0 +1,225 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// writeFiles creates the given files (relative path to contents) under a new
+// temporary directory and returns it.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestNegotiateImageFormat(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"img/products/mug.jpg":  "jpeg",
+		"img/products/mug.webp": "webp",
+		"img/products/pen.png":  "png",
+	})
+	h := http.StripPrefix("/static/", negotiateImageFormat(staticDirs{root}, http.FileServer(http.Dir(root))))
+
+	tests := []struct {
+		name   string
+		path   string
+		accept string
+		want   string
+	}{
+		{"no accept", "/static/img/products/mug.jpg", "", "jpeg"},
+		{"webp advertised", "/static/img/products/mug.jpg", "image/avif,image/webp,*/*", "webp"},
+		{"webp refused", "/static/img/products/mug.jpg", "image/webp;q=0,*/*", "jpeg"},
+		{"wildcard only", "/static/img/products/mug.jpg", "image/*", "jpeg"},
+		{"no variant on disk", "/static/img/products/pen.png", "image/avif,image/webp", "png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("served %q, want %q", got, tt.want)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept" {
+				t.Errorf("Vary = %q, want \"Accept\"", got)
+			}
+		})
+	}
+}
+
+func TestCacheImages(t *testing.T) {
+	h := http.StripPrefix("/static/", cacheImages(http.FileServer(http.Dir("./static/"))))
+	tests := map[string]string{
+		"/static/img/placeholder.svg":       "public, max-age=86400",
+		"/static/styles/styles.css":         "",
+		"/static/img/products/camp-mug.jpg": "public, max-age=86400",
+	}
+	for path, want := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: status = %d, want %d", path, w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get("Cache-Control"); got != want {
+			t.Errorf("GET %s: Cache-Control = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestParseImageCDNBase(t *testing.T) {
+	tests := map[string]string{
+		"":                              "",
+		"https://cdn.example.com":       "https://cdn.example.com",
+		"https://cdn.example.com/shop/": "https://cdn.example.com/shop",
+	}
+	for in, want := range tests {
+		if got, err := parseImageCDNBase(in); err != nil || got != want {
+			t.Errorf("parseImageCDNBase(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"cdn.example.com", "/static", "ftp://cdn.example.com", "https://cdn.example.com/?v=1"} {
+		if _, err := parseImageCDNBase(in); err == nil {
+			t.Errorf("parseImageCDNBase(%q) did not fail", in)
+		}
+	}
+}
+
+func TestImageURL(t *testing.T) {
+	defer func(s string) { imageCDNBase = s }(imageCDNBase)
+
+	imageCDNBase = ""
+	if got := imageURL("/static/img/products/watch.jpg"); got != "/static/img/products/watch.jpg" {
+		t.Errorf("imageURL() without a CDN = %q, want the local path", got)
+	}
+
+	imageCDNBase = "https://cdn.example.com/shop"
+	tests := map[string]string{
+		"/static/img/products/watch.jpg":           "https://cdn.example.com/shop/static/img/products/watch.jpg",
+		"static/img/placeholder.svg":               "https://cdn.example.com/shop/static/img/placeholder.svg",
+		"https://images.example.com/watch.jpg":     "https://images.example.com/watch.jpg",
+		"https://cdn.example.com/shop/a/watch.jpg": "https://cdn.example.com/shop/a/watch.jpg",
+		"//images.example.com/watch.jpg":           "//images.example.com/watch.jpg",
+		"":                                         "",
+	}
+	for in, want := range tests {
+		if got := imageURL(in); got != want {
+			t.Errorf("imageURL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestProductHandler_imageCDN(t *testing.T) {
+	defer func(s string) { imageCDNBase = s }(imageCDNBase)
+	imageCDNBase = "https://cdn.example.com"
+	fb := newFakeBackends()
+	fb.recommendations = []string{"66VCHSJNUP"}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	w := httptest.NewRecorder()
+	fe.productHandler(w, r)
+
+	body := w.Body.String()
+	for _, want := range []string{
+		`src="https://cdn.example.com/static/img/products/sunglasses.jpg"`,
+		`src="https://cdn.example.com/static/img/products/tank-top.jpg"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("product page does not contain %s", want)
+		}
+	}
+	if strings.Contains(body, `src="/static/img/products/`) {
+		t.Error("product page still links to locally served product images")
+	}
+}
+
+func TestStaticDirs_override(t *testing.T) {
+	theme := writeFiles(t, map[string]string{
+		"img/logo.svg":         "theme logo",
+		"img/products/mug.jpg": "theme jpeg",
+	})
+	base := writeFiles(t, map[string]string{
+		"img/logo.svg":          "default logo",
+		"img/products/mug.jpg":  "jpeg",
+		"img/products/mug.webp": "webp",
+		"img/products/pen.png":  "png",
+		"styles/styles.css":     "css",
+	})
+	dirs := staticDirs{theme, base}
+	h := http.StripPrefix("/static/", negotiateImageFormat(dirs, http.FileServer(dirs)))
+
+	tests := []struct {
+		path   string
+		accept string
+		code   int
+		want   string
+	}{
+		{"/static/img/logo.svg", "", http.StatusOK, "theme logo"},
+		{"/static/styles/styles.css", "", http.StatusOK, "css"},
+		{"/static/img/products/pen.png", "", http.StatusOK, "png"},
+		// The default's variant does not stand in for an overridden image.
+		{"/static/img/products/mug.jpg", "image/webp", http.StatusOK, "theme jpeg"},
+		{"/static/img/missing.svg", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.Header.Set("Accept", tt.accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("GET %s: status = %d, want %d", tt.path, w.Code, tt.code)
+		}
+		if got := w.Body.String(); tt.code == http.StatusOK && got != tt.want {
+			t.Errorf("GET %s: served %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseStaticDirs(t *testing.T) {
+	if got, err := parseStaticDirs(""); err != nil || !reflect.DeepEqual(got, staticDirs{defaultStaticDir}) {
+		t.Errorf("parseStaticDirs(\"\") = %v, %v, want the default", got, err)
+	}
+	theme, base := t.TempDir(), t.TempDir()
+	if got, err := parseStaticDirs(theme + ":" + base); err != nil || !reflect.DeepEqual(got, staticDirs{theme, base}) {
+		t.Errorf("parseStaticDirs() = %v, %v, want %v", got, err, staticDirs{theme, base})
+	}
+	file := writeFiles(t, map[string]string{"f": ""})
+	for _, in := range []string{filepath.Join(theme, "missing"), filepath.Join(file, "f")} {
+		if _, err := parseStaticDirs(base + ":" + in); err == nil {
+			t.Errorf("parseStaticDirs(%q) did not fail", in)
+		}
+	}
+}
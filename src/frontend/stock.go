@@ -0,0 +1,66 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// parseProductStock parses PRODUCT_STOCK, comma-separated
+// "productID=units" pairs, e.g. "OLJCESPC7Z=3,66VCHSJNUP=0". The catalog does
+// not report stock, so it is configured for the products it matters for.
+func parseProductStock(s string) (map[string]int, error) {
+	stock := make(map[string]int)
+	for _, kv := range splitList(s) {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid stock entry %q, want productID=units", kv)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[i+1:]))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid stock %q for product %q", kv[i+1:], kv[:i])
+		}
+		stock[strings.TrimSpace(kv[:i])] = n
+	}
+	return stock, nil
+}
+
+// productStock returns the number of units of p in stock, and false if it
+// is unknown, i.e. not configured in PRODUCT_STOCK.
+func (fe *frontendServer) productStock(p *pb.Product) (int, bool) {
+	n, ok := fe.stock[p.GetId()]
+	return n, ok
+}
+
+// outOfStock reports whether p is known to be out of stock.
+func (fe *frontendServer) outOfStock(p *pb.Product) bool {
+	n, ok := fe.productStock(p)
+	return ok && n <= 0
+}
+
+// lowStock returns the stock of p if it is below LOW_STOCK_THRESHOLD, for
+// the "Only N left!" badge, and 0 if no badge should be shown: without a
+// threshold, without stock data, or when p is out of stock altogether.
+func (fe *frontendServer) lowStock(p *pb.Product) int {
+	n, ok := fe.productStock(p)
+	if !ok || n <= 0 || n >= fe.lowStockThreshold {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestParseProductStock(t *testing.T) {
+	got, err := parseProductStock("OLJCESPC7Z=3, 66VCHSJNUP = 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"OLJCESPC7Z": 3, "66VCHSJNUP": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseProductStock() = %v, want %v", got, want)
+	}
+	for _, s := range []string{"OLJCESPC7Z", "OLJCESPC7Z=many", "OLJCESPC7Z=-1"} {
+		if _, err := parseProductStock(s); err == nil {
+			t.Errorf("parseProductStock(%q) = nil error", s)
+		}
+	}
+}
+
+func TestLowStock(t *testing.T) {
+	fe := &frontendServer{stock: map[string]int{"FOUR": 4, "FIVE": 5, "NONE": 0}, lowStockThreshold: 5}
+	tests := map[string]int{
+		"FOUR":    4,
+		"FIVE":    0, // at the threshold
+		"NONE":    0, // out of stock
+		"UNKNOWN": 0,
+	}
+	for id, want := range tests {
+		if got := fe.lowStock(&pb.Product{Id: id}); got != want {
+			t.Errorf("lowStock(%s) = %d, want %d", id, got, want)
+		}
+	}
+	if got := (&frontendServer{}).lowStock(&pb.Product{Id: "FOUR"}); got != 0 {
+		t.Errorf("lowStock() without a threshold = %d, want 0", got)
+	}
+}
+
+func TestProductHandler_lowStockBadge(t *testing.T) {
+	tests := []struct {
+		stock map[string]int
+		want  string
+	}{
+		{map[string]int{"OLJCESPC7Z": 2}, "Only 2 left!"},
+		{map[string]int{"OLJCESPC7Z": 3}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		fe := newTestFrontend(t, &frontendServer{stock: tt.stock, lowStockThreshold: 3}, newFakeBackends())
+
+		w := httptest.NewRecorder()
+		r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+		fe.productHandler(w, r)
+
+		body := w.Body.String()
+		if got := strings.Contains(body, "low-stock"); got != (tt.want != "") || !strings.Contains(body, tt.want) {
+			t.Errorf("stock %v: product page badge = %v, want %q", tt.stock, got, tt.want)
+		}
+	}
+}
+
+func TestViewCartHandler_lowStockBadge(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{
+		{ProductId: "OLJCESPC7Z", Quantity: 1},
+		{ProductId: "66VCHSJNUP", Quantity: 1},
+		{ProductId: "1YMWWN1N4O", Quantity: 1},
+	}
+	fe := newTestFrontend(t, &frontendServer{stock: map[string]int{"OLJCESPC7Z": 2, "66VCHSJNUP": 3}, lowStockThreshold: 3}, fb)
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+
+	body := w.Body.String()
+	if n := strings.Count(body, `class="badge badge-warning low-stock"`); n != 1 || !strings.Contains(body, "Only 2 left!") {
+		t.Errorf("cart page has %d low stock badges, want only \"Only 2 left!\":\n%s", n, body)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+// costBreakdown itemizes the total of a cart or order. Every component is in
+// the session currency. Total is the amount charged, the subtotal and the
+// shipping: the tax is only an estimate, which the checkout service does not
+// charge.
+type costBreakdown struct {
+	Subtotal pb.Money
+	Tax      pb.Money
+	Shipping pb.Money
+	Total    pb.Money
+}
+
+// parseTaxRate parses a decimal rate such as "0.0825" within [0, 1].
+func parseTaxRate(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || r.Sign() < 0 || r.Cmp(big.NewRat(1, 1)) > 0 {
+		return nil, fmt.Errorf("invalid tax rate %q", s)
+	}
+	return r, nil
+}
+
+// parseTaxRates parses comma-separated "country=rate" pairs, e.g.
+// "United States=0.0725,Canada=0.13". Countries are matched
+// case-insensitively.
+func parseTaxRates(s string) (map[string]*big.Rat, error) {
+	rates := make(map[string]*big.Rat)
+	for _, kv := range strings.Split(s, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid tax rate entry %q, want country=rate", kv)
+		}
+		r, err := parseTaxRate(kv[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		rates[strings.ToLower(strings.TrimSpace(kv[:i]))] = r
+	}
+	return rates, nil
+}
+
+// taxRate returns the rate for the country, falling back to the flat rate.
+// The downstream services do not compute taxes, so this is an estimate.
+func (fe *frontendServer) taxRate(country string) *big.Rat {
+	if r, ok := fe.taxRates[strings.ToLower(strings.TrimSpace(country))]; ok {
+		return r
+	}
+	if fe.flatTaxRate != nil {
+		return fe.flatTaxRate
+	}
+	return new(big.Rat)
+}
+
+// costBreakdown computes the estimated tax on subtotal for the country and
+// the total charged. The tax follows the rounding policy, or is rounded to
+// the cent without one. If prices are displayed tax-inclusive, the tax is
+// the part of the subtotal it would make up, so that only the breakdown of
+// the amount charged differs.
+func (fe *frontendServer) costBreakdown(subtotal, shipping pb.Money, country string) costBreakdown {
+	rate := fe.taxRate(country)
+	if fe.taxInclusive {
+		rate = new(big.Rat).Quo(rate, new(big.Rat).Add(big.NewRat(1, 1), rate))
+	}
+	return costBreakdown{
+		Subtotal: subtotal,
+		Tax:      fe.tax(subtotal, rate),
+		Shipping: shipping,
+		Total:    money.Must(money.Sum(subtotal, shipping)),
+	}
+}
+
+// tax computes the tax on amount at rate.
+func (fe *frontendServer) tax(amount pb.Money, rate *big.Rat) pb.Money {
+	tax := money.MultiplyRat(amount, rate)
+	if fe.roundingMode == money.RoundNone {
+		tax = money.Round(tax, money.RoundNearest, 10000000)
+	} else {
+		tax = fe.round(tax)
+	}
+	tax.CurrencyCode = amount.GetCurrencyCode()
+	return tax
+}
+
+// parsePriceDisplay parses PRICE_DISPLAY, reporting whether prices are
+// displayed including tax.
+func parsePriceDisplay(s string) (bool, error) {
+	switch s {
+	case "", "exclusive":
+		return false, nil
+	case "inclusive":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown price display %q, want inclusive or exclusive", s)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+	"github.com/GoogleCloudPlatform/microservices-demo/src/frontend/money"
+)
+
+func usd(units int64, nanos int32) pb.Money {
+	return pb.Money{CurrencyCode: "USD", Units: units, Nanos: nanos}
+}
+
+func TestCostBreakdown(t *testing.T) {
+	flat, _ := parseTaxRate("0.0725")
+	rates, err := parseTaxRates("Canada=0.13, united states = 0.0825")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		fe       *frontendServer
+		subtotal pb.Money
+		country  string
+		wantTax  pb.Money
+	}{
+		{"no tax configured", &frontendServer{}, usd(100, 0), "", usd(0, 0)},
+		{"flat rate, rounded to the cent", &frontendServer{flatTaxRate: flat}, usd(19, 990000000), "", usd(1, 450000000)},
+		{"regional rate", &frontendServer{flatTaxRate: flat, taxRates: rates}, usd(100, 0), "United States", usd(8, 250000000)},
+		{"unknown region uses flat rate", &frontendServer{flatTaxRate: flat, taxRates: rates}, usd(100, 0), "Mexico", usd(7, 250000000)},
+		{"rounding policy", &frontendServer{flatTaxRate: flat, roundingMode: money.RoundDown, roundingGranularity: 50000000}, usd(19, 990000000), "", usd(1, 400000000)},
+		{"included in the subtotal", &frontendServer{flatTaxRate: flat, taxInclusive: true}, usd(100, 0), "", usd(6, 760000000)},
+	}
+	shipping := usd(8, 990000000)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.fe.costBreakdown(tt.subtotal, shipping, tt.country)
+			if !money.AreEquals(b.Tax, tt.wantTax) {
+				t.Errorf("tax = %v, want %v", b.Tax, tt.wantTax)
+			}
+			want := money.Must(money.Sum(tt.subtotal, shipping))
+			if !money.AreEquals(b.Total, want) {
+				t.Errorf("total = %v, want subtotal + shipping = %v, without the estimated tax", b.Total, want)
+			}
+		})
+	}
+}
+
+func TestParseTaxRates_invalid(t *testing.T) {
+	for _, s := range []string{"Canada", "Canada=abc", "Canada=-0.1", "Canada=1.5"} {
+		if _, err := parseTaxRates(s); err == nil {
+			t.Errorf("parseTaxRates(%q) = nil error", s)
+		}
+	}
+}
+
+func TestViewCartHandler_rendersBreakdown(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+	flat, _ := parseTaxRate("0.1")
+	fe := newTestFrontend(t, &frontendServer{flatTaxRate: flat}, fb)
+
+	w := httptest.NewRecorder()
+	fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+
+	body := w.Body.String()
+	for _, want := range []string{
+		"Subtotal: <strong>USD 39.98</strong>",
+		"Estimated Tax (not included): <strong>USD 4.00</strong>",
+		"Shipping Cost: <strong>USD 8.99</strong>",
+		"Total Cost: <strong>USD 48.97</strong>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("cart page does not contain %q", want)
+		}
+	}
+}
+
+func TestPlaceOrderHandler_totalPaidIsCharged(t *testing.T) {
+	fb := newFakeBackends()
+	fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}, {ProductId: "66VCHSJNUP", Quantity: 1}}
+	flat, _ := parseTaxRate("0.1")
+	fe := newTestFrontend(t, &frontendServer{flatTaxRate: flat}, fb)
+	var charged pb.Money
+	fb.placeOrder = func(req *pb.PlaceOrderRequest) (*pb.PlaceOrderResponse, error) {
+		fb.placeOrder = nil
+		resp, err := fb.PlaceOrder(context.Background(), req)
+		if err != nil {
+			return nil, err
+		}
+		charged = *resp.GetOrder().GetShippingCost()
+		for _, item := range resp.GetOrder().GetItems() {
+			charged = money.Must(money.Sum(charged, money.MultiplySlow(*item.GetCost(), uint32(item.GetItem().GetQuantity()))))
+		}
+		return resp, nil
+	}
+
+	w := httptest.NewRecorder()
+	fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(testCheckoutForm)))
+
+	if want := `total-paid"><strong>` + renderMoney(charged) + `</strong>`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("order confirmation does not show the charged %s as paid:\n%s", renderMoney(charged), w.Body.String())
+	}
+}
+
+func TestParsePriceDisplay(t *testing.T) {
+	for s, want := range map[string]bool{"": false, "exclusive": false, "inclusive": true} {
+		if got, err := parsePriceDisplay(s); err != nil || got != want {
+			t.Errorf("parsePriceDisplay(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := parsePriceDisplay("gross"); err == nil {
+		t.Error(`parsePriceDisplay("gross") = nil error`)
+	}
+}
+
+func TestPriceDisplay(t *testing.T) {
+	tests := []struct {
+		name         string
+		taxInclusive bool
+		wantProduct  string
+		wantCart     []string
+	}{
+		{"exclusive", false, "USD 19.99", []string{
+			"USD 39.98", "Subtotal: <strong>USD 39.98</strong>", "Estimated Tax (not included): <strong>USD 4.00</strong>"}},
+		{"inclusive", true, "USD 19.99", []string{
+			"USD 39.98", "incl. tax", "Subtotal (incl. tax): <strong>USD 39.98</strong>", "Included Tax: <strong>USD 3.63</strong>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFakeBackends()
+			fb.carts[testSessionID] = []*pb.CartItem{{ProductId: "OLJCESPC7Z", Quantity: 2}}
+			flat, _ := parseTaxRate("0.1")
+			fe := newTestFrontend(t, &frontendServer{flatTaxRate: flat, taxInclusive: tt.taxInclusive}, fb)
+
+			w := httptest.NewRecorder()
+			fe.productHandler(w, mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"}))
+			if body := w.Body.String(); !strings.Contains(body, tt.wantProduct) {
+				t.Errorf("product page does not show the price %q", tt.wantProduct)
+			}
+
+			w = httptest.NewRecorder()
+			fe.viewCartHandler(w, newTestRequest(http.MethodGet, "/cart", nil))
+			body := w.Body.String()
+			for _, want := range append(tt.wantCart, "Total Cost: <strong>USD 48.97</strong>") {
+				if !strings.Contains(body, want) {
+					t.Errorf("cart page does not contain %q", want)
+				}
+			}
+
+			// Only the display differs: the order costs the same either way.
+			w = httptest.NewRecorder()
+			fe.placeOrderHandler(w, newTestRequest(http.MethodPost, "/cart/checkout", strings.NewReader(testCheckoutForm)))
+			if body := w.Body.String(); !strings.Contains(body, `total-paid"><strong>USD 48.97</strong>`) {
+				t.Errorf("order confirmation does not show the total USD 48.97:\n%s", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// defaultAdTimeout bounds ad calls when AD_TIMEOUT is not set, since pages
+// render without ads rather than wait for them.
+const defaultAdTimeout = 100 * time.Millisecond
+
+// serviceTimeoutKeys are the environment variables holding the timeout of
+// the calls to each service, by service label.
+var serviceTimeoutKeys = map[string]string{
+	"adservice":             "AD_TIMEOUT",
+	"cartservice":           "CART_TIMEOUT",
+	"checkoutservice":       "CHECKOUT_TIMEOUT",
+	"currencyservice":       "CURRENCY_TIMEOUT",
+	"productcatalogservice": "PRODUCT_CATALOG_TIMEOUT",
+	"recommendationservice": "RECOMMENDATION_TIMEOUT",
+	"shippingservice":       "SHIPPING_TIMEOUT",
+}
+
+// mustMapServiceTimeouts sets the global downstream timeout from
+// DOWNSTREAM_TIMEOUT and the timeouts of the services that override it.
+func mustMapServiceTimeouts(svc *frontendServer) {
+	mustMapEnvDuration(&svc.downstreamTimeout, "DOWNSTREAM_TIMEOUT")
+	for service, key := range serviceTimeoutKeys {
+		var d time.Duration
+		mustMapEnvDuration(&d, key)
+		if d > 0 {
+			if svc.serviceTimeouts == nil {
+				svc.serviceTimeouts = make(map[string]time.Duration)
+			}
+			svc.serviceTimeouts[service] = d
+		}
+	}
+}
+
+// callTimeout returns the timeout of calls to service, falling back to the
+// global downstream timeout. Zero means no timeout. Unlike other services,
+// ad calls default to a short timeout rather than the global one.
+func (fe *frontendServer) callTimeout(service string) time.Duration {
+	if d, ok := fe.serviceTimeouts[service]; ok {
+		return d
+	}
+	if service == "adservice" {
+		return defaultAdTimeout
+	}
+	return fe.downstreamTimeout
+}
+
+// applyTimeout bounds a call, including its retries, by the timeout of the
+// service it is made to. A shorter deadline already on ctx still applies.
+func (fe *frontendServer) applyTimeout(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if d := fe.callTimeout(serviceLabel(method)); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
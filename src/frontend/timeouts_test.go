@@ -0,0 +1,96 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// deadlineOf calls the method through fe.applyTimeout and returns the time
+// left before the deadline the call was made with, or zero if none.
+func deadlineOf(t *testing.T, fe *frontendServer, method string) time.Duration {
+	t.Helper()
+	var left time.Duration
+	invoker := func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+		if deadline, ok := ctx.Deadline(); ok {
+			left = time.Until(deadline)
+		}
+		return nil
+	}
+	if err := fe.applyTimeout(context.Background(), method, nil, nil, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+	return left
+}
+
+func TestApplyTimeout_perService(t *testing.T) {
+	fe := &frontendServer{
+		downstreamTimeout: 2 * time.Second,
+		serviceTimeouts: map[string]time.Duration{
+			"checkoutservice": 30 * time.Second,
+			"cartservice":     500 * time.Millisecond,
+		},
+	}
+	tests := map[string]time.Duration{
+		"/hipstershop.CheckoutService/PlaceOrder":       30 * time.Second,
+		"/hipstershop.CartService/GetCart":              500 * time.Millisecond,
+		"/hipstershop.ProductCatalogService/GetProduct": 2 * time.Second,
+	}
+	for method, want := range tests {
+		got := deadlineOf(t, fe, method)
+		if got > want || got < want-100*time.Millisecond {
+			t.Errorf("%s called with %v left, want %v", method, got, want)
+		}
+	}
+}
+
+func TestApplyTimeout_none(t *testing.T) {
+	fe := &frontendServer{serviceTimeouts: map[string]time.Duration{"cartservice": time.Second}}
+	if got := deadlineOf(t, fe, "/hipstershop.CurrencyService/Convert"); got != 0 {
+		t.Errorf("call without a configured timeout has %v left, want no deadline", got)
+	}
+}
+
+func TestMustMapServiceTimeouts(t *testing.T) {
+	setenv(t, "DOWNSTREAM_TIMEOUT", "2s")
+	setenv(t, "CHECKOUT_TIMEOUT", "30s")
+	setenv(t, "AD_TIMEOUT", "250ms")
+	svc := new(frontendServer)
+	mustMapServiceTimeouts(svc)
+
+	if got := svc.callTimeout("checkoutservice"); got != 30*time.Second {
+		t.Errorf("checkout timeout = %v, want 30s", got)
+	}
+	if got := svc.callTimeout("cartservice"); got != 2*time.Second {
+		t.Errorf("cart timeout = %v, want the global 2s", got)
+	}
+	if got := svc.callTimeout("adservice"); got != 250*time.Millisecond {
+		t.Errorf("ad timeout = %v, want 250ms", got)
+	}
+	if got := (&frontendServer{downstreamTimeout: 2 * time.Second}).callTimeout("adservice"); got != defaultAdTimeout {
+		t.Errorf("default ad timeout = %v, want %v rather than the global timeout", got, defaultAdTimeout)
+	}
+}
+
+func TestApplyTimeout_ads(t *testing.T) {
+	fe := &frontendServer{downstreamTimeout: 2 * time.Second}
+	if got := deadlineOf(t, fe, "/hipstershop.AdService/GetAds"); got > defaultAdTimeout || got < defaultAdTimeout-50*time.Millisecond {
+		t.Errorf("ad call made with %v left, want the default ad timeout %v", got, defaultAdTimeout)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTLSTestServer serves noopHandler over HTTPS with the TLS configuration
+// of the frontend.
+func newTLSTestServer(t *testing.T, minVersion uint16) *httptest.Server {
+	srv := httptest.NewUnstartedServer(noopHandler)
+	srv.TLS = newTLSConfig(minVersion)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// getWithMaxVersion requests the server root with a client limited to
+// maxVersion, returning the negotiated version.
+func getWithMaxVersion(srv *httptest.Server, maxVersion uint16) (uint16, error) {
+	c := srv.Client()
+	tr := c.Transport.(*http.Transport)
+	tr.TLSClientConfig.MaxVersion = maxVersion
+	resp, err := c.Get(srv.URL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.TLS.Version, nil
+}
+
+func TestTLSConfig_minVersion(t *testing.T) {
+	srv := newTLSTestServer(t, tls.VersionTLS13)
+	if _, err := getWithMaxVersion(srv, tls.VersionTLS12); err == nil {
+		t.Error("TLS 1.2 client connected to a server requiring TLS 1.3")
+	}
+	if v, err := getWithMaxVersion(srv, tls.VersionTLS13); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("negotiated version %x, %v, want TLS 1.3", v, err)
+	}
+}
+
+func TestTLSConfig_defaultMinVersion(t *testing.T) {
+	minVersion, err := parseTLSVersion("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTLSTestServer(t, minVersion)
+	if _, err := getWithMaxVersion(srv, tls.VersionTLS11); err == nil {
+		t.Error("TLS 1.1 client connected with the default minimum version")
+	}
+	if v, err := getWithMaxVersion(srv, tls.VersionTLS12); err != nil || v != tls.VersionTLS12 {
+		t.Errorf("negotiated version %x, %v, want TLS 1.2", v, err)
+	}
+}
+
+func TestParseTLSVersion_invalid(t *testing.T) {
+	for _, v := range []string{"1.1", "TLS1.3", "1"} {
+		if _, err := parseTLSVersion(v); err == nil {
+			t.Errorf("parseTLSVersion(%q) = nil error", v)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// cardLimits are the lengths, in characters, that product names and
+// descriptions are truncated to on product cards so that the cards of a grid
+// line up. They are configured by CARD_NAME_MAX_LENGTH and
+// CARD_DESCRIPTION_MAX_LENGTH, zero disabling truncation.
+var cardLimits = struct{ name, description int }{name: 40, description: 100}
+
+func cardName(s string) string        { return truncateText(s, cardLimits.name) }
+func cardDescription(s string) string { return truncateText(s, cardLimits.description) }
+
+// truncateText shortens s to at most n characters, ending it with an
+// ellipsis. It cuts at the last word boundary unless that would drop more
+// than half of the text kept, and never within a UTF-8 sequence.
+func truncateText(s string, n int) string {
+	if n <= 0 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	kept := runes[:n-1] // leaves room for the ellipsis
+	if !unicode.IsSpace(runes[n-1]) {
+		for i := len(kept) - 1; i >= len(kept)/2; i-- {
+			if unicode.IsSpace(kept[i]) {
+				kept = kept[:i]
+				break
+			}
+		}
+	}
+	return strings.TrimRightFunc(string(kept), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	}) + "…"
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"Sunglasses", 10, "Sunglasses"},
+		{"Sunglasses", 0, "Sunglasses"},
+		{"Vintage Typewriter", 12, "Vintage…"},
+		{"Vintage Typewriter", 9, "Vintage…"},
+		{"Vintage, Typewriter", 10, "Vintage…"},
+		{"Typewriter", 6, "Typew…"},
+		{"Café crème brûlée", 12, "Café crème…"},
+		{"サングラスとタンクトップ", 6, "サングラス…"},
+		{"👓👓👓👓👓👓", 4, "👓👓👓…"},
+		{"Sunglasses", 1, "…"},
+	}
+	for _, tt := range tests {
+		got := truncateText(tt.s, tt.n)
+		if got != tt.want {
+			t.Errorf("truncateText(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncateText(%q, %d) = %q is not valid UTF-8", tt.s, tt.n, got)
+		}
+		if tt.n > 0 && utf8.RuneCountInString(got) > tt.n {
+			t.Errorf("truncateText(%q, %d) = %q is longer than %d characters", tt.s, tt.n, got, tt.n)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type ctxKeyUserID struct{}
+
+// UserResolver maps an incoming request to the ID of the user it is made
+// by, which scopes the cart and appears in the logs. It returns false if
+// the request carries no user, which is then identified by its session.
+type UserResolver interface {
+	ResolveUser(r *http.Request) (string, bool)
+}
+
+// sessionUserResolver identifies every user by their anonymous session. It
+// is the default.
+type sessionUserResolver struct{}
+
+func (sessionUserResolver) ResolveUser(*http.Request) (string, bool) { return "", false }
+
+// jwtUserResolver identifies users by the subject of an HS256-signed JWT
+// read from a header, with an optional "Bearer " prefix. Requests without a
+// valid, unexpired token are anonymous.
+type jwtUserResolver struct {
+	header string
+	secret []byte
+	now    func() time.Time
+}
+
+func newJWTUserResolver(header string, secret []byte) *jwtUserResolver {
+	return &jwtUserResolver{header: header, secret: secret, now: time.Now}
+}
+
+func (j *jwtUserResolver) ResolveUser(r *http.Request) (string, bool) {
+	token := strings.TrimSpace(r.Header.Get(j.header))
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	if token == "" {
+		return "", false
+	}
+	sub, err := j.verify(token)
+	if err != nil {
+		return "", false
+	}
+	return sub, true
+}
+
+// verify checks the signature and expiry of token and returns its subject.
+func (j *jwtUserResolver) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", errors.Wrap(err, "invalid header")
+	}
+	if header.Alg != "HS256" {
+		return "", errors.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.Wrap(err, "invalid signature")
+	}
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", errors.New("signature mismatch")
+	}
+	var claims struct {
+		Sub string `json:"sub"`
+		Exp int64  `json:"exp"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", errors.Wrap(err, "invalid claims")
+	}
+	if claims.Exp != 0 && j.now().Unix() >= claims.Exp {
+		return "", errors.New("token expired")
+	}
+	if claims.Sub == "" {
+		return "", errors.New("token has no subject")
+	}
+	return claims.Sub, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// resolveUser stores the user the request is made by, if any, in its
+// context.
+func (fe *frontendServer) resolveUser(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fe.users != nil {
+			if id, ok := fe.users.ResolveUser(r); ok {
+				r = r.WithContext(context.WithValue(r.Context(), ctxKeyUserID{}, id))
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// userIDPrefix sets the IDs of resolved users apart from session IDs, which
+// clients control through their cookie.
+const userIDPrefix = "user:"
+
+// userID returns the ID scoping the cart of the request: its resolved user,
+// or its session if anonymous.
+func userID(r *http.Request) string {
+	if v, ok := r.Context().Value(ctxKeyUserID{}).(string); ok {
+		return userIDPrefix + v
+	}
+	return sessionID(r)
+}
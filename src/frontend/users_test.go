@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT returns an HS256 token with the claims, signed with secret.
+func signJWT(claims, secret string) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTUserResolver(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	resolver := newJWTUserResolver("Authorization", []byte("s3cret"))
+	resolver.now = func() time.Time { return now }
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+		wantOK bool
+	}{
+		{"valid", "Bearer " + signJWT(`{"sub":"alice","exp":1700000060}`, "s3cret"), "alice", true},
+		{"without bearer", signJWT(`{"sub":"alice"}`, "s3cret"), "alice", true},
+		{"expired", "Bearer " + signJWT(`{"sub":"alice","exp":1699999999}`, "s3cret"), "", false},
+		{"wrong secret", "Bearer " + signJWT(`{"sub":"alice"}`, "other"), "", false},
+		{"no subject", "Bearer " + signJWT(`{"exp":1700000060}`, "s3cret"), "", false},
+		{"malformed", "Bearer not-a-token", "", false},
+		{"absent", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			got, ok := resolver.ResolveUser(r)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("ResolveUser() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestResolveUser_scopesCart(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{users: newJWTUserResolver("X-User-Token", []byte("s3cret"))}, fb)
+	h := fe.resolveUser(http.HandlerFunc(fe.addToCartHandler))
+
+	r := newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity=2"))
+	r.Header.Set("X-User-Token", signJWT(`{"sub":"alice"}`, "s3cret"))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	r = newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=66VCHSJNUP&quantity=1"))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got := fb.carts["user:alice"]; len(got) != 1 || got[0].GetProductId() != "OLJCESPC7Z" {
+		t.Errorf("cart of alice = %v, want the item added with her token", got)
+	}
+	if got := fb.carts[testSessionID]; len(got) != 1 || got[0].GetProductId() != "66VCHSJNUP" {
+		t.Errorf("cart of the anonymous session = %v, want the item added without a token", got)
+	}
+}
+
+func TestResolveUser_sessionCannotClaimUserCart(t *testing.T) {
+	fb := newFakeBackends()
+	fe := newTestFrontend(t, &frontendServer{users: newJWTUserResolver("X-User-Token", []byte("s3cret"))}, fb)
+	h := fe.ensureSessionID(fe.resolveUser(http.HandlerFunc(fe.addToCartHandler)))
+
+	r := newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=OLJCESPC7Z&quantity=2"))
+	r.Header.Set("X-User-Token", signJWT(`{"sub":"alice"}`, "s3cret"))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	for _, session := range []string{"alice", "user:alice"} {
+		r = newTestRequest(http.MethodPost, "/cart", strings.NewReader("product_id=66VCHSJNUP&quantity=1"))
+		r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: session})
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	if got := fb.carts["user:alice"]; len(got) != 1 || got[0].GetProductId() != "OLJCESPC7Z" {
+		t.Errorf("cart of alice = %v, want only the item added with her token", got)
+	}
+	if got := fb.carts["alice"]; len(got) != 1 || got[0].GetProductId() != "66VCHSJNUP" {
+		t.Errorf("cart of the session alice = %v, want the item added with that cookie", got)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+// parseVariantPrices parses comma-separated "productID=price|price" entries,
+// e.g. "OLJCESPC7Z=17.50|26", the USD prices of the variants of products.
+// The catalog does not model variants, so they are configured alongside it.
+func parseVariantPrices(s string) (map[string][]*pb.Money, error) {
+	variants := make(map[string][]*pb.Money)
+	for _, kv := range splitList(s) {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid variant prices entry %q, want productID=price|price", kv)
+		}
+		id := strings.TrimSpace(kv[:i])
+		for _, v := range strings.Split(kv[i+1:], "|") {
+			price, err := parseUSDAmount(v)
+			if err != nil {
+				return nil, fmt.Errorf("product %q: %v", id, err)
+			}
+			if price == nil {
+				return nil, fmt.Errorf("product %q: empty variant price", id)
+			}
+			variants[id] = append(variants[id], price)
+		}
+	}
+	return variants, nil
+}
+
+// variantPrices returns the USD prices of the variants of p: the catalog
+// price, which is that of the variant added to carts, and the configured
+// prices of its other variants.
+func (fe *frontendServer) variantPrices(p *pb.Product) []*pb.Money {
+	return append([]*pb.Money{p.GetPriceUsd()}, fe.productVariants[p.GetId()]...)
+}
+
+// priceRange returns the lowest and highest of prices.
+func priceRange(prices []*pb.Money) (lo, hi *pb.Money) {
+	lo, hi = prices[0], prices[0]
+	for _, p := range prices[1:] {
+		if lessMoney(p, lo) {
+			lo = p
+		}
+		if lessMoney(hi, p) {
+			hi = p
+		}
+	}
+	return lo, hi
+}
+
+// convertPriceRange converts the lowest and highest of prices to currency.
+// max is nil when all prices are the same, sparing a conversion.
+func (fe *frontendServer) convertPriceRange(ctx context.Context, prices []*pb.Money, currency string) (min, max *pb.Money, err error) {
+	lo, hi := priceRange(prices)
+	if min, err = fe.convertCurrency(ctx, lo, currency); err != nil {
+		return nil, nil, err
+	}
+	if !lessMoney(lo, hi) {
+		return min, nil, nil
+	}
+	if max, err = fe.convertCurrency(ctx, hi, currency); err != nil {
+		return nil, nil, err
+	}
+	return min, max, nil
+}
+
+// lessMoney reports whether l is less than r, which must be valid amounts in
+// the same currency.
+func lessMoney(l, r *pb.Money) bool {
+	if l.GetUnits() != r.GetUnits() {
+		return l.GetUnits() < r.GetUnits()
+	}
+	return l.GetNanos() < r.GetNanos()
+}
+
+// renderPriceRange renders a price as "min–max", or min alone when max is
+// nil.
+func renderPriceRange(min, max *pb.Money) string {
+	if max == nil {
+		return renderMoney(*min)
+	}
+	return renderMoney(*min) + "–" + renderMoney(*max)
+}
+
+// renderPriceFrom renders the starting price of a product with variants as
+// "from min", for the compact product cards.
+func renderPriceFrom(min, max *pb.Money) string {
+	if max == nil {
+		return renderMoney(*min)
+	}
+	return "from " + renderMoney(*min)
+}
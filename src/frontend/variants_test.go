@@ -0,0 +1,126 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/frontend/genproto"
+)
+
+func TestRenderPriceRange(t *testing.T) {
+	tests := []struct {
+		min, max  *pb.Money
+		wantRange string
+		wantFrom  string
+	}{
+		{&pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000}, nil,
+			"USD 19.99", "USD 19.99"},
+		{&pb.Money{CurrencyCode: "EUR", Units: 17, Nanos: 500000000}, &pb.Money{CurrencyCode: "EUR", Units: 26},
+			"EUR 17.50–EUR 26.00", "from EUR 17.50"},
+		{&pb.Money{CurrencyCode: "JPY", Units: 2180}, &pb.Money{CurrencyCode: "JPY", Units: 3270},
+			"JPY 2180.00–JPY 3270.00", "from JPY 2180.00"},
+	}
+	for _, tt := range tests {
+		if got := renderPriceRange(tt.min, tt.max); got != tt.wantRange {
+			t.Errorf("renderPriceRange(%v, %v) = %q, want %q", tt.min, tt.max, got, tt.wantRange)
+		}
+		if got := renderPriceFrom(tt.min, tt.max); got != tt.wantFrom {
+			t.Errorf("renderPriceFrom(%v, %v) = %q, want %q", tt.min, tt.max, got, tt.wantFrom)
+		}
+	}
+}
+
+func TestConvertPriceRange(t *testing.T) {
+	fb := newFakeBackends()
+	fb.convert = func(req *pb.CurrencyConversionRequest) (*pb.Money, error) {
+		// 1 USD = 2 EUR, with whole amounts only for simplicity.
+		return &pb.Money{CurrencyCode: req.GetToCode(), Units: req.GetFrom().GetUnits() * 2}, nil
+	}
+	fe := newTestFrontend(t, &frontendServer{}, fb)
+	prices := []*pb.Money{
+		{CurrencyCode: "USD", Units: 15},
+		{CurrencyCode: "USD", Units: 10},
+		{CurrencyCode: "USD", Units: 12, Nanos: 500000000},
+	}
+
+	min, max, err := fe.convertPriceRange(context.Background(), prices, "EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := renderPriceRange(min, max); got != "EUR 20.00–EUR 30.00" {
+		t.Errorf("range = %q, want \"EUR 20.00–EUR 30.00\"", got)
+	}
+
+	min, max, err = fe.convertPriceRange(context.Background(), prices[:1], "EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max != nil || renderMoney(*min) != "EUR 30.00" {
+		t.Errorf("single price = %v, %v, want EUR 30.00 alone", min, max)
+	}
+	if n := fb.callCount("Convert"); n != 3 {
+		t.Errorf("Convert called %d times, want 3", n)
+	}
+}
+
+func TestParseVariantPrices(t *testing.T) {
+	got, err := parseVariantPrices("OLJCESPC7Z=17.50|26, 66VCHSJNUP=20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(got["OLJCESPC7Z"]); n != 2 || renderMoney(*got["OLJCESPC7Z"][1]) != "USD 26.00" {
+		t.Errorf("variants of OLJCESPC7Z = %v, want 17.50 and 26.00", got["OLJCESPC7Z"])
+	}
+	if n := len(got["66VCHSJNUP"]); n != 1 {
+		t.Errorf("variants of 66VCHSJNUP = %v, want 20.00", got["66VCHSJNUP"])
+	}
+	for _, in := range []string{"OLJCESPC7Z", "OLJCESPC7Z=", "OLJCESPC7Z=10|", "OLJCESPC7Z=-1", "OLJCESPC7Z=ten"} {
+		if _, err := parseVariantPrices(in); err == nil {
+			t.Errorf("parseVariantPrices(%q) did not fail", in)
+		}
+	}
+}
+
+func TestVariantPriceRangeRendered(t *testing.T) {
+	variants, err := parseVariantPrices("OLJCESPC7Z=14.99|24.99")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fe := newTestFrontend(t, &frontendServer{productVariants: variants}, newFakeBackends())
+
+	w := httptest.NewRecorder()
+	r := mux.SetURLVars(newTestRequest(http.MethodGet, "/product/OLJCESPC7Z", nil), map[string]string{"id": "OLJCESPC7Z"})
+	fe.productHandler(w, r)
+	if body := w.Body.String(); !strings.Contains(body, "USD 14.99–USD 24.99") {
+		t.Error("product page does not render the price range of the variants")
+	}
+
+	w = httptest.NewRecorder()
+	fe.homeHandler(w, newTestRequest(http.MethodGet, "/", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "from USD 14.99") {
+		t.Error("product card does not render the starting price of the variants")
+	}
+	if !strings.Contains(body, "USD 18.99") || strings.Contains(body, "from USD 18.99") {
+		t.Error("product card of a single-price product is not rendered as before")
+	}
+}